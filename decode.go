@@ -0,0 +1,140 @@
+package main
+
+import (
+	"anaflow/src/anaflow"
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+type decodedRoute struct {
+	Route     string `json:"route"`
+	Nexthop   string `json:"nexthop"`
+	First_asn int32  `json:"first_asn"`
+	Path_len  int32  `json:"path_len"`
+	Pref      int32  `json:"pref"`
+
+	Attrs bgp.RouteAttrs `json:"attrs"`
+}
+
+type decodedUpdate struct {
+	Type     string        `json:"type"`
+	Btime    int64         `json:"btime"`
+	Peer     string        `json:"peer"`
+	Peer_asn uint32        `json:"peer_asn"`
+	Old      *decodedRoute `json:"old,omitempty"`
+	New      *decodedRoute `json:"new,omitempty"`
+}
+
+type decodedFlow struct {
+	Route    string `json:"route"`
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	Src_as   uint32 `json:"src_as"`
+	Dst_as   uint32 `json:"dst_as"`
+	Observer string `json:"observer"`
+	Nexthop  string `json:"nexthop"`
+	Egress   uint16 `json:"egress"`
+	Start_t  int64  `json:"start"`
+	End_t    int64  `json:"end"`
+	Size     uint64 `json:"size"`
+}
+
+func decodeRoute(ip uint32, prefix int32, nexthop uint32, asn int32, path_len int32, pref int32, attrs *bgp.RouteAttrs) *decodedRoute {
+	if ip == 0 && prefix == 0 && nexthop == 0 {
+		return nil
+	}
+	return &decodedRoute{
+		Route:     util.RouteString(uint64(ip)<<8 + uint64(prefix)),
+		Nexthop:   util.IPint2string(nexthop),
+		First_asn: asn,
+		Path_len:  path_len,
+		Pref:      pref,
+		Attrs:     *attrs,
+	}
+}
+
+func decodeUpdate(bu *bgp.BgpInfo) decodedUpdate {
+	d := decodedUpdate{
+		Type:     fmt.Sprintf("unknown(%d)", bu.Msg_type),
+		Btime:    bu.Btime,
+		Peer:     util.IPint2string(bu.Peer_addr),
+		Peer_asn: bu.Peer_asn,
+	}
+	switch bu.Msg_type {
+	case bgp.BGP_ADD:
+		d.Type = "add"
+	case bgp.BGP_DELETE:
+		d.Type = "delete"
+	case bgp.BGP_UPDATE:
+		d.Type = "update"
+	}
+	d.Old = decodeRoute(bu.Old_ip_addr, bu.Old_ip_prefix, bu.Old_nexthop, bu.Old_first_asn, bu.Old_path_len, bu.Old_pref, &bu.Old_attrs)
+	d.New = decodeRoute(bu.New_ip_addr, bu.New_ip_prefix, bu.New_nexthop, bu.New_first_asn, bu.New_path_len, bu.New_pref, &bu.New_attrs)
+	return d
+}
+
+func decodeFlow(f *bgp.Flow) decodedFlow {
+	return decodedFlow{
+		Route:    util.RouteString(uint64(f.Route)<<8 + uint64(f.Prefix)),
+		Src:      util.IPint2string(f.Src_ip),
+		Dst:      util.IPint2string(f.Dst_ip),
+		Src_as:   f.Src_as,
+		Dst_as:   f.Dst_as,
+		Observer: util.IPint2string(f.Observer_ip),
+		Nexthop:  util.IPint2string(f.Nh_ip),
+		Egress:   f.Egress_id,
+		Start_t:  f.Start_t,
+		End_t:    f.End_t,
+		Size:     f.Size,
+	}
+}
+
+// anaflow decode bgp|loki [file]
+//
+// Prints the BgpInfo packets or the flows of a Loki response in the file, or
+// stdin, as JSON.
+func runDecode(args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: anaflow decode bgp|loki [file]")
+	}
+	fs.Parse(args)
+
+	in := io.Reader(os.Stdin)
+	if name := fs.Arg(1); name != "" && name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		in = file
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	var err error
+	switch fs.Arg(0) {
+	case "bgp":
+		_, err = anaflow.ReadPackets(in, func(bu bgp.BgpInfo) { enc.Encode(decodeUpdate(&bu)) })
+	case "loki":
+		var body []byte
+		body, err = io.ReadAll(in)
+		if err == nil {
+			_, err = anaflow.DecodeLoki(body, func(f bgp.Flow) { enc.Encode(decodeFlow(&f)) })
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"anaflow/src/store"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// anaflow history [-db file | -api url] [-from t] [-to t] [-prefix p] [-dst ip] [-type t] [-limit n] [-details]
+//
+// Reads the store directly, which needs the daemon to be stopped, or asks the
+// /api/history endpoint of a running instance.
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	db := fs.String("db", "./scope.db", "store file")
+	api := fs.String("api", "", "base URL of a running instance, e.g. http://127.0.0.1:8080")
+	v := url.Values{}
+	for _, name := range []string{"from", "to", "prefix", "dst", "type", "limit"} {
+		name := name
+		fs.Func(name, name+" filter", func(s string) error {
+			v.Set(name, s)
+			return nil
+		})
+	}
+	details := fs.Bool("details", false, "include the per-destination records")
+	fs.Parse(args)
+	if *details {
+		v.Set("details", "1")
+	}
+
+	if *api != "" {
+		resp, err := http.Get(*api + "/api/history?" + v.Encode())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer resp.Body.Close()
+		io.Copy(os.Stdout, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return 1
+		}
+		return 0
+	}
+
+	q, err := store.ParseQuery(v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s, err := store.Open(*db, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open %s (is the daemon running? use -api): %s\n", *db, err)
+		return 1
+	}
+	defer s.Close()
+
+	records, err := s.Query(q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if records == nil {
+		records = []store.Record{}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(records)
+	return 0
+}
@@ -1,72 +1,234 @@
 package main
 
 import (
+	"anaflow/src/alert"
 	"anaflow/src/anaflow"
+	"anaflow/src/bgp"
+	"anaflow/src/config"
 	"anaflow/src/util"
 	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"flag"
 	"fmt"
+	"io"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
-
-	"github.com/spf13/viper"
+	"os/exec"
+	"strings"
 )
 
+const usage = `Usage: anaflow <command> [flags]
+
+Commands:
+  run              run the daemon (default)
+  replay           analyse saved Loki responses and BGP packets offline
+  query            ask a running instance (dst, prefix, pending, topn, metrics)
+  history          query the stored scope results
+  validate-config  check the config file and exit
+  decode           pretty-print BGP packets or a Loki response
+
+Run "anaflow <command> -h" for the flags of a command.
+`
+
 func main() {
-	// read config from config.toml
-	viper.SetConfigFile("./config.toml")
-	err := viper.ReadInConfig()
-	util.PanicError(err, "Config Set error.")
-
-	server_list := viper.GetStringSlice("url.servers")
-	url_path := viper.GetString("url.base_path")
-	interval := viper.GetInt64("query_params.interval")
-	loki_delay := viper.GetInt64("query_params.delay")
-	limit := interval * viper.GetInt64("query_params.limit_per_sec")
-
-	delay := viper.GetInt64("time_settings.delay")
-	agetime := viper.GetInt64("time_settings.agetime")
-	syncdevi := viper.GetInt64("time_settings.syncdevi")
-
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, syscall.SIGTERM, syscall.SIGINT)
-
-	ticker_flow := time.NewTicker(time.Duration(interval) * time.Second)
-	defer ticker_flow.Stop()
-	ticker_update := time.NewTicker(1 * time.Second)
-	defer ticker_update.Stop()
-
-	log_file := "./scope.log"
-	file, err := os.OpenFile(log_file, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0666)
-	util.CheckError(err)
-	defer file.Close()
+	cmd := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
 
+	switch cmd {
+	case "run":
+		os.Exit(runDaemon(args))
+	case "replay":
+		os.Exit(runReplay(args))
+	case "query":
+		os.Exit(runQuery(args))
+	case "history":
+		os.Exit(runHistory(args))
+	case "validate-config":
+		os.Exit(runValidate(args))
+	case "decode":
+		os.Exit(runDecode(args))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// Flags shared by the commands that load the config
+type options struct {
+	config    string
+	log_file  string
+	socket    string
+	log_level string
+}
+
+func commonFlags(fs *flag.FlagSet) *options {
+	o := new(options)
+	fs.StringVar(&o.config, "config", "./config.toml", "config file")
+	fs.StringVar(&o.log_file, "log", "./scope.log", "scope log file")
+	fs.StringVar(&o.socket, "socket", "/tmp/c2gsocket", "unixgram socket BIRD sends the updates to")
+	fs.StringVar(&o.log_level, "log-level", "info", "debug, info, warn or error")
+	return o
+}
+
+// Set the log level, read and validate the config file
+func (o *options) load() (*config.Config, error) {
+	level, err := util.ParseLogLevel(o.log_level)
+	if err != nil {
+		return nil, err
+	}
+	util.Log_level = level
+	return config.Load(o.config)
+}
+
+func (o *options) openLog() (*os.File, error) {
+	file, err := os.OpenFile(o.log_file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
 	anaflow.File_writer = bufio.NewWriter(file)
+	return file, nil
+}
 
-	go anaflow.RunBgpReceiver(anaflow.Updata_queue)
+// Apply the analysis settings of the config: windows, rollups, events and rankings
+func setupAnalysis(cfg *config.Config) {
+	anaflow.Sketch_memory = 0
+	if ap := &cfg.Approximate; ap.Enabled {
+		anaflow.Sketch_memory = ap.Memory_mb << 20
+		anaflow.Sketch_depth = ap.Depth
+		anaflow.Sketch_heavy = ap.Heavy_hitters
+	}
+	anaflow.SetupWindows(cfg.Time_settings.Agetime, cfg.Time_settings.Syncdevi, cfg.WindowAgetimes()[1:])
 
-	go func() {
-		for {
-			ut := <-ticker_update.C
-			anaflow.GivenCurrentTime(int64(ut.Unix()), delay, agetime, syncdevi)
+	anaflow.Window_overrides = nil
+	for _, o := range cfg.Windows.Override {
+		wo := anaflow.WindowOverride{Windows: o.Windows}
+		if o.Prefix != "" {
+			wo.Route, _ = util.ParseRoute(o.Prefix)
+		}
+		if o.Peer != "" {
+			wo.Nexthop = util.IPbyte2int([]byte(o.Peer))
 		}
-	}()
+		anaflow.Window_overrides = append(anaflow.Window_overrides, wo)
+	}
+
+	applySettings(cfg)
+}
+
+// Bound the queues of the windows as the [queues] section says. Only the
+// daemon does: a replay pushes and ticks in turn and would block on itself.
+func boundQueues(cfg *config.Config) {
+	q := &cfg.Queues
+	policy, _ := util.ParseOverloadPolicy(q.Policy)
+	anaflow.BoundQueues(
+		util.Bound{Capacity: q.Max_flows, Policy: policy, Sample: q.Sample_rate},
+		util.Bound{Capacity: q.Max_updates, Policy: policy, Sample: q.Sample_rate})
+}
 
-	for {
-		select {
-		case t := <-ticker_flow.C:
-			utime := t.Unix() - loki_delay
-			for _, u := range server_list {
-				url := fmt.Sprintf("%s%s&start=%d000000000&end=%d999999999&limit=%d", u, url_path, utime-interval, utime-1, limit)
+// Apply the settings a reload may change, with State_mu held once running
+func applySettings(cfg *config.Config) {
+	anaflow.Rollup_bucket = cfg.Rollup.Bucket
+	anaflow.Conv_fraction = cfg.Convergence.Fraction
+	anaflow.Conv_smooth = cfg.Convergence.Smooth
+	anaflow.Event_gap = cfg.Event.Gap
+	anaflow.Topn_n = cfg.Topn.N
+	anaflow.Topn_windows = cfg.Topn.Windows
+	anaflow.Topn_report = cfg.Topn.Report_interval
+}
+
+// Enable the RIB view and load the table of the [rib] section, if any
+func loadRib(cfg *config.Config) error {
+	rib := &cfg.Rib
+	if rib.View {
+		anaflow.EnableRibView()
+	}
 
-				go anaflow.RequestLoki(utime, url)
+	var name string
+	var r io.Reader
+	var read func(io.Reader, func(bgp.TableEntry)) (int, error)
+	switch {
+	case rib.Mrt_file != "":
+		file, err := os.Open(rib.Mrt_file)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		name, r, read = "mrt:"+rib.Mrt_file, file, bgp.ReadMrt
+		switch {
+		case strings.HasSuffix(rib.Mrt_file, ".gz"):
+			if r, err = gzip.NewReader(file); err != nil {
+				return fmt.Errorf("%s: %w", rib.Mrt_file, err)
 			}
-		case s := <-sigint:
-			ticker_flow.Stop()
-			ticker_update.Stop()
-			fmt.Println("Receive Signal s=", s)
-			os.Exit(1)
+		case strings.HasSuffix(rib.Mrt_file, ".bz2"):
+			r = bzip2.NewReader(file)
+		}
+	case rib.Birdc_file != "":
+		file, err := os.Open(rib.Birdc_file)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		name, r, read = "birdc:"+rib.Birdc_file, file, bgp.ReadBirdc
+	case rib.Birdc_command != "":
+		cmd := exec.Command("sh", "-c", rib.Birdc_command)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
 		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+		name, r, read = "birdc:"+rib.Birdc_command, out, bgp.ReadBirdc
+	default:
+		return nil
+	}
+
+	table := anaflow.NewRibSync(name)
+	if _, err := read(r, table.Add); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	table.End()
+	return nil
+}
+
+func alertConfig(cfg *config.Config) alert.Config {
+	a := &cfg.Alerts
+	ac := alert.Config{
+		Webhooks:  a.Webhooks,
+		Retries:   a.Retries,
+		Dedup:     a.Dedup,
+		RateLimit: a.Rate_limit,
+	}
+	for _, r := range a.Rule {
+		rule := alert.Rule{Name: r.Name, MinBytes: r.Min_bytes, MinDsts: r.Min_dsts, BlackholeBytes: r.Blackhole_bytes}
+		for _, p := range r.Watchlist {
+			route, _ := util.ParseRoute(p)
+			rule.Watchlist = append(rule.Watchlist, route)
+		}
+		ac.Rules = append(ac.Rules, rule)
+	}
+	return ac
+}
+
+// anaflow validate-config [-config file]
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	o := commonFlags(fs)
+	fs.Parse(args)
+
+	if _, err := o.load(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
+	fmt.Printf("%s is valid\n", o.config)
+	return 0
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"anaflow/src/config"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const queryUsage = `Usage: anaflow query [-api url | -config file] <what> [arg]
+
+  dst <ip>          routes and flows of a destination
+  prefix <cidr>     destinations behind a route
+  pending           updates waiting for their post window
+  topn [window]     largest updates of the ranking window (seconds)
+  metrics           Prometheus metrics
+`
+
+// anaflow query [-api url | -config file] <what> [arg]
+//
+// The API address defaults to api.listen of the config file.
+func runQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), queryUsage)
+		fs.PrintDefaults()
+	}
+	api := fs.String("api", "", "base URL of a running instance, e.g. http://127.0.0.1:8080")
+	config_file := fs.String("config", "./config.toml", "config file giving api.listen when -api is not set")
+	fs.Parse(args)
+
+	if *api == "" {
+		cfg, err := config.Load(*config_file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if cfg.Api.Listen == "" {
+			fmt.Fprintf(os.Stderr, "The API is disabled in %s, give -api\n", *config_file)
+			return 1
+		}
+		*api = "http://" + cfg.Api.Listen
+	}
+
+	v := url.Values{}
+	var path string
+	switch what, arg := fs.Arg(0), fs.Arg(1); {
+	case what == "dst" && arg != "":
+		path = "/api/dst"
+		v.Set("ip", arg)
+	case what == "prefix" && arg != "":
+		path = "/api/prefix"
+		v.Set("prefix", arg)
+	case what == "pending":
+		path = "/api/pending"
+	case what == "topn":
+		path = "/api/topn"
+		if arg != "" {
+			v.Set("window", arg)
+		}
+	case what == "metrics":
+		path = "/metrics"
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	u := strings.TrimRight(*api, "/") + path
+	if len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
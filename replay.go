@@ -0,0 +1,111 @@
+package main
+
+import (
+	"anaflow/src/anaflow"
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// anaflow replay -flows f1.json,f2.json -updates file [-config file] [-log file] [-log-level level]
+//
+// Feeds saved Loki responses and a file of BIRD packets through the analysis
+// with a clock advanced second by second from the oldest flow or update, then
+// drains the pending updates. Flows are pushed once the clock passes their end
+// time and updates once it passes their Btime, as the daemon would see them.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	o := commonFlags(fs)
+	flows_arg := fs.String("flows", "", "comma separated files of Loki query_range responses")
+	updates_arg := fs.String("updates", "", "file of consecutive BgpInfo packets")
+	fs.Parse(args)
+
+	cfg, err := o.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	setupAnalysis(cfg)
+	if err := loadRib(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	delay := cfg.Time_settings.Delay
+
+	var flows []bgp.Flow
+	if *flows_arg != "" {
+		for _, name := range strings.Split(*flows_arg, ",") {
+			body, err := os.ReadFile(name)
+			if err == nil {
+				_, err = anaflow.DecodeLoki(body, func(f bgp.Flow) { flows = append(flows, f) })
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+				return 1
+			}
+		}
+	}
+	var updates []bgp.BgpInfo
+	if *updates_arg != "" {
+		file, err := os.Open(*updates_arg)
+		if err == nil {
+			_, err = anaflow.ReadPackets(file, func(bu bgp.BgpInfo) { updates = append(updates, bu) })
+			file.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *updates_arg, err)
+			return 1
+		}
+	}
+	if len(flows) == 0 && len(updates) == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to replay, give -flows and/or -updates")
+		return 1
+	}
+	sort.SliceStable(flows, func(i, j int) bool { return flows[i].End_t < flows[j].End_t })
+	sort.SliceStable(updates, func(i, j int) bool { return updates[i].Btime < updates[j].Btime })
+
+	file, err := o.openLog()
+	if util.CheckError(err) {
+		return 1
+	}
+	defer file.Close()
+
+	var utime, end int64
+	if len(flows) > 0 {
+		utime, end = flows[0].End_t, flows[len(flows)-1].End_t
+	}
+	if len(updates) > 0 {
+		if utime == 0 || updates[0].Btime < utime {
+			utime = updates[0].Btime
+		}
+		if last := updates[len(updates)-1].Btime; last > end {
+			end = last
+		}
+	}
+
+	fi, ui := 0, 0
+	for ; utime <= end; utime++ {
+		for fi < len(flows) && flows[fi].End_t <= utime {
+			anaflow.AddFlow2Q(flows[fi])
+			fi++
+		}
+		for ui < len(updates) && updates[ui].Btime <= utime {
+			anaflow.AddUpdate2Q(updates[ui])
+			ui++
+		}
+		anaflow.GivenCurrentTime(utime, delay)
+	}
+	utime = anaflow.Drain(utime, delay)
+	util.Infof("Replayed %d flows and %d updates up to %d\n", len(flows), len(updates), utime)
+
+	util.CheckError(anaflow.FlushReports())
+	anaflow.CloseSinks()
+	if util.CheckError(file.Close()) {
+		return 1
+	}
+	return 0
+}
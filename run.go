@@ -0,0 +1,340 @@
+package main
+
+import (
+	"anaflow/src/alert"
+	"anaflow/src/anaflow"
+	"anaflow/src/config"
+	"anaflow/src/metrics"
+	"anaflow/src/store"
+	"anaflow/src/stream"
+	"anaflow/src/util"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Parts of the daemon a reload can change. cfg and alerter belong to the main
+// loop, the atomics are also read by the update and API goroutines.
+type daemon struct {
+	cfg     *config.Config
+	alerter *alert.Alerter
+
+	history        atomic.Pointer[store.Store]
+	flush_interval atomic.Int64
+	ckpt_interval  atomic.Int64
+}
+
+func (d *daemon) setStore(path string) error {
+	var s *store.Store
+	if path != "" {
+		var err error
+		if s, err = store.Open(path, false); err != nil {
+			return err
+		}
+		anaflow.AddSink(s)
+	}
+	if old := d.history.Swap(s); old != nil {
+		anaflow.RemoveSink(old)
+		util.CheckError(old.Close())
+	}
+	return nil
+}
+
+func (d *daemon) setAlerts(cfg *config.Config) {
+	switch {
+	case len(cfg.Alerts.Rule) > 0 && d.alerter != nil:
+		d.alerter.SetConfig(alertConfig(cfg))
+	case len(cfg.Alerts.Rule) > 0:
+		d.alerter = alert.New(alertConfig(cfg))
+		anaflow.AddSink(d.alerter)
+	case d.alerter != nil:
+		anaflow.RemoveSink(d.alerter)
+		util.CheckError(d.alerter.Close())
+		d.alerter = nil
+	}
+}
+
+func (d *daemon) historyHandler(w http.ResponseWriter, r *http.Request) {
+	s := d.history.Load()
+	if s == nil {
+		http.Error(w, "the store is disabled", http.StatusNotFound)
+		return
+	}
+	s.Handler().ServeHTTP(w, r)
+}
+
+// The unixgram socket, the stream listeners of the [receiver] section, the
+// BGP speaker and the feeds
+func updateSources(socket string, cfg *config.Config) ([]anaflow.UpdateSource, error) {
+	sources := []anaflow.UpdateSource{&anaflow.DatagramSource{Path: socket}}
+	if sp := &cfg.Speaker; sp.Listen != "" {
+		speaker := &anaflow.BgpSpeaker{
+			Listen:    sp.Listen,
+			Asn:       uint32(sp.Asn),
+			Router_id: util.IPbyte2int([]byte(sp.Router_id)),
+			Hold_time: uint16(sp.Hold_time),
+		}
+		for _, n := range sp.Neighbor {
+			speaker.Neighbors = append(speaker.Neighbors, anaflow.Neighbor{Addr: util.IPbyte2int([]byte(n.Address)), Asn: uint32(n.Asn)})
+		}
+		sources = append(sources, speaker)
+	}
+	for _, f := range cfg.Feed {
+		sources = append(sources, &anaflow.FeedSource{Format: f.Format, Path: f.Path, Socket: f.Socket})
+	}
+
+	r := &cfg.Receiver
+	if r.Unix_stream != "" {
+		sources = append(sources, &anaflow.StreamSource{Network: "unix", Addr: r.Unix_stream, Dump_request: cfg.Rib.Dump_request})
+	}
+	if r.Tcp_listen != "" {
+		src := &anaflow.StreamSource{Network: "tcp", Addr: r.Tcp_listen, Dump_request: cfg.Rib.Dump_request}
+		if r.Tls_cert != "" {
+			cert, err := tls.LoadX509KeyPair(r.Tls_cert, r.Tls_key)
+			if err != nil {
+				return nil, err
+			}
+			src.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+			if r.Tls_client_ca != "" {
+				pem, err := os.ReadFile(r.Tls_client_ca)
+				if err != nil {
+					return nil, err
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("%s: no certificate", r.Tls_client_ca)
+				}
+				src.TLS.ClientCAs = pool
+				src.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// Apply the config file again. The flow and route state is kept, settings
+// that need a restart keep their running value.
+func (d *daemon) reload(path string) {
+	cfg, kept, err := config.Reload(d.cfg, path)
+	for _, k := range kept {
+		util.Warnf("Reload: %s\n", k)
+	}
+	if err != nil {
+		util.Errorf("Reload rejected, keeping the running config: %s\n", err)
+		return
+	}
+
+	if cfg.Store.Path != d.cfg.Store.Path {
+		if err := d.setStore(cfg.Store.Path); err != nil {
+			util.Errorf("Reload: cannot open store %s, keeping %s: %s\n", cfg.Store.Path, d.cfg.Store.Path, err)
+			cfg.Store.Path = d.cfg.Store.Path
+		}
+	}
+	d.setAlerts(cfg)
+
+	anaflow.State_mu.Lock()
+	applySettings(cfg)
+	anaflow.State_mu.Unlock()
+	d.flush_interval.Store(cfg.Output.Flush_interval)
+	d.ckpt_interval.Store(cfg.Checkpoint.Interval)
+
+	d.cfg = cfg
+	util.Infof("Reloaded %s\n", path)
+}
+
+// anaflow run [-config file] [-log file] [-socket path] [-log-level level] [-watch=false]
+//
+// SIGHUP, or a write to the config file unless -watch=false, reloads the config.
+func runDaemon(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	o := commonFlags(fs)
+	watch := fs.Bool("watch", true, "reload the config when its file changes")
+	fs.Parse(args)
+
+	cfg, err := o.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	setupAnalysis(cfg)
+	d := &daemon{cfg: cfg}
+	d.flush_interval.Store(cfg.Output.Flush_interval)
+	d.ckpt_interval.Store(cfg.Checkpoint.Interval)
+
+	// fixed until restart
+	delay := cfg.Time_settings.Delay
+	ckpt_file := cfg.Checkpoint.File
+	api_listen := cfg.Api.Listen
+
+	if ckpt_file != "" {
+		saved_at, err := anaflow.LoadCheckpoint(ckpt_file)
+		if err == nil {
+			util.Infof("Restored checkpoint %s taken at %d\n", ckpt_file, saved_at)
+		} else if !os.IsNotExist(err) {
+			util.Warnf("Cannot restore checkpoint %s: %s\n", ckpt_file, err.Error())
+		}
+	}
+	if err := loadRib(cfg); err != nil {
+		util.Warnf("Cannot load the RIB: %s\n", err.Error())
+	}
+	// after the restore, which must not shed
+	boundQueues(cfg)
+
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, syscall.SIGTERM, syscall.SIGINT)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	if *watch {
+		config.Watch(o.config, func() {
+			select {
+			case reload <- syscall.SIGHUP:
+			default:
+			}
+		})
+	}
+
+	ticker_flow := time.NewTicker(time.Duration(cfg.Query_params.Interval) * time.Second)
+	defer ticker_flow.Stop()
+	ticker_update := time.NewTicker(1 * time.Second)
+	defer ticker_update.Stop()
+
+	file, err := o.openLog()
+	if util.CheckError(err) {
+		return 1
+	}
+	// closed with its error checked on shutdown, here on the early returns
+	log_closed := false
+	defer func() {
+		if !log_closed {
+			file.Close()
+		}
+	}()
+
+	if util.CheckError(d.setStore(cfg.Store.Path)) {
+		return 1
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	sources, err := updateSources(o.socket, cfg)
+	if util.CheckError(err) {
+		return 1
+	}
+	anaflow.Max_pending_updates = cfg.Receiver.Max_pending
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src anaflow.UpdateSource) {
+			defer wg.Done()
+			if err := src.Run(done); err != nil {
+				util.Errorf("Source %s: %s\n", src.Name(), err.Error())
+			}
+		}(src)
+	}
+
+	d.setAlerts(cfg)
+
+	api_mux := anaflow.NewAPIMux()
+	api_mux.Handle("/metrics", metrics.Default.Handler())
+	api_mux.HandleFunc("/api/history", d.historyHandler)
+	if api_listen != "" {
+		hub := stream.NewHub()
+		anaflow.AddSink(hub)
+		api_mux.Handle("/api/stream", hub)
+	}
+	api_server := &http.Server{Addr: api_listen, Handler: api_mux}
+	if api_listen != "" {
+		go func() {
+			err := api_server.ListenAndServe()
+			if err != http.ErrServerClosed {
+				util.CheckError(err)
+			}
+		}()
+	}
+
+	last_utime := time.Now().Unix()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var last_ckpt, last_flush int64
+		for {
+			var ut time.Time
+			select {
+			case <-done:
+				return
+			case ut = <-ticker_update.C:
+			}
+			last_utime = ut.Unix()
+			anaflow.GivenCurrentTime(last_utime, delay)
+
+			if flush_interval := d.flush_interval.Load(); flush_interval > 0 && last_utime-last_flush >= flush_interval {
+				last_flush = last_utime
+				util.CheckError(anaflow.FlushOutput())
+			}
+			if ckpt_interval := d.ckpt_interval.Load(); ckpt_file != "" && ckpt_interval > 0 && last_utime-last_ckpt >= ckpt_interval {
+				last_ckpt = last_utime
+				util.CheckError(anaflow.SaveCheckpoint(ckpt_file, last_ckpt))
+			}
+		}
+	}()
+
+	// start of the flows not asked for yet, per Loki server
+	loki_from := make(map[string]int64)
+	for {
+		select {
+		case t := <-ticker_flow.C:
+			q := &d.cfg.Query_params
+			utime := t.Unix() - q.Loki_delay
+			for _, u := range d.cfg.Url.Servers {
+				from, ok := loki_from[u]
+				if !ok {
+					from = utime - q.Interval
+				}
+				limit := (utime - from) * q.Limit_per_sec
+				url := fmt.Sprintf("%s%s&start=%d000000000&end=%d999999999&limit=%d", u, d.cfg.Url.Base_path, from, utime-1, limit)
+
+				if anaflow.StartLoki(utime, u, url) {
+					loki_from[u] = utime
+				}
+			}
+		case <-reload:
+			interval := d.cfg.Query_params.Interval
+			d.reload(o.config)
+			if d.cfg.Query_params.Interval != interval {
+				ticker_flow.Reset(time.Duration(d.cfg.Query_params.Interval) * time.Second)
+			}
+		case s := <-sigint:
+			util.Infof("Receive Signal s= %v\n", s)
+
+			// stop the sources and wait for the current tick to finish
+			ticker_flow.Stop()
+			ticker_update.Stop()
+			close(done)
+			anaflow.CloseQueues()
+			wg.Wait()
+			api_server.Close()
+
+			// a checkpoint of a drained state would replay the drained updates
+			if d.cfg.Shutdown.Drain {
+				last_utime = anaflow.Drain(last_utime, delay)
+				util.Infof("Drained pending updates up to %d\n", last_utime)
+			} else if ckpt_file != "" {
+				util.CheckError(anaflow.SaveCheckpoint(ckpt_file, last_utime))
+			}
+			util.CheckError(anaflow.FlushReports())
+			anaflow.CloseSinks()
+			log_closed = true
+			util.CheckError(file.Close())
+			return 0
+		}
+	}
+}
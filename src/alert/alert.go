@@ -0,0 +1,286 @@
+/*
+Webhook alerting on high-impact updates.
+
+Rules are evaluated on every handled update and on every routing event, the
+updates of a session reset taken together. A rule matches when all of its set
+conditions hold; watchlist and blackhole rules only match single updates.
+Matches are deduplicated per rule and route, rate limited, and POSTed as JSON
+to every webhook with retries by a background sender, so that the analysis
+goroutine never waits on the network.
+*/
+package alert
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/metrics"
+	"anaflow/src/util"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Rule struct {
+	Name           string
+	MinBytes       uint64   // bytes moved
+	MinDsts        int      // destinations affected
+	BlackholeBytes uint64   // bytes of destinations left without a route
+	Watchlist      []uint64 // routes (uint32 IP + uint8 Prefix), matched if the update is inside one
+}
+
+type Config struct {
+	Rules     []Rule
+	Webhooks  []string
+	Retries   int
+	Dedup     int64 // seconds during which a rule fires once per route
+	RateLimit int   // max alerts per minute, 0 for no limit
+}
+
+type Payload struct {
+	Rule       string            `json:"rule"`
+	Route      string            `json:"route"`
+	Msg_type   int32             `json:"msg_type"`
+	Btime      int64             `json:"btime"`
+	Window     int64             `json:"window"`
+	Nexthop    string            `json:"nexthop"`
+	First_asn  int32             `json:"first_asn"`
+	Moved      uint64            `json:"moved"`
+	DstCount   int               `json:"dst_count"`
+	Blackholed uint64            `json:"blackholed"`
+	Summary    bgp.UpdateSummary `json:"summary"`
+
+	Event *bgp.EventSummary `json:"event,omitempty"` // set for a routing event
+}
+
+const queueLen = 1024
+
+var alertsTotal = metrics.Default.NewCounterVec("anaflow_alerts_total",
+	"Alerts per rule and result: sent, failed, deduplicated, rate_limited or dropped.", "rule", "result")
+
+type Alerter struct {
+	mu       sync.Mutex
+	cfg      Config
+	lastSent map[string]int64 // rule + route -> Btime of the last alert
+	tokens   float64
+	refilled time.Time
+
+	queue  chan Payload
+	client *http.Client
+	done   sync.WaitGroup
+}
+
+func New(cfg Config) *Alerter {
+	a := &Alerter{
+		cfg:      cfg,
+		lastSent: make(map[string]int64),
+		tokens:   float64(cfg.RateLimit),
+		refilled: time.Now(),
+		queue:    make(chan Payload, queueLen),
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+	a.done.Add(1)
+	go a.send()
+	return a
+}
+
+// Replace the rules and delivery settings, keeping the dedup and rate limit state
+func (a *Alerter) SetConfig(cfg Config) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cfg = cfg
+	if a.tokens > float64(cfg.RateLimit) {
+		a.tokens = float64(cfg.RateLimit)
+	}
+}
+
+func routeIn(a uint64, b uint64) bool {
+	pb := b & 0xff
+	if a&0xff < pb {
+		return false
+	}
+	return a>>8>>(32-pb) == b>>8>>(32-pb)
+}
+
+func (r *Rule) matches(sum *bgp.UpdateSummary, blackholed uint64) bool {
+	if sum.Moved < r.MinBytes || sum.DstCount < r.MinDsts || blackholed < r.BlackholeBytes {
+		return false
+	}
+	if len(r.Watchlist) == 0 {
+		return true
+	}
+	for _, w := range r.Watchlist {
+		if routeIn(sum.Route, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// Take one token of the per-minute budget. Called with a.mu held.
+func (a *Alerter) allow() bool {
+	if a.cfg.RateLimit <= 0 {
+		return true
+	}
+	now := time.Now()
+	a.tokens += now.Sub(a.refilled).Minutes() * float64(a.cfg.RateLimit)
+	if a.tokens > float64(a.cfg.RateLimit) {
+		a.tokens = float64(a.cfg.RateLimit)
+	}
+	a.refilled = now
+	if a.tokens < 1 {
+		return false
+	}
+	a.tokens--
+	return true
+}
+
+func (a *Alerter) OnUpdate(bu *bgp.BgpInfo, sum *bgp.UpdateSummary, details []bgp.IpLogInfo) {
+	var blackholed uint64
+	if bu.Msg_type == bgp.BGP_DELETE {
+		for _, d := range details {
+			if d.PostRoute == 0 {
+				blackholed += d.PriFlow
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.cfg.Rules {
+		r := &a.cfg.Rules[i]
+		if !r.matches(sum, blackholed) {
+			continue
+		}
+
+		p := Payload{
+			Rule:       r.Name,
+			Route:      util.RouteString(sum.Route),
+			Msg_type:   sum.Msg_type,
+			Btime:      sum.Btime,
+			Window:     sum.Window,
+			Nexthop:    util.IPint2string(bu.New_nexthop),
+			First_asn:  bu.New_first_asn,
+			Moved:      sum.Moved,
+			DstCount:   sum.DstCount,
+			Blackholed: blackholed,
+			Summary:    *sum,
+		}
+		if bu.Msg_type == bgp.BGP_DELETE {
+			p.Nexthop = util.IPint2string(bu.Old_nexthop)
+			p.First_asn = bu.Old_first_asn
+		}
+		a.fire(fmt.Sprintf("%s|%d", r.Name, sum.Route), &p)
+	}
+	a.forget(sum.Btime)
+}
+
+func (a *Alerter) OnEvent(ev *bgp.EventSummary) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.cfg.Rules {
+		r := &a.cfg.Rules[i]
+		if len(r.Watchlist) > 0 || r.BlackholeBytes > 0 || ev.Moved < r.MinBytes || ev.DstCount < r.MinDsts {
+			continue
+		}
+		p := Payload{
+			Rule:      r.Name,
+			Btime:     ev.End,
+			Window:    ev.Window,
+			Nexthop:   util.IPint2string(ev.Nexthop),
+			First_asn: ev.First_asn,
+			Moved:     ev.Moved,
+			DstCount:  ev.DstCount,
+			Event:     ev,
+		}
+		a.fire(fmt.Sprintf("%s|event|%d|%d|%d", r.Name, ev.Peer_addr, ev.Nexthop, ev.First_asn), &p)
+	}
+	a.forget(ev.End)
+}
+
+// Queue p unless key fired less than Dedup ago or the rate limit is reached.
+// Called with a.mu held.
+func (a *Alerter) fire(key string, p *Payload) {
+	if last, ok := a.lastSent[key]; ok && p.Btime-last < a.cfg.Dedup {
+		alertsTotal.With(p.Rule, "deduplicated").Inc()
+		return
+	}
+	if !a.allow() {
+		alertsTotal.With(p.Rule, "rate_limited").Inc()
+		return
+	}
+	a.lastSent[key] = p.Btime
+	select {
+	case a.queue <- *p:
+	default:
+		alertsTotal.With(p.Rule, "dropped").Inc()
+	}
+}
+
+// Forget the dedup entries that cannot suppress anything any more at btime.
+// Called with a.mu held.
+func (a *Alerter) forget(btime int64) {
+	if len(a.lastSent) > 4*queueLen {
+		for k, last := range a.lastSent {
+			if btime-last >= a.cfg.Dedup {
+				delete(a.lastSent, k)
+			}
+		}
+	}
+}
+
+func (a *Alerter) post(url string, body []byte, retries int) error {
+	var err error
+	backoff := time.Second
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var resp *http.Response
+		resp, err = a.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("webhook %s answered %s", url, resp.Status)
+	}
+	return err
+}
+
+func (a *Alerter) send() {
+	defer a.done.Done()
+	for p := range a.queue {
+		body, err := json.Marshal(p)
+		if util.CheckError(err) {
+			continue
+		}
+		a.mu.Lock()
+		webhooks := a.cfg.Webhooks
+		retries := a.cfg.Retries
+		a.mu.Unlock()
+
+		result := "sent"
+		for _, url := range webhooks {
+			if util.CheckError(a.post(url, body, retries)) {
+				result = "failed"
+			}
+		}
+		alertsTotal.With(p.Rule, result).Inc()
+	}
+}
+
+func (a *Alerter) Flush() error {
+	return nil
+}
+
+// Wait for the queued alerts to be delivered
+func (a *Alerter) Close() error {
+	close(a.queue)
+	a.done.Wait()
+	return nil
+}
@@ -0,0 +1,195 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+/*
+HTTP JSON API over the live scope state.
+
+	GET /api/dst?ip=a.b.c.d          routes the destination used before (pri) and uses now (post)
+	GET /api/prefix?prefix=a.b.c.d/l destinations on the route
+	GET /api/pending                 updates still waiting in the update queues
+	GET /api/topn?window=seconds     Top-N rankings
+
+Every handler takes State_mu for reading, GivenCurrentTime takes it for writing.
+*/
+
+// Guards the maps of the windows and the report state against the API readers
+var State_mu sync.RWMutex
+
+type apiRoute struct {
+	Route string `json:"route"`
+	Size  uint64 `json:"size"`
+}
+
+type apiDst struct {
+	Dst  string `json:"dst"`
+	Size uint64 `json:"size"`
+}
+
+// Error_bound is set in the approximate mode, see sketch.go
+type apiDstWindow struct {
+	Window      int64      `json:"window"`
+	Pri         []apiRoute `json:"pri"`
+	Post        []apiRoute `json:"post"`
+	Error_bound uint64     `json:"error_bound,omitempty"`
+}
+
+type apiPrefixWindow struct {
+	Window      int64    `json:"window"`
+	Pri         []apiDst `json:"pri"`
+	Post        []apiDst `json:"post"`
+	Error_bound uint64   `json:"error_bound,omitempty"`
+}
+
+type apiUpdate struct {
+	Btime     int64  `json:"btime"`
+	Msg_type  int32  `json:"msg_type"`
+	Old_route string `json:"old_route,omitempty"`
+	New_route string `json:"new_route,omitempty"`
+	Old_asn   int32  `json:"old_first_asn,omitempty"`
+	New_asn   int32  `json:"new_first_asn,omitempty"`
+	Nexthop   string `json:"nexthop"`
+	Source    string `json:"source,omitempty"`
+	Class     string `json:"class,omitempty"`
+}
+
+type apiPendingWindow struct {
+	Window  int64       `json:"window"`
+	Updates []apiUpdate `json:"updates"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	util.CheckError(json.NewEncoder(w).Encode(v))
+}
+
+func apiRoutes(routes []bgp.IpInfo) []apiRoute {
+	r := make([]apiRoute, 0, len(routes))
+	for _, info := range routes {
+		r = append(r, apiRoute{util.RouteString(info.RoutePrefix), info.Size})
+	}
+	return r
+}
+
+func apiDsts(dsts map[uint32]uint64) []apiDst {
+	d := make([]apiDst, 0, len(dsts))
+	for dst, size := range dsts {
+		d = append(d, apiDst{util.IPint2string(dst), size})
+	}
+	return d
+}
+
+func handleDst(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		http.Error(w, "missing ip", http.StatusBadRequest)
+		return
+	}
+	dst := util.IPbyte2int([]byte(ip))
+
+	State_mu.RLock()
+	defer State_mu.RUnlock()
+	var resp []apiDstWindow
+	for _, win := range Windows {
+		resp = append(resp, apiDstWindow{
+			Window:      win.Agetime,
+			Pri:         apiRoutes(win.dstRoutes(true, dst)),
+			Post:        apiRoutes(win.dstRoutes(false, dst)),
+			Error_bound: win.errorBound(),
+		})
+	}
+	writeJSON(w, resp)
+}
+
+func handlePrefix(w http.ResponseWriter, r *http.Request) {
+	rp, err := util.ParseRoute(r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	State_mu.RLock()
+	defer State_mu.RUnlock()
+	var resp []apiPrefixWindow
+	for _, win := range Windows {
+		resp = append(resp, apiPrefixWindow{
+			Window:      win.Agetime,
+			Pri:         apiDsts(win.routeDsts(true, rp)),
+			Post:        apiDsts(win.routeDsts(false, rp)),
+			Error_bound: win.errorBound(),
+		})
+	}
+	writeJSON(w, resp)
+}
+
+func apiUpdateOf(bu *bgp.BgpInfo) apiUpdate {
+	u := apiUpdate{Btime: bu.Btime, Msg_type: bu.Msg_type, Source: bu.Source}
+	if bu.Class != bgp.CLASS_UNKNOWN {
+		u.Class = bu.Class.String()
+	}
+	if bu.Msg_type != bgp.BGP_ADD {
+		u.Old_route = util.RouteString(oldRoutePrefix(bu))
+		u.Old_asn = bu.Old_first_asn
+		u.Nexthop = util.IPint2string(bu.Old_nexthop)
+	}
+	if bu.Msg_type != bgp.BGP_DELETE {
+		u.New_route = util.RouteString(newRoutePrefix(bu))
+		u.New_asn = bu.New_first_asn
+		u.Nexthop = util.IPint2string(bu.New_nexthop)
+	}
+	return u
+}
+
+func handlePending(w http.ResponseWriter, r *http.Request) {
+	// the update queues are concurrent safe, no need for State_mu
+	var resp []apiPendingWindow
+	for _, win := range Windows {
+		updates, _ := win.Updata_queue.CsItems()
+		p := apiPendingWindow{Window: win.Agetime, Updates: make([]apiUpdate, 0, len(updates))}
+		for i := range updates {
+			p.Updates = append(p.Updates, apiUpdateOf(&updates[i]))
+		}
+		resp = append(resp, p)
+	}
+	writeJSON(w, resp)
+}
+
+func handleTopN(w http.ResponseWriter, r *http.Request) {
+	var windows []int64
+	if s := r.URL.Query().Get("window"); s != "" {
+		window, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		windows = append(windows, window)
+	}
+
+	State_mu.RLock()
+	defer State_mu.RUnlock()
+	if windows == nil {
+		windows = Topn_windows
+	}
+	var resp []TopReport
+	for _, window := range windows {
+		resp = append(resp, TopN(window))
+	}
+	writeJSON(w, resp)
+}
+
+// Mux serving the API. More handlers can be added by the caller.
+func NewAPIMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/dst", handleDst)
+	mux.HandleFunc("/api/prefix", handlePrefix)
+	mux.HandleFunc("/api/pending", handlePending)
+	mux.HandleFunc("/api/topn", handleTopN)
+	return mux
+}
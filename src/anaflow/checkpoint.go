@@ -0,0 +1,483 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+Checkpoint and restore of the in-memory analysis state.
+
+A checkpoint holds the shared flow queue and, for every window, its cursors,
+the pending updates and the route/dst maps, so that a restart resumes the analysis
+where it stopped instead of leaving a blind spot of 2*agetime+delay. The open
+rollup bucket, events and Top-N buckets are reports and restart empty.
+
+Format, little endian:
+	magic "AFCK" | version u16 | saved_at i64 | sketch width u32, depth u32
+	flows n u32 | n * (utime i64, bgp.Flow)
+	nwindows u32
+	per window:
+		agetime i64 | syncdevi i64
+		pri_start u32 | pri_end u32 | post_start u32 | post_end u32, as offsets into the flows
+		updates n u32 | n * (utime i64, len u32, bgp.BgpInfo as a wire message, len u32, source, class u8)
+		priRoute2Dst, priDst2Route, postRoute2Dst, postDst2Route
+		routeAsn, dstAs with dstObs, routeSec
+		in the approximate mode, pri and post sketches: bytes u64, counters,
+		routes n u32 | n * (rp u64, total u64, heavy n u32 | n * (dst u32, bytes u64))
+
+A checkpoint only loads with the flow state mode and sketch size it was taken
+with, the width is 0 in the exact mode.
+*/
+
+const ckptMagic = "AFCK"
+const ckptVersion = 7
+
+var ckptOrder = binary.LittleEndian
+
+// Encoder with a sticky error, checked once at the end
+type ckptWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (cw *ckptWriter) val(v interface{}) {
+	if cw.err == nil {
+		cw.err = binary.Write(cw.w, ckptOrder, v)
+	}
+}
+
+func (cw *ckptWriter) u32(v int) {
+	cw.val(uint32(v))
+}
+
+type ckptReader struct {
+	r    *bufio.Reader
+	left int64 // bytes of the file not read yet
+	err  error
+}
+
+func (cr *ckptReader) val(v interface{}) {
+	if cr.err == nil {
+		cr.err = binary.Read(cr.r, ckptOrder, v)
+		cr.left -= int64(binary.Size(v))
+	}
+}
+
+// Return n if n entries of size bytes fit in the rest of the file, so that a
+// corrupt count does not allocate more than the file holds
+func (cr *ckptReader) fits(n int, size int) int {
+	if cr.err == nil && int64(n)*int64(size) > cr.left {
+		cr.err = fmt.Errorf("%d entries of %d bytes in checkpoint, %d bytes left", n, size, cr.left)
+	}
+	if cr.err != nil {
+		return 0
+	}
+	return n
+}
+
+func (cr *ckptReader) u32() int {
+	var v uint32
+	cr.val(&v)
+	if cr.err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+func writeRoute2Dst(cw *ckptWriter, m map[uint64](map[uint32]uint64)) {
+	cw.u32(len(m))
+	for rp, dsts := range m {
+		cw.val(rp)
+		cw.u32(len(dsts))
+		for dst, size := range dsts {
+			cw.val(dst)
+			cw.val(size)
+		}
+	}
+}
+
+func readRoute2Dst(cr *ckptReader, m map[uint64](map[uint32]uint64)) {
+	for n := cr.u32(); n > 0 && cr.err == nil; n-- {
+		var rp uint64
+		cr.val(&rp)
+		ndst := cr.fits(cr.u32(), 4+8)
+		dsts := make(map[uint32]uint64, ndst)
+		for ; ndst > 0 && cr.err == nil; ndst-- {
+			var dst uint32
+			var size uint64
+			cr.val(&dst)
+			cr.val(&size)
+			dsts[dst] = size
+		}
+		m[rp] = dsts
+	}
+}
+
+func writeDst2Route(cw *ckptWriter, m map[uint32][]bgp.IpInfo) {
+	cw.u32(len(m))
+	for dst, routes := range m {
+		cw.val(dst)
+		cw.u32(len(routes))
+		for _, r := range routes {
+			cw.val(r)
+		}
+	}
+}
+
+func readDst2Route(cr *ckptReader, m map[uint32][]bgp.IpInfo) {
+	for n := cr.u32(); n > 0 && cr.err == nil; n-- {
+		var dst uint32
+		cr.val(&dst)
+		routes := make([]bgp.IpInfo, cr.fits(cr.u32(), binary.Size(bgp.IpInfo{})))
+		for i := range routes {
+			cr.val(&routes[i])
+		}
+		m[dst] = routes
+	}
+}
+
+func writeSketch(cw *ckptWriter, s *flowSketch) {
+	cw.val(s.bytes)
+	cw.val(s.counts)
+	cw.u32(len(s.routes))
+	for rp, r := range s.routes {
+		cw.val(rp)
+		cw.val(r.total)
+		cw.u32(len(r.heavy))
+		for dst, size := range r.heavy {
+			cw.val(dst)
+			cw.val(size)
+		}
+	}
+}
+
+func readSketch(cr *ckptReader, s *flowSketch) {
+	cr.val(&s.bytes)
+	cr.val(s.counts)
+	for n := cr.u32(); n > 0 && cr.err == nil; n-- {
+		var rp uint64
+		r := &sketchRoute{heavy: make(map[uint32]uint64)}
+		cr.val(&rp)
+		cr.val(&r.total)
+		for nheavy := cr.u32(); nheavy > 0 && cr.err == nil; nheavy-- {
+			var dst uint32
+			var size uint64
+			cr.val(&dst)
+			cr.val(&size)
+			s.track(rp, r, dst, size)
+		}
+		s.routes[rp] = r
+	}
+}
+
+func sketchMode(width int, depth int) string {
+	if width == 0 {
+		return "the exact mode"
+	}
+	return fmt.Sprintf("the approximate mode with %dx%d counters", depth, width)
+}
+
+func (w *Window) writeCheckpoint(cw *ckptWriter, offsets [4]int) {
+	cw.val(w.Agetime)
+	cw.val(w.Syncdevi)
+	for _, off := range offsets {
+		cw.u32(off)
+	}
+
+	updates, btimes := w.Updata_queue.CsItems()
+	cw.u32(len(updates))
+	for i := range updates {
+		msg, err := bgp.MarshalUpdate(&updates[i])
+		if err != nil {
+			cw.err = err
+			return
+		}
+		cw.val(btimes[i])
+		cw.u32(len(msg))
+		cw.val(msg)
+		cw.u32(len(updates[i].Source))
+		cw.val([]byte(updates[i].Source))
+		cw.val(updates[i].Class)
+	}
+
+	writeRoute2Dst(cw, w.priRoute2Dst)
+	writeDst2Route(cw, w.priDst2Route)
+	writeRoute2Dst(cw, w.postRoute2Dst)
+	writeDst2Route(cw, w.postDst2Route)
+
+	cw.u32(len(w.routeAsn))
+	for rp, asn := range w.routeAsn {
+		cw.val(rp)
+		cw.val(asn)
+	}
+	cw.u32(len(w.dstAs))
+	for dst, asn := range w.dstAs {
+		cw.val(dst)
+		cw.val(asn)
+		cw.val(w.dstObs[dst])
+	}
+	cw.u32(len(w.routeSec))
+	for rp, secs := range w.routeSec {
+		cw.val(rp)
+		cw.u32(len(secs))
+		for sec, size := range secs {
+			cw.val(sec)
+			cw.val(size)
+		}
+	}
+	if w.approximate() {
+		writeSketch(cw, w.priSketch)
+		writeSketch(cw, w.postSketch)
+	}
+}
+
+// Read the state of w after its agetime and syncdevi, returning its cursor
+// offsets into the flows of nflows
+func (w *Window) readCheckpoint(cr *ckptReader, nflows int) (offsets [4]int) {
+	for i := range offsets {
+		offsets[i] = cr.u32()
+		if offsets[i] > nflows && cr.err == nil {
+			cr.err = fmt.Errorf("cursor at flow %d of %d in checkpoint", offsets[i], nflows)
+		}
+	}
+
+	for n := cr.u32(); n > 0 && cr.err == nil; n-- {
+		var btime int64
+		var bu bgp.BgpInfo
+		cr.val(&btime)
+		size := cr.u32()
+		if size > bgp.HeaderLen+0xffff+bgp.ChecksumLen {
+			cr.err = fmt.Errorf("update of %d bytes in checkpoint", size)
+		}
+		if cr.err != nil {
+			return
+		}
+		msg := make([]byte, size)
+		if cr.val(msg); cr.err != nil {
+			return
+		}
+		if _, err := bgp.UnmarshalMessage(msg, &bu); err != nil {
+			cr.err = err
+			return
+		}
+		size = cr.u32()
+		if size > 0xffff {
+			cr.err = fmt.Errorf("update source of %d bytes in checkpoint", size)
+		}
+		if cr.err != nil {
+			return
+		}
+		source := make([]byte, size)
+		if cr.val(source); cr.err != nil {
+			return
+		}
+		bu.Source = string(source)
+		if cr.val(&bu.Class); cr.err != nil {
+			return
+		}
+		w.Updata_queue.CsPush(bu, btime)
+	}
+
+	readRoute2Dst(cr, w.priRoute2Dst)
+	readDst2Route(cr, w.priDst2Route)
+	readRoute2Dst(cr, w.postRoute2Dst)
+	readDst2Route(cr, w.postDst2Route)
+
+	for n := cr.u32(); n > 0 && cr.err == nil; n-- {
+		var rp uint64
+		var asn int32
+		cr.val(&rp)
+		cr.val(&asn)
+		w.routeAsn[rp] = asn
+	}
+	for n := cr.u32(); n > 0 && cr.err == nil; n-- {
+		var dst, asn, observer uint32
+		cr.val(&dst)
+		cr.val(&asn)
+		cr.val(&observer)
+		w.dstAs[dst] = asn
+		w.dstObs[dst] = observer
+	}
+	for n := cr.u32(); n > 0 && cr.err == nil; n-- {
+		var rp uint64
+		cr.val(&rp)
+		nsec := cr.fits(cr.u32(), 8+8)
+		secs := make(map[int64]uint64, nsec)
+		for ; nsec > 0 && cr.err == nil; nsec-- {
+			var sec int64
+			var size uint64
+			cr.val(&sec)
+			cr.val(&size)
+			secs[sec] = size
+		}
+		w.routeSec[rp] = secs
+	}
+	if w.approximate() {
+		readSketch(cr, w.priSketch)
+		readSketch(cr, w.postSketch)
+	}
+	return offsets
+}
+
+// Take the state decoded into s, a scratch window of the same agetime
+func (w *Window) restore(s *Window) {
+	w.priRoute2Dst, w.priDst2Route = s.priRoute2Dst, s.priDst2Route
+	w.postRoute2Dst, w.postDst2Route = s.postRoute2Dst, s.postDst2Route
+	w.priSketch, w.postSketch = s.priSketch, s.postSketch
+	w.routeAsn, w.dstAs, w.dstObs, w.routeSec = s.routeAsn, s.dstAs, s.dstObs, s.routeSec
+	updates, btimes := s.Updata_queue.CsItems()
+	for i := range updates {
+		w.Updata_queue.CsPush(updates[i], btimes[i])
+	}
+}
+
+func writeCheckpoint(cw *ckptWriter, utime int64) {
+	State_mu.RLock()
+	defer State_mu.RUnlock()
+
+	cw.val([]byte(ckptMagic))
+	cw.val(uint16(ckptVersion))
+	cw.val(utime)
+	width, depth, _ := sketchSize()
+	cw.u32(width)
+	cw.u32(depth)
+
+	sets := make([]*util.FlowCursors, len(Windows))
+	for i, w := range Windows {
+		sets[i] = w.Flow_cursors
+	}
+	flows, utimes, offsets := Flow_queue.CsSnapshot(sets)
+	cw.u32(len(flows))
+	for i := range flows {
+		cw.val(utimes[i])
+		cw.val(flows[i])
+	}
+	cw.u32(len(Windows))
+	for i, w := range Windows {
+		w.writeCheckpoint(cw, offsets[i])
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+}
+
+// Write the state of all windows to path. The file is replaced atomically,
+// and removed if it cannot be written whole.
+func SaveCheckpoint(path string, utime int64) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	cw := &ckptWriter{w: bufio.NewWriter(file)}
+	writeCheckpoint(cw, utime)
+	if err := file.Close(); cw.err == nil {
+		cw.err = err
+	}
+	if cw.err != nil {
+		os.Remove(tmp)
+		return cw.err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Decode a checkpoint into scratch windows, one per window it holds, over a
+// scratch flow queue. Returns the time it was taken and the flows with the
+// cursor offsets of each window.
+func readCheckpoint(cr *ckptReader) (saved_at int64, windows []*Window, flows []bgp.Flow, utimes []int64, offsets [][4]int) {
+	magic := make([]byte, len(ckptMagic))
+	var version uint16
+	cr.val(magic)
+	cr.val(&version)
+	cr.val(&saved_at)
+	if cr.err != nil {
+		return
+	}
+	if string(magic) != ckptMagic {
+		cr.err = errors.New("not an anaflow checkpoint")
+		return
+	}
+	if version != ckptVersion {
+		cr.err = fmt.Errorf("unsupported checkpoint version %d", version)
+		return
+	}
+	width, depth := cr.u32(), cr.u32()
+	if cr.err != nil {
+		return
+	}
+	if cur_width, cur_depth, _ := sketchSize(); width != cur_width || depth != cur_depth {
+		cr.err = fmt.Errorf("checkpoint taken in %s, now in %s", sketchMode(width, depth), sketchMode(cur_width, cur_depth))
+		return
+	}
+
+	// grown as read, n comes from the file
+	for n := cr.u32(); n > 0 && cr.err == nil; n-- {
+		var utime int64
+		var flow bgp.Flow
+		cr.val(&utime)
+		cr.val(&flow)
+		utimes = append(utimes, utime)
+		flows = append(flows, flow)
+	}
+
+	fq := util.NewFlowCsqueue()
+	for n := cr.u32(); n > 0 && cr.err == nil; n-- {
+		var agetime, syncdevi int64
+		cr.val(&agetime)
+		cr.val(&syncdevi)
+		w := NewWindow(agetime, syncdevi, fq, util.NewGCsqueue[bgp.BgpInfo]())
+		windows = append(windows, w)
+		offsets = append(offsets, w.readCheckpoint(cr, len(flows)))
+	}
+	if cr.err == io.EOF {
+		cr.err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// Restore the state saved by SaveCheckpoint into the windows set up with the
+// same agetime. Nothing is restored unless the whole file decodes. Windows
+// missing in the checkpoint start empty. Returns the time the checkpoint was
+// taken. Call it before any source is started.
+func LoadCheckpoint(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	cr := &ckptReader{r: bufio.NewReader(file), left: info.Size()}
+	saved_at, windows, flows, utimes, offsets := readCheckpoint(cr)
+	if cr.err != nil {
+		return 0, cr.err
+	}
+
+	State_mu.Lock()
+	defer State_mu.Unlock()
+	var sets []*util.FlowCursors
+	var set_offsets [][4]int
+	for i, s := range windows {
+		for _, w := range Windows {
+			// windows not configured any more are dropped
+			if w.Agetime == s.Agetime {
+				w.restore(s)
+				sets = append(sets, w.Flow_cursors)
+				set_offsets = append(set_offsets, offsets[i])
+			}
+		}
+	}
+	Flow_queue.CsRestore(flows, utimes, sets, set_offsets)
+	return saved_at, nil
+}
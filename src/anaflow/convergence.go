@@ -0,0 +1,136 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"fmt"
+	"sort"
+)
+
+/*
+Convergence estimation.
+
+Every flow is also counted in a per-second bucket of its route while it stays
+in the queue window, which gives a byte series for [Btime-agetime, Btime+agetime]
+around each update. Traffic on the post route rises from its baseline before
+Btime to a steady state after it, traffic on the pri route drains. The latency
+of an update is the first second at which Conv_fraction of that level shift is
+reached by the Conv_smooth seconds moving average.
+*/
+
+// Fraction of the level shift that counts as converged. Set by main.
+var Conv_fraction float64 = 0.9
+
+// Length of the moving average applied to the per-second series (seconds)
+var Conv_smooth int64 = 10
+
+func (w *Window) addFlow2Sec(v_ptr *bgp.Flow, rp uint64) {
+	secs, ok := w.routeSec[rp]
+	if !ok {
+		secs = make(map[int64]uint64)
+		w.routeSec[rp] = secs
+	}
+	secs[v_ptr.End_t] += v_ptr.Size
+}
+
+func (w *Window) delFlowFromSec(v_ptr *bgp.Flow, rp uint64) {
+	secs, ok := w.routeSec[rp]
+	if !ok {
+		return
+	}
+	// a flow never counted must not wrap the bytes around
+	if secs[v_ptr.End_t] > v_ptr.Size {
+		secs[v_ptr.End_t] -= v_ptr.Size
+		return
+	}
+	delete(secs, v_ptr.End_t)
+	if len(secs) == 0 {
+		delete(w.routeSec, rp)
+	}
+}
+
+// Sum the per-second series of routes over [btime-agetime, btime+agetime]
+func (w *Window) routeSeries(routes map[uint64]bool, btime int64) []float64 {
+	series := make([]float64, 2*w.Agetime+1)
+	for rp := range routes {
+		secs, ok := w.routeSec[rp]
+		if !ok {
+			continue
+		}
+		for i := range series {
+			series[i] += float64(secs[btime-w.Agetime+int64(i)])
+		}
+	}
+	return series
+}
+
+func mean(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	var s float64
+	for _, x := range v {
+		s += x
+	}
+	return s / float64(len(v))
+}
+
+// Seconds after btime (series index agetime) until the series completed
+// Conv_fraction of its shift toward the steady state. -1 if there is no shift
+// in the expected direction or it never completes within the window.
+func (w *Window) shiftLatency(series []float64, rising bool) int64 {
+	mid := int(w.Agetime)
+	if mid == 0 {
+		return -1
+	}
+	base := mean(series[:mid])
+	steady := mean(series[mid+(mid+1)/2:])
+	if (rising && steady <= base) || (!rising && steady >= base) {
+		return -1
+	}
+	target := base + Conv_fraction*(steady-base)
+
+	smooth := int(Conv_smooth)
+	if smooth < 1 {
+		smooth = 1
+	}
+	for i := mid; i < len(series); i++ {
+		lo := i - smooth + 1
+		if lo < mid {
+			lo = mid
+		}
+		avg := mean(series[lo : i+1])
+		if (rising && avg >= target) || (!rising && avg <= target) {
+			return int64(i - mid)
+		}
+	}
+	return -1
+}
+
+// Fill Converge and Drain of sum. pri and post are the routes the affected
+// destinations used before and after the update.
+func (w *Window) estimateConvergence(sum *bgp.UpdateSummary, pri map[uint64]bool, post map[uint64]bool) {
+	sum.Converge = -1
+	sum.Drain = -1
+	if len(post) > 0 {
+		sum.Converge = w.shiftLatency(w.routeSeries(post, sum.Btime), true)
+	}
+	if len(pri) > 0 {
+		sum.Drain = w.shiftLatency(w.routeSeries(pri, sum.Btime), false)
+	}
+}
+
+// min/mean/p50/p90/max of the latencies that could be estimated
+func latencyStats(v []int64) string {
+	if len(v) == 0 {
+		return "n=0"
+	}
+	s := make([]int64, len(v))
+	copy(s, v)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	var total int64
+	for _, x := range s {
+		total += x
+	}
+	return fmt.Sprintf("n=%d min=%d mean=%.1f p50=%d p90=%d max=%d",
+		len(s), s[0], float64(total)/float64(len(s)), s[len(s)/2], s[len(s)*9/10], s[len(s)-1])
+}
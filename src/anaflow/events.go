@@ -0,0 +1,137 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+	"fmt"
+)
+
+/*
+Update correlation.
+
+A session reset on a peer yields thousands of updates within seconds. Updates
+of the same peer sharing the same next hop and first-hop ASN are grouped into one routing event
+as long as they arrive less than Event_gap seconds apart. The scope of an event
+is computed over its de-duplicated destinations, and a single EVENT line is
+written and passed to the sinks once the analysis cursor has moved Event_gap
+seconds past its last update.
+*/
+
+// Max distance between two updates of the same event (seconds). Set by main.
+var Event_gap int64 = 5
+
+type eventKey struct {
+	peer      uint32
+	nexthop   uint32
+	first_asn int32
+}
+
+type eventDst struct {
+	priFlow  uint64 // from the first update that touched the destination
+	postFlow uint64 // from the last one
+}
+
+type routingEvent struct {
+	key     eventKey
+	start   int64
+	end     int64
+	updates int
+	types   map[int32]int
+	routes  map[uint64]bool
+	dsts    map[uint32]*eventDst
+}
+
+var openEvents map[eventKey]*routingEvent
+
+func init() {
+	openEvents = make(map[eventKey]*routingEvent)
+}
+
+func updateEventKey(bu *bgp.BgpInfo) eventKey {
+	if bu.Msg_type == bgp.BGP_DELETE {
+		return eventKey{bu.Peer_addr, bu.Old_nexthop, bu.Old_first_asn}
+	}
+	return eventKey{bu.Peer_addr, bu.New_nexthop, bu.New_first_asn}
+}
+
+func addUpdate2Event(bu *bgp.BgpInfo, sum *bgp.UpdateSummary, details []bgp.IpLogInfo) {
+	key := updateEventKey(bu)
+	ev, ok := openEvents[key]
+	if ok && bu.Btime-ev.end > Event_gap {
+		closeEvent(ev)
+		ok = false
+	}
+	if !ok {
+		ev = &routingEvent{
+			key:    key,
+			start:  bu.Btime,
+			types:  make(map[int32]int),
+			routes: make(map[uint64]bool),
+			dsts:   make(map[uint32]*eventDst),
+		}
+		openEvents[key] = ev
+	}
+
+	ev.end = bu.Btime
+	ev.updates++
+	ev.types[bu.Msg_type]++
+	ev.routes[sum.Route] = true
+	for _, d := range details {
+		ed, ok := ev.dsts[d.DstIp]
+		if ok {
+			ed.postFlow = d.PostFlow
+		} else {
+			ev.dsts[d.DstIp] = &eventDst{d.PriFlow, d.PostFlow}
+		}
+	}
+}
+
+// Close the events whose last update is more than Event_gap before btime
+func checkEvents(btime int64) {
+	for _, ev := range openEvents {
+		if btime-ev.end > Event_gap {
+			closeEvent(ev)
+		}
+	}
+}
+
+func closeEvent(ev *routingEvent) {
+	delete(openEvents, ev.key)
+
+	var pri, post, moved uint64
+	for _, d := range ev.dsts {
+		pri += d.priFlow
+		post += d.postFlow
+		if d.postFlow > d.priFlow {
+			moved += d.postFlow
+		} else {
+			moved += d.priFlow
+		}
+	}
+	sum := &bgp.EventSummary{
+		Window:    Windows[0].Agetime,
+		Peer_addr: ev.key.peer,
+		Nexthop:   ev.key.nexthop,
+		First_asn: ev.key.first_asn,
+		Start:     ev.start,
+		End:       ev.end,
+		Updates:   ev.updates,
+		Types:     ev.types,
+		Routes:    len(ev.routes),
+		DstCount:  len(ev.dsts),
+		PriFlow:   pri,
+		PostFlow:  post,
+		Moved:     moved,
+	}
+	if sum.Window > 0 {
+		sum.Gbps = float64(moved) * 8 / float64(sum.Window) / 1e9
+	}
+
+	nexthop := util.IPint2string(sum.Nexthop)
+	peer := util.IPint2string(sum.Peer_addr)
+	util.Infof("\033[35mEVENT peer %s nexthop %s asn %d:\033[0m %d updates, %d dsts, moved %.3f Gbps\n",
+		peer, nexthop, sum.First_asn, sum.Updates, sum.DstCount, sum.Gbps)
+	File_writer.WriteString(fmt.Sprintf("EVENT: peer=%s nexthop=%s first_asn=%d start=%d end=%d updates=%d types=%v routes=%d dsts=%d pri_flow=%d post_flow=%d moved=%d gbps=%.3f\n",
+		peer, nexthop, sum.First_asn, sum.Start, sum.End, sum.Updates, sum.Types, sum.Routes, sum.DstCount, sum.PriFlow, sum.PostFlow, sum.Moved, sum.Gbps))
+	emitEvent(sum)
+}
@@ -0,0 +1,435 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+/*
+Route event feeds, one JSON document per line.
+
+	exabgp  the process API of ExaBGP with "encoder json": update and state
+	        messages of its neighbors
+	gobgp   `gobgp monitor global rib -j`: the best path changes of the
+	        global RIB
+
+A feed is read from stdin ("-"), a file or a named pipe, or from the
+connections to a unix socket, e.g. of `socat STDIN UNIX-CONNECT:path` run by
+ExaBGP. Only IPv4 unicast routes are kept. The announcements and withdrawals
+go through the Adj-RIB-In of the feed, per neighbor for ExaBGP, per prefix for
+the best paths of GoBGP, and take the time of the event as Btime.
+*/
+
+type FeedSource struct {
+	Format string // "exabgp" or "gobgp"
+	Path   string // "-" for stdin, a file or a named pipe
+	Socket string // unix socket to listen on instead of Path
+}
+
+// Longest line of a feed
+const feedMaxLine = 16 << 20
+
+func (s *FeedSource) Name() string {
+	if s.Socket != "" {
+		return s.Format + ":" + s.Socket
+	}
+	return s.Format + ":" + s.Path
+}
+
+func (s *FeedSource) Run(done <-chan struct{}) error {
+	var decode func(line []byte, rib *adjRib) error
+	switch s.Format {
+	case "exabgp":
+		decode = decodeExabgp
+	case "gobgp":
+		decode = decodeGobgp
+	default:
+		return fmt.Errorf("unknown feed format %q", s.Format)
+	}
+	rib := newAdjRib(s.Name())
+
+	if s.Socket != "" {
+		syscall.Unlink(s.Socket)
+		listener, err := net.Listen("unix", s.Socket)
+		if err != nil {
+			return err
+		}
+		return acceptLoop(listener, done, func(c net.Conn, seq int, done <-chan struct{}) {
+			defer c.Close()
+			s.read(c, rib, decode, done)
+		})
+	}
+
+	in := os.Stdin
+	if s.Path != "-" {
+		// a named pipe opened for writing too neither blocks on open nor sees
+		// EOF when its writer restarts
+		flag := os.O_RDONLY
+		if fi, err := os.Stat(s.Path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+			flag = os.O_RDWR
+		}
+		f, err := os.OpenFile(s.Path, flag, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	// stdin cannot be interrupted, the reader is left behind on done
+	finished := make(chan error, 1)
+	go func() {
+		finished <- s.read(in, rib, decode, done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case err := <-finished:
+		return err
+	}
+}
+
+func (s *FeedSource) read(r io.Reader, rib *adjRib, decode func([]byte, *adjRib) error, done <-chan struct{}) error {
+	bound := newSourceBound(rib.source, done)
+	defer bound.release()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), feedMaxLine)
+	for bound.wait() && scanner.Scan() {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := decode(line, rib); err != nil {
+			parseFailures.With(s.Format).Inc()
+			util.Warnf("Feed %s: %s\n", rib.source, err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+func parseIPv4(s string) (uint32, bool) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() == nil {
+		return 0, false
+	}
+	return util.IPbyte2int([]byte(ip.To4().String())), true
+}
+
+// Btime of an event at unix time t, now if unknown
+func feedTime(t int64) int64 {
+	if t <= 0 {
+		return time.Now().Unix()
+	}
+	return t
+}
+
+// ExaBGP
+
+type exabgpMessage struct {
+	Time     float64 `json:"time"`
+	Type     string  `json:"type"`
+	Neighbor struct {
+		Address struct {
+			Peer string `json:"peer"`
+		} `json:"address"`
+		Asn struct {
+			Peer uint32 `json:"peer"`
+		} `json:"asn"`
+		Direction string `json:"direction"`
+		State     string `json:"state"`
+		Message   struct {
+			Update *struct {
+				Attribute exabgpAttrs                       `json:"attribute"`
+				Announce  map[string]map[string]exabgpNlris `json:"announce"` // family -> next hop -> prefixes
+				Withdraw  map[string]exabgpNlris            `json:"withdraw"` // family -> prefixes
+			} `json:"update"`
+		} `json:"message"`
+	} `json:"neighbor"`
+}
+
+type exabgpAttrs struct {
+	Origin          string      `json:"origin"`
+	As_path         interface{} `json:"as-path"`
+	Med             uint32      `json:"med"`
+	Local_pref      *int32      `json:"local-preference"`
+	Community       [][]uint32  `json:"community"`
+	Large_community [][]uint32  `json:"large-community"`
+}
+
+type exabgpNlri struct {
+	Nlri    string `json:"nlri"`
+	Path_id string `json:"path-information"`
+}
+
+// A list of prefixes, as objects or strings, or an object keyed by prefix as
+// in ExaBGP 3
+type exabgpNlris []exabgpNlri
+
+func (n *exabgpNlris) UnmarshalJSON(b []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(b, &items); err != nil {
+		var keyed map[string]json.RawMessage
+		if json.Unmarshal(b, &keyed) != nil {
+			return err
+		}
+		for prefix := range keyed {
+			*n = append(*n, exabgpNlri{Nlri: prefix})
+		}
+		return nil
+	}
+	for _, item := range items {
+		var e exabgpNlri
+		if err := json.Unmarshal(item, &e.Nlri); err != nil {
+			if err := json.Unmarshal(item, &e); err != nil {
+				return err
+			}
+		}
+		*n = append(*n, e)
+	}
+	return nil
+}
+
+// The AS numbers of an as-path in document order: a list, possibly nesting
+// the AS_SETs, or an object of segments with their "value" as in ExaBGP 5
+func flattenAsns(v interface{}, path []uint32) []uint32 {
+	switch v := v.(type) {
+	case float64:
+		path = append(path, uint32(v))
+	case []interface{}:
+		for _, e := range v {
+			path = flattenAsns(e, path)
+		}
+	case map[string]interface{}:
+		if value, ok := v["value"]; ok {
+			return flattenAsns(value, path)
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, _ := strconv.Atoi(keys[i])
+			b, _ := strconv.Atoi(keys[j])
+			return a < b
+		})
+		for _, k := range keys {
+			path = flattenAsns(v[k], path)
+		}
+	}
+	return path
+}
+
+func (a *exabgpAttrs) route(peer uint32, peer_asn uint32, nexthop uint32) (ribRoute, error) {
+	var attrs bgp.RouteAttrs
+	if a.Origin != "" {
+		if err := attrs.Origin.UnmarshalText([]byte(a.Origin)); err != nil {
+			return ribRoute{}, err
+		}
+	}
+	attrs.As_path = flattenAsns(a.As_path, []uint32{})
+	attrs.Med = a.Med
+	for _, c := range a.Community {
+		if len(c) != 2 {
+			return ribRoute{}, fmt.Errorf("community %v is not [asn, value]", c)
+		}
+		attrs.Communities = append(attrs.Communities, bgp.Community(c[0]<<16|c[1]&0xffff))
+	}
+	for _, c := range a.Large_community {
+		if len(c) != 3 {
+			return ribRoute{}, fmt.Errorf("large community %v is not [global, local1, local2]", c)
+		}
+		attrs.Large_communities = append(attrs.Large_communities, bgp.LargeCommunity{Global: c[0], Local1: c[1], Local2: c[2]})
+	}
+	pref := int32(bgpDefaultPref)
+	if a.Local_pref != nil {
+		pref = *a.Local_pref
+	}
+	return newRibRoute(peer, peer_asn, nexthop, pref, attrs), nil
+}
+
+func (n *exabgpNlri) key(peer uint32) (ribKey, error) {
+	rp, err := util.ParseRoute(n.Nlri)
+	if err != nil {
+		return ribKey{}, err
+	}
+	key := ribKey{peer: peer, rp: rp}
+	if n.Path_id != "" {
+		// dotted like an address, or a number
+		if id, ok := parseIPv4(n.Path_id); ok {
+			key.path_id = id
+		} else if id, err := strconv.ParseUint(n.Path_id, 10, 32); err == nil {
+			key.path_id = uint32(id)
+		} else {
+			return ribKey{}, fmt.Errorf("path-information %q", n.Path_id)
+		}
+	}
+	return key, nil
+}
+
+func decodeExabgp(line []byte, rib *adjRib) error {
+	var m exabgpMessage
+	if err := json.Unmarshal(line, &m); err != nil {
+		return err
+	}
+	n := &m.Neighbor
+	peer, ok := parseIPv4(n.Address.Peer)
+	if !ok {
+		// neighbors are told apart by their IPv4 address
+		return nil
+	}
+	btime := feedTime(int64(m.Time))
+
+	switch {
+	case m.Type == "state" && n.State == "down":
+		rib.withdrawPeer(peer, btime)
+	case m.Type == "update" && n.Direction != "send" && n.Message.Update != nil:
+		u := n.Message.Update
+		for _, nlri := range u.Withdraw["ipv4 unicast"] {
+			key, err := nlri.key(peer)
+			if err != nil {
+				return err
+			}
+			rib.withdraw(key, btime)
+		}
+		for nh, prefixes := range u.Announce["ipv4 unicast"] {
+			nexthop, _ := parseIPv4(nh)
+			route, err := u.Attribute.route(peer, n.Asn.Peer, nexthop)
+			if err != nil {
+				return err
+			}
+			for _, nlri := range prefixes {
+				key, err := nlri.key(peer)
+				if err != nil {
+					return err
+				}
+				rib.announce(key, route, btime)
+			}
+		}
+	}
+	return nil
+}
+
+// GoBGP
+
+type gobgpPath struct {
+	Nlri struct {
+		Prefix string `json:"prefix"`
+	} `json:"nlri"`
+	Age         int64       `json:"age"`
+	Attrs       []gobgpAttr `json:"attrs"`
+	Withdrawal  bool        `json:"withdrawal"`
+	Neighbor_ip string      `json:"neighbor-ip"`
+}
+
+type gobgpAttr struct {
+	Type     int             `json:"type"`
+	Value    json.RawMessage `json:"value"` // origin, local pref, large communities
+	As_paths []struct {
+		Segment_type int      `json:"segment_type"`
+		Asns         []uint32 `json:"asns"`
+	} `json:"as_paths"`
+	Nexthop     string   `json:"nexthop"`
+	Metric      uint32   `json:"metric"`
+	Communities []uint32 `json:"communities"`
+}
+
+type gobgpLargeCommunity struct {
+	ASN        uint32 `json:"ASN"`
+	LocalData1 uint32 `json:"LocalData1"`
+	LocalData2 uint32 `json:"LocalData2"`
+}
+
+func (p *gobgpPath) route() (ribRoute, error) {
+	var attrs bgp.RouteAttrs
+	var nexthop uint32
+	pref := int32(bgpDefaultPref)
+	attrs.As_path = []uint32{}
+	for _, a := range p.Attrs {
+		var err error
+		switch a.Type {
+		case bgp.ATTR_ORIGIN:
+			var origin uint8
+			err = json.Unmarshal(a.Value, &origin)
+			attrs.Origin = bgp.Origin(origin)
+		case bgp.ATTR_AS_PATH:
+			for _, seg := range a.As_paths {
+				// confederation segments are left out, as by the speaker
+				if seg.Segment_type == 1 || seg.Segment_type == 2 {
+					attrs.As_path = append(attrs.As_path, seg.Asns...)
+				}
+			}
+		case bgp.ATTR_NEXT_HOP:
+			nexthop, _ = parseIPv4(a.Nexthop)
+		case bgp.ATTR_MED:
+			attrs.Med = a.Metric
+		case bgp.ATTR_LOCAL_PREF:
+			err = json.Unmarshal(a.Value, &pref)
+		case bgp.ATTR_COMMUNITIES:
+			for _, c := range a.Communities {
+				attrs.Communities = append(attrs.Communities, bgp.Community(c))
+			}
+		case bgp.ATTR_LARGE_COMMUNITY:
+			var large []gobgpLargeCommunity
+			err = json.Unmarshal(a.Value, &large)
+			for _, c := range large {
+				attrs.Large_communities = append(attrs.Large_communities, bgp.LargeCommunity{Global: c.ASN, Local1: c.LocalData1, Local2: c.LocalData2})
+			}
+		}
+		if err != nil {
+			return ribRoute{}, fmt.Errorf("attribute %d: %w", a.Type, err)
+		}
+	}
+	peer, _ := parseIPv4(p.Neighbor_ip)
+	return newRibRoute(peer, 0, nexthop, pref, attrs), nil
+}
+
+// A line is an array of paths, or a path
+func decodeGobgp(line []byte, rib *adjRib) error {
+	var paths []gobgpPath
+	if line[0] == '[' {
+		if err := json.Unmarshal(line, &paths); err != nil {
+			return err
+		}
+	} else {
+		paths = make([]gobgpPath, 1)
+		if err := json.Unmarshal(line, &paths[0]); err != nil {
+			return err
+		}
+	}
+
+	for i := range paths {
+		p := &paths[i]
+		rp, err := util.ParseRoute(p.Nlri.Prefix)
+		if err != nil {
+			// IPv6 and the other families
+			continue
+		}
+		key := ribKey{rp: rp}
+		btime := feedTime(p.Age)
+		if p.Withdrawal {
+			rib.withdraw(key, btime)
+			continue
+		}
+		route, err := p.route()
+		if err != nil {
+			return err
+		}
+		rib.announce(key, route, btime)
+	}
+	return nil
+}
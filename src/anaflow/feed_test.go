@@ -0,0 +1,189 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"bufio"
+	"strings"
+	"testing"
+)
+
+const exabgpAnnounce = `{"exabgp": "4.0.1", "time": 1700000000.5, "type": "update", "neighbor": {` +
+	`"address": {"local": "192.0.2.254", "peer": "192.0.2.1"}, "asn": {"local": 64500, "peer": 64512}, "direction": "receive", ` +
+	`"message": {"update": {"attribute": {"origin": "igp", "as-path": [64512, [64600, 64601]], "med": 10, "local-preference": 150, ` +
+	`"community": [[64512, 1]], "large-community": [[64512, 1, 2]]}, ` +
+	`"announce": {"ipv4 unicast": {"192.0.2.1": [{"nlri": "10.0.0.0/8", "path-information": "0.0.0.1"}, ` +
+	`{"nlri": "10.0.0.0/8", "path-information": "2"}]}}}}}}`
+
+const exabgpWithdraw = `{"time": 1700000001, "type": "update", "neighbor": {"address": {"peer": "192.0.2.1"}, ` +
+	`"asn": {"peer": 64512}, "direction": "receive", "message": {"update": {"withdraw": {"ipv4 unicast": ` +
+	`[{"nlri": "10.0.0.0/8", "path-information": "0.0.0.1"}]}}}}}`
+
+const exabgpDown = `{"time": 1700000002, "type": "state", "neighbor": {"address": {"peer": "192.0.2.1"}, "state": "down"}}`
+
+const gobgpAnnounce = `[{"nlri": {"prefix": "198.51.100.0/24"}, "age": 1700000000, "best": true, "attrs": [` +
+	`{"type": 1, "value": 2}, {"type": 2, "as_paths": [{"segment_type": 2, "num": 2, "asns": [64512, 64600]}, ` +
+	`{"segment_type": 1, "num": 1, "asns": [65000]}, {"segment_type": 3, "num": 1, "asns": [65100]}]}, ` +
+	`{"type": 3, "nexthop": "192.0.2.9"}, {"type": 4, "metric": 7}, ` +
+	`{"type": 5, "value": 120}, {"type": 8, "communities": [4227858433]}, ` +
+	`{"type": 32, "value": [{"ASN": 64512, "LocalData1": 1, "LocalData2": 2}]}], "neighbor-ip": "192.0.2.9"}, ` +
+	`{"nlri": {"prefix": "2001:db8::/32"}, "age": 1700000000, "attrs": []}]`
+
+const gobgpWithdraw = `{"nlri": {"prefix": "198.51.100.0/24"}, "age": 1700000001, "withdrawal": true, "neighbor-ip": "192.0.2.9"}`
+
+func TestFeedExabgp(t *testing.T) {
+	SetupWindows(60, 0, nil)
+	drainUpdates()
+	rib := newAdjRib("exabgp:test")
+
+	if err := decodeExabgp([]byte(exabgpAnnounce), rib); err != nil {
+		t.Fatal(err)
+	}
+	updates := popUpdates(t, 2)
+	for i, bu := range updates {
+		if bu.Msg_type != bgp.BGP_ADD || bu.New_ip_addr != 0x0a000000 || bu.New_ip_prefix != 8 ||
+			bu.New_nexthop != 0xc0000201 || bu.New_first_asn != 64512 || bu.New_path_len != 3 || bu.New_pref != 150 ||
+			bu.Peer_addr != 0xc0000201 || bu.Peer_asn != 64512 || bu.Btime != 1700000000 || bu.Source != "exabgp:test" {
+			t.Fatalf("update %d: %+v", i, bu)
+		}
+		a := bu.New_attrs
+		if a.Med != 10 || len(a.Communities) != 1 || a.Communities[0] != bgp.Community(64512<<16|1) ||
+			len(a.Large_communities) != 1 || a.Large_communities[0] != (bgp.LargeCommunity{Global: 64512, Local1: 1, Local2: 2}) {
+			t.Fatalf("attributes of update %d: %+v", i, a)
+		}
+	}
+	if updates[0].Path_id+updates[1].Path_id != 3 {
+		t.Fatalf("path ids %d and %d, want 1 and 2", updates[0].Path_id, updates[1].Path_id)
+	}
+
+	// the same announcement again is no update
+	if err := decodeExabgp([]byte(exabgpAnnounce), rib); err != nil {
+		t.Fatal(err)
+	}
+	popUpdates(t, 0)
+
+	if err := decodeExabgp([]byte(exabgpWithdraw), rib); err != nil {
+		t.Fatal(err)
+	}
+	if bu := popUpdates(t, 1)[0]; bu.Msg_type != bgp.BGP_DELETE || bu.Path_id != 1 || bu.Btime != 1700000001 {
+		t.Fatalf("withdrawal %+v", bu)
+	}
+	if err := decodeExabgp([]byte(exabgpDown), rib); err != nil {
+		t.Fatal(err)
+	}
+	if bu := popUpdates(t, 1)[0]; bu.Msg_type != bgp.BGP_DELETE || bu.Path_id != 2 {
+		t.Fatalf("withdrawal of the neighbor going down %+v", bu)
+	}
+}
+
+func TestFeedGobgp(t *testing.T) {
+	SetupWindows(60, 0, nil)
+	drainUpdates()
+	rib := newAdjRib("gobgp:test")
+
+	// the IPv6 path and the confederation segment are left out
+	if err := decodeGobgp([]byte(gobgpAnnounce), rib); err != nil {
+		t.Fatal(err)
+	}
+	bu := popUpdates(t, 1)[0]
+	if bu.Msg_type != bgp.BGP_ADD || bu.New_ip_addr != 0xc6336400 || bu.New_ip_prefix != 24 || bu.New_nexthop != 0xc0000209 ||
+		bu.New_pref != 120 || bu.Peer_addr != 0xc0000209 || bu.Btime != 1700000000 {
+		t.Fatalf("update %+v", bu)
+	}
+	a := bu.New_attrs
+	if len(a.As_path) != 3 || a.As_path[2] != 65000 || a.Origin != bgp.ORIGIN_INCOMPLETE || a.Med != 7 ||
+		len(a.Communities) != 1 || a.Communities[0] != bgp.Community(4227858433) ||
+		len(a.Large_communities) != 1 || a.Large_communities[0].Local2 != 2 {
+		t.Fatalf("attributes %+v", a)
+	}
+
+	if err := decodeGobgp([]byte(gobgpWithdraw), rib); err != nil {
+		t.Fatal(err)
+	}
+	if bu := popUpdates(t, 1)[0]; bu.Msg_type != bgp.BGP_DELETE || bu.Old_ip_addr != 0xc6336400 || bu.Btime != 1700000001 {
+		t.Fatalf("withdrawal %+v", bu)
+	}
+}
+
+func TestFeedMalformed(t *testing.T) {
+	SetupWindows(60, 0, nil)
+	drainUpdates()
+
+	replace := func(line string, old string, new string) string {
+		if !strings.Contains(line, old) {
+			t.Fatalf("%q not in the line", old)
+		}
+		return strings.Replace(line, old, new, 1)
+	}
+	one := replace(exabgpAnnounce, `, {"nlri": "10.0.0.0/8", "path-information": "2"}`, "")
+	cases := []struct {
+		name   string
+		decode func([]byte, *adjRib) error
+		line   string
+	}{
+		{"exabgp not json", decodeExabgp, "neighbor 192.0.2.1 up"},
+		{"exabgp origin", decodeExabgp, replace(one, `"igp"`, `"best"`)},
+		{"exabgp community", decodeExabgp, replace(one, `[[64512, 1]]`, `[[64512, 1, 2]]`)},
+		{"exabgp large community", decodeExabgp, replace(one, `[[64512, 1, 2]]`, `[[64512, 1]]`)},
+		{"exabgp prefix", decodeExabgp, replace(one, `"10.0.0.0/8"`, `"10.0.0.0/33"`)},
+		{"exabgp path-information", decodeExabgp, replace(one, `"0.0.0.1"`, `"first"`)},
+		{"exabgp withdrawn prefix", decodeExabgp, replace(exabgpWithdraw, `"10.0.0.0/8"`, `"10.0.0"`)},
+		{"exabgp nlris", decodeExabgp, replace(one, `[{"nlri"`, `[1, {"nlri"`)},
+		{"exabgp asn", decodeExabgp, replace(one, `"peer": 64512`, `"peer": "64512"`)},
+		{"gobgp not json", decodeGobgp, "{nlri}"},
+		{"gobgp origin", decodeGobgp, replace(gobgpAnnounce, `"value": 2`, `"value": "incomplete"`)},
+		{"gobgp local pref", decodeGobgp, replace(gobgpAnnounce, `"value": 120`, `"value": 1e20`)},
+		{"gobgp large community", decodeGobgp, replace(gobgpAnnounce, `"value": [{"ASN"`, `"value": {"ASN"`)},
+		{"gobgp array", decodeGobgp, "[" + gobgpWithdraw},
+	}
+	for _, c := range cases {
+		if err := c.decode([]byte(c.line), newAdjRib("malformed")); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+	if n := Updata_queue.GetLength(); n != 0 {
+		t.Fatalf("%d updates queued from malformed lines", n)
+	}
+
+	// a line cut anywhere is an error and changes nothing
+	for _, c := range []struct {
+		decode func([]byte, *adjRib) error
+		line   string
+	}{{decodeExabgp, exabgpAnnounce}, {decodeGobgp, gobgpAnnounce}, {decodeGobgp, gobgpWithdraw}} {
+		rib := newAdjRib("truncated")
+		for cut := 1; cut < len(c.line); cut++ {
+			if err := c.decode([]byte(c.line[:cut]), rib); err == nil {
+				t.Fatalf("line cut at %d of %q: no error", cut, c.line)
+			}
+		}
+		if rib.len() != 0 || Updata_queue.GetLength() != 0 {
+			t.Fatalf("truncated lines left %d routes and %d updates", rib.len(), Updata_queue.GetLength())
+		}
+	}
+}
+
+func TestFeedRead(t *testing.T) {
+	SetupWindows(60, 0, nil)
+	drainUpdates()
+	s := &FeedSource{Format: "exabgp", Path: "-"}
+	rib := newAdjRib(s.Name())
+	failures := parseFailures.With("exabgp").Value()
+
+	// bad and cut lines are skipped, the last one without its newline
+	in := strings.Join([]string{exabgpAnnounce, "", "{]", "  ", exabgpWithdraw[:40], exabgpWithdraw, exabgpDown[:len(exabgpDown)-1]}, "\n")
+	if err := s.read(strings.NewReader(in), rib, decodeExabgp, make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	if n := parseFailures.With("exabgp").Value() - failures; n != 3 {
+		t.Fatalf("%d parse failures, want 3", n)
+	}
+	popUpdates(t, 3)
+	if rib.len() != 1 {
+		t.Fatalf("%d routes left, want 1", rib.len())
+	}
+
+	// a line over the limit ends the feed
+	long := strings.NewReader(exabgpWithdraw + "\n" + strings.Repeat(" ", feedMaxLine+1))
+	if err := s.read(long, rib, decodeExabgp, make(chan struct{})); err != bufio.ErrTooLong {
+		t.Fatalf("err %v, want bufio.ErrTooLong", err)
+	}
+}
@@ -6,38 +6,111 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"strconv"
+	"sync/atomic"
 )
 
 // Global shared structures. Need concurrent safe methods.
+// Flow_queue is shared by every window, Updata_queue belongs to the primary
+// window, Windows[0].
 var Updata_queue *util.GCsqueue[bgp.BgpInfo]
 var Flow_queue *util.FlowCsqueue
 var File_writer *bufio.Writer
 
-// Local structure without concurrent problems.
+// post_end time of the primary window as of the last tick, for lateFlows
+var postEndTime atomic.Int64
+
+// One observation window. Each window has its own cursors over the shared flow
+// queue and its own update queue, as their times depend on agetime.
+type Window struct {
+	Agetime      int64
+	Syncdevi     int64
+	Flow_queue   *util.FlowCsqueue
+	Flow_cursors *util.FlowCursors
+	Updata_queue *util.GCsqueue[bgp.BgpInfo]
+
+	// Local structure without concurrent problems.
+
+	// Given a route entry, find the list of dst_ip using this route.
+	// Nesting structure enables O(1) insertion/deletion time for each Dst_ip
+	priRoute2Dst  map[uint64](map[uint32]uint64) // PriRD
+	priDst2Route  map[uint32][]bgp.IpInfo        // PriDR
+	postRoute2Dst map[uint64](map[uint32]uint64) // PostDR
+	postDst2Route map[uint32][]bgp.IpInfo        // PostRD
+
+	// Approximate mode, see sketch.go. The four maps above stay empty.
+	priSketch  *flowSketch
+	postSketch *flowSketch
+
+	routeAsn map[uint64]int32              // route prefix -> first-hop ASN learned from the handled updates
+	dstAs    map[uint32]uint32             // dst_ip -> destination ASN reported by the flows
+	dstObs   map[uint32]uint32             // dst_ip -> router that last reported a flow to it
+	routeSec map[uint64](map[int64]uint64) // route prefix -> second -> bytes
+
+	flowBuf []bgp.Flow // flows a cursor passed in the tick, reused
+}
 
-// Given a route entry, find the list of dst_ip using this route.
-// Nesting structure enables O(1) insertion/deletion time for each Dst_ip
-var priRoute2Dst map[uint64](map[uint32]uint64)  // PriRD
-var priDst2Route map[uint32][]bgp.IpInfo         // PriDR
-var postRoute2Dst map[uint64](map[uint32]uint64) // PostDR
-var postDst2Route map[uint32][]bgp.IpInfo        // PostRD
+// All windows, the primary one first
+var Windows []*Window
 
 const INITVOLUME = 524288
 
+// flows the tick buffer of a window may keep between ticks
+const maxFlowBuf = 65536
+
 func init() {
 	Updata_queue = util.NewGCsqueue[bgp.BgpInfo]()
+	Updata_queue.Count = countPending
 	Flow_queue = util.NewFlowCsqueue()
-	priRoute2Dst = make(map[uint64](map[uint32]uint64), INITVOLUME)
-	priDst2Route = make(map[uint32][]bgp.IpInfo, INITVOLUME)
-	postRoute2Dst = make(map[uint64](map[uint32]uint64), INITVOLUME)
-	postDst2Route = make(map[uint32][]bgp.IpInfo, INITVOLUME)
 }
 
-func addFlow2Pri(v_ptr *bgp.Flow) {
+func NewWindow(agetime int64, syncdevi int64, fq *util.FlowCsqueue, uq *util.GCsqueue[bgp.BgpInfo]) *Window {
+	pri_sketch, post_sketch := newFlowSketches()
+	volume := INITVOLUME
+	if pri_sketch != nil {
+		volume = 0
+	}
+	return &Window{
+		Agetime:       agetime,
+		Syncdevi:      syncdevi,
+		Flow_queue:    fq,
+		Flow_cursors:  fq.NewCursors(),
+		Updata_queue:  uq,
+		priRoute2Dst:  make(map[uint64](map[uint32]uint64), volume),
+		priDst2Route:  make(map[uint32][]bgp.IpInfo, volume),
+		postRoute2Dst: make(map[uint64](map[uint32]uint64), volume),
+		postDst2Route: make(map[uint32][]bgp.IpInfo, volume),
+		priSketch:     pri_sketch,
+		postSketch:    post_sketch,
+		routeAsn:      make(map[uint64]int32, INITVOLUME),
+		dstAs:         make(map[uint32]uint32, volume),
+		dstObs:        make(map[uint32]uint32, volume),
+		routeSec:      make(map[uint64](map[int64]uint64), INITVOLUME),
+	}
+}
+
+// Count a flow in the approximate mode. Only the heavy hitters keep their
+// destination AS and observer.
+func (w *Window) addFlow2Sketch(s *flowSketch, v_ptr *bgp.Flow, rp uint64) {
+	evicted, ok := s.add(rp, v_ptr.Dst_ip, v_ptr.Size)
+	if _, tracked := s.routes[rp].heavy[v_ptr.Dst_ip]; tracked {
+		w.dstAs[v_ptr.Dst_ip] = v_ptr.Dst_as
+		w.dstObs[v_ptr.Dst_ip] = v_ptr.Observer_ip
+	}
+	if ok {
+		w.forgetDstAs(evicted)
+	}
+}
+
+func (w *Window) addFlow2Pri(v_ptr *bgp.Flow) {
 	rp := uint64(v_ptr.Route)>>(32-v_ptr.Prefix)<<(40-v_ptr.Prefix) + uint64(v_ptr.Prefix)
+	if w.priSketch != nil {
+		w.addFlow2Sketch(w.priSketch, v_ptr, rp)
+		return
+	}
 
 	// add flow to priRoute2Dst
-	dst_list, ok_out := priRoute2Dst[rp]
+	dst_list, ok_out := w.priRoute2Dst[rp]
 	if ok_out {
 		_, ok_in := dst_list[v_ptr.Dst_ip]
 		if ok_in {
@@ -46,67 +119,82 @@ func addFlow2Pri(v_ptr *bgp.Flow) {
 			dst_list[v_ptr.Dst_ip] = v_ptr.Size
 		}
 	} else {
-		priRoute2Dst[rp] = map[uint32]uint64{
+		w.priRoute2Dst[rp] = map[uint32]uint64{
 			v_ptr.Dst_ip: v_ptr.Size,
 		}
 	}
 
 	// add flow to priDst2Route
-	route_q, ok_q := priDst2Route[v_ptr.Dst_ip]
+	route_q, ok_q := w.priDst2Route[v_ptr.Dst_ip]
 	if ok_q {
 		if route_q[len(route_q)-1].RoutePrefix == rp {
-			priDst2Route[v_ptr.Dst_ip][len(route_q)-1].Size += v_ptr.Size
+			w.priDst2Route[v_ptr.Dst_ip][len(route_q)-1].Size += v_ptr.Size
 		} else {
-			priDst2Route[v_ptr.Dst_ip] = append(priDst2Route[v_ptr.Dst_ip], bgp.IpInfo{
+			w.priDst2Route[v_ptr.Dst_ip] = append(w.priDst2Route[v_ptr.Dst_ip], bgp.IpInfo{
 				RoutePrefix: rp,
 				Size:        v_ptr.Size,
 			})
 		}
 	} else {
-		priDst2Route[v_ptr.Dst_ip] = []bgp.IpInfo{
+		w.priDst2Route[v_ptr.Dst_ip] = []bgp.IpInfo{
 			{
 				RoutePrefix: rp,
 				Size:        v_ptr.Size,
 			},
 		}
 	}
+	w.dstAs[v_ptr.Dst_ip] = v_ptr.Dst_as
+	w.dstObs[v_ptr.Dst_ip] = v_ptr.Observer_ip
 	// fmt.Printf("\033[41;37mCurTime: %d\033[0m\n", time.Now().Unix())
 	// fmt.Printf("\033[31mpriRoute2Dst \033[0mis %+v\n\033[31mpriDst2Route \033[0mis %+v\n", priRoute2Dst[rp], priDst2Route[v_ptr.Dst_ip])
 }
 
-func delFlowFromPri(v_ptr *bgp.Flow) {
+func (w *Window) delFlowFromPri(v_ptr *bgp.Flow) {
 	rp := uint64(v_ptr.Route)>>(32-v_ptr.Prefix)<<(40-v_ptr.Prefix) + uint64(v_ptr.Prefix)
+	if w.priSketch != nil {
+		w.priSketch.sub(rp, v_ptr.Dst_ip, v_ptr.Size)
+		w.forgetDstAs(v_ptr.Dst_ip)
+		w.delFlowFromSec(v_ptr, rp)
+		return
+	}
 
 	// delete flow from priRoute2Dst
-	priRoute2Dst[rp][v_ptr.Dst_ip] -= v_ptr.Size
-	if priRoute2Dst[rp][v_ptr.Dst_ip] <= 0 {
-		if len(priRoute2Dst[rp]) <= 1 {
-			delete(priRoute2Dst, rp)
+	w.priRoute2Dst[rp][v_ptr.Dst_ip] -= v_ptr.Size
+	if w.priRoute2Dst[rp][v_ptr.Dst_ip] <= 0 {
+		if len(w.priRoute2Dst[rp]) <= 1 {
+			delete(w.priRoute2Dst, rp)
 		} else {
-			delete(priRoute2Dst[rp], v_ptr.Dst_ip)
+			delete(w.priRoute2Dst[rp], v_ptr.Dst_ip)
 		}
 	}
 
 	// delete flow from priDst2Route
-	if priDst2Route[v_ptr.Dst_ip][0].RoutePrefix != rp {
+	if w.priDst2Route[v_ptr.Dst_ip][0].RoutePrefix != rp {
 		util.PanicError(errors.New("func delFlowFromPri: "), "priDst2Route[v_ptr.Dst_ip][0].RoutePrefix != rp\n")
 	}
-	priDst2Route[v_ptr.Dst_ip][0].Size -= v_ptr.Size
-	if priDst2Route[v_ptr.Dst_ip][0].Size <= 0 {
-		if len(priDst2Route[v_ptr.Dst_ip]) == 1 {
-			delete(priDst2Route, v_ptr.Dst_ip)
+	w.priDst2Route[v_ptr.Dst_ip][0].Size -= v_ptr.Size
+	if w.priDst2Route[v_ptr.Dst_ip][0].Size <= 0 {
+		if len(w.priDst2Route[v_ptr.Dst_ip]) == 1 {
+			delete(w.priDst2Route, v_ptr.Dst_ip)
 		} else {
-			priDst2Route[v_ptr.Dst_ip] = priDst2Route[v_ptr.Dst_ip][1:]
+			w.priDst2Route[v_ptr.Dst_ip] = w.priDst2Route[v_ptr.Dst_ip][1:]
 		}
 	}
+	w.forgetDstAs(v_ptr.Dst_ip)
+	w.delFlowFromSec(v_ptr, rp)
 	// fmt.Printf("\033[44;37mCurTime: %d\033[0m\n", time.Now().Unix())
 }
 
-func addFlow2Post(v_ptr *bgp.Flow) {
+func (w *Window) addFlow2Post(v_ptr *bgp.Flow) {
 	rp := uint64(v_ptr.Route)>>(32-v_ptr.Prefix)<<(40-v_ptr.Prefix) + uint64(v_ptr.Prefix)
+	if w.postSketch != nil {
+		w.addFlow2Sketch(w.postSketch, v_ptr, rp)
+		w.addFlow2Sec(v_ptr, rp)
+		return
+	}
 
 	// add flow to postRoute2Dst
-	dst_list, ok_out := postRoute2Dst[rp]
+	dst_list, ok_out := w.postRoute2Dst[rp]
 	if ok_out {
 		_, ok_in := dst_list[v_ptr.Dst_ip]
 		if ok_in {
@@ -115,69 +203,89 @@ func addFlow2Post(v_ptr *bgp.Flow) {
 			dst_list[v_ptr.Dst_ip] = v_ptr.Size
 		}
 	} else {
-		postRoute2Dst[rp] = map[uint32]uint64{
+		w.postRoute2Dst[rp] = map[uint32]uint64{
 			v_ptr.Dst_ip: v_ptr.Size,
 		}
 	}
 
 	// add flow to postDst2Route
-	route_q, ok_q := postDst2Route[v_ptr.Dst_ip]
+	route_q, ok_q := w.postDst2Route[v_ptr.Dst_ip]
 	if ok_q {
 		if route_q[len(route_q)-1].RoutePrefix == rp {
-			postDst2Route[v_ptr.Dst_ip][len(route_q)-1].Size += v_ptr.Size
+			w.postDst2Route[v_ptr.Dst_ip][len(route_q)-1].Size += v_ptr.Size
 		} else {
-			postDst2Route[v_ptr.Dst_ip] = append(postDst2Route[v_ptr.Dst_ip], bgp.IpInfo{
+			w.postDst2Route[v_ptr.Dst_ip] = append(w.postDst2Route[v_ptr.Dst_ip], bgp.IpInfo{
 				RoutePrefix: rp,
 				Size:        v_ptr.Size,
 			})
 		}
 	} else {
-		postDst2Route[v_ptr.Dst_ip] = []bgp.IpInfo{
+		w.postDst2Route[v_ptr.Dst_ip] = []bgp.IpInfo{
 			{
 				RoutePrefix: rp,
 				Size:        v_ptr.Size,
 			},
 		}
 	}
+	w.dstAs[v_ptr.Dst_ip] = v_ptr.Dst_as
+	w.dstObs[v_ptr.Dst_ip] = v_ptr.Observer_ip
+	w.addFlow2Sec(v_ptr, rp)
 
 	// fmt.Printf("\033[42;37mCurTime: %d\033[0m\n", time.Now().Unix())
 	// fmt.Printf("\033[32mpostRoute2Dst \033[0mis %+v\n\033[32mpostDst2Route \033[0mis %+v\n", postRoute2Dst[rp], postDst2Route[v_ptr.Dst_ip])
 }
 
-func delFlowFromPost(v_ptr *bgp.Flow) {
+func (w *Window) delFlowFromPost(v_ptr *bgp.Flow) {
 	rp := uint64(v_ptr.Route)>>(32-v_ptr.Prefix)<<(40-v_ptr.Prefix) + uint64(v_ptr.Prefix)
+	if w.postSketch != nil {
+		w.postSketch.sub(rp, v_ptr.Dst_ip, v_ptr.Size)
+		w.forgetDstAs(v_ptr.Dst_ip)
+		return
+	}
 
 	// delete flow from postRoute2Dst
-	postRoute2Dst[rp][v_ptr.Dst_ip] -= v_ptr.Size
-	if postRoute2Dst[rp][v_ptr.Dst_ip] <= 0 {
-		if len(postRoute2Dst[rp]) <= 1 {
-			delete(postRoute2Dst, rp)
+	w.postRoute2Dst[rp][v_ptr.Dst_ip] -= v_ptr.Size
+	if w.postRoute2Dst[rp][v_ptr.Dst_ip] <= 0 {
+		if len(w.postRoute2Dst[rp]) <= 1 {
+			delete(w.postRoute2Dst, rp)
 		} else {
-			delete(postRoute2Dst[rp], v_ptr.Dst_ip)
+			delete(w.postRoute2Dst[rp], v_ptr.Dst_ip)
 		}
 	}
 
 	// delete flow from postDst2Route
-	if postDst2Route[v_ptr.Dst_ip][0].RoutePrefix != rp {
+	if w.postDst2Route[v_ptr.Dst_ip][0].RoutePrefix != rp {
 		util.PanicError(errors.New("func delFlowFrompost: "), "postDst2Route[v_ptr.Dst_ip][0].RoutePrefix != rp\n")
 	}
-	postDst2Route[v_ptr.Dst_ip][0].Size -= v_ptr.Size
-	if postDst2Route[v_ptr.Dst_ip][0].Size <= 0 {
-		if len(postDst2Route[v_ptr.Dst_ip]) == 1 {
-			delete(postDst2Route, v_ptr.Dst_ip)
+	w.postDst2Route[v_ptr.Dst_ip][0].Size -= v_ptr.Size
+	if w.postDst2Route[v_ptr.Dst_ip][0].Size <= 0 {
+		if len(w.postDst2Route[v_ptr.Dst_ip]) == 1 {
+			delete(w.postDst2Route, v_ptr.Dst_ip)
 		} else {
-			postDst2Route[v_ptr.Dst_ip] = postDst2Route[v_ptr.Dst_ip][1:]
+			w.postDst2Route[v_ptr.Dst_ip] = w.postDst2Route[v_ptr.Dst_ip][1:]
 		}
 	}
+	w.forgetDstAs(v_ptr.Dst_ip)
 
 	// fmt.Printf("\033[43;37mCurTime: %d\033[0m\n", time.Now().Unix())
 }
 
 func AddFlow2Q(flow bgp.Flow) {
-	// End t to modify
+	if post_e_t := postEndTime.Load(); post_e_t != 0 && flow.End_t <= post_e_t {
+		lateFlows.Inc()
+	}
 	Flow_queue.CsPush(flow, flow.End_t)
 }
 
+func AddUpdate2Q(bu bgp.BgpInfo) {
+	if Rib_view != nil {
+		Rib_view.classify(&bu)
+	}
+	for _, w := range Windows {
+		w.Updata_queue.CsPush(bu, bu.Btime)
+	}
+}
+
 /*
 Exec GivenCurrentTime every second.
 */
@@ -187,29 +295,53 @@ Exec GivenCurrentTime every second.
 //                   | |
 //              sync deviation
 
-func GivenCurrentTime(utime int64, delay int64, agetime int64, syncdevi int64) {
-	Flow_queue.ModifyTime(utime, delay, agetime, syncdevi)
-	v_ptr := new(bgp.Flow)
-	var flag bool
+func GivenCurrentTime(utime int64, delay int64) {
+	State_mu.Lock()
+	defer State_mu.Unlock()
+
+	for _, w := range Windows {
+		w.givenCurrentTime(utime, delay)
+	}
+}
+
+func (w *Window) givenCurrentTime(utime int64, delay int64) {
+	agetime := w.Agetime
+	syncdevi := w.Syncdevi
+	cursors := w.Flow_cursors
+	cursors.ModifyTime(utime, delay, agetime, syncdevi)
+	if w == Windows[0] {
+		postEndTime.Store(utime - delay)
+	}
+
+	// Each cursor takes the queue lock once per tick, the maps are updated
+	// once it is released
 
 	// ADD flows at time POSTEND to PriMaps
-	for flag = Flow_queue.CsOnePostEndOvertime(v_ptr); flag; flag = Flow_queue.CsOnePostEndOvertime(v_ptr) {
-		addFlow2Post(v_ptr)
+	w.flowBuf = cursors.CsAdvance(util.POST_END, w.flowBuf[:0])
+	for i := range w.flowBuf {
+		w.addFlow2Post(&w.flowBuf[i])
 	}
 
 	// Delete outdated(before delay+agetime) entry in PriRoute2Dst and PriDst2Route
-	for flag = Flow_queue.CsOnePostStartOvertime(v_ptr); flag; flag = Flow_queue.CsOnePostStartOvertime(v_ptr) {
-		delFlowFromPost(v_ptr)
+	w.flowBuf = cursors.CsAdvance(util.POST_START, w.flowBuf[:0])
+	for i := range w.flowBuf {
+		w.delFlowFromPost(&w.flowBuf[i])
 	}
 
 	// ADD flows at time (BGPUPDATE - syncdevi) to PriMaps
-	for flag = Flow_queue.CsOnePriEndOvertime(v_ptr); flag; flag = Flow_queue.CsOnePriEndOvertime(v_ptr) {
-		addFlow2Pri(v_ptr)
+	w.flowBuf = cursors.CsAdvance(util.PRI_END, w.flowBuf[:0])
+	for i := range w.flowBuf {
+		w.addFlow2Pri(&w.flowBuf[i])
 	}
 
 	// Delete outdated(before delay+2*agetime+2*syncdevi) entry in PriRoute2Dst and PriDst2Route
-	for flag = Flow_queue.CsPopPriStartOverTime(v_ptr); flag; flag = Flow_queue.CsPopPriStartOverTime(v_ptr) {
-		delFlowFromPri(v_ptr)
+	w.flowBuf = cursors.CsAdvance(util.PRI_START, w.flowBuf[:0])
+	for i := range w.flowBuf {
+		w.delFlowFromPri(&w.flowBuf[i])
+	}
+	if cap(w.flowBuf) > maxFlowBuf {
+		// do not hold on to a burst
+		w.flowBuf = nil
 	}
 
 	// For each update BU at this time
@@ -217,55 +349,138 @@ func GivenCurrentTime(utime int64, delay int64, agetime int64, syncdevi int64) {
 	// If type is add: get dst_IP list that use BU after BGPUPDATE.
 	//		For each IP, if its route queue head is quite BU, we think this IP is affected by BU
 	//		Find this IP in
-	for v, flag := Updata_queue.CsPopOverTime(utime - delay - agetime); flag; v, flag = Updata_queue.CsPopOverTime(utime - delay - agetime - syncdevi) {
-		GivenUpdate(&v)
+	for v, flag := w.Updata_queue.CsPopOverTime(utime - delay - agetime); flag; v, flag = w.Updata_queue.CsPopOverTime(utime - delay - agetime - syncdevi) {
+		if w.analyses(&v) {
+			w.GivenUpdate(&v)
+		}
 	}
+	if w == Windows[0] {
+		checkBucket(utime - delay - agetime - syncdevi)
+		checkEvents(utime - delay - agetime - syncdevi)
+		checkTopN(utime - delay - agetime - syncdevi)
+	}
+}
 
+func newRoutePrefix(bu *bgp.BgpInfo) uint64 {
+	return uint64(bu.New_ip_addr)>>(32-bu.New_ip_prefix)<<(40-bu.New_ip_prefix) + uint64(bu.New_ip_prefix)
 }
 
-var ipLoginfo bgp.IpLogInfo
+func oldRoutePrefix(bu *bgp.BgpInfo) uint64 {
+	return uint64(bu.Old_ip_addr)>>(32-bu.Old_ip_prefix)<<(40-bu.Old_ip_prefix) + uint64(bu.Old_ip_prefix)
+}
 
-func GivenUpdate(bu *bgp.BgpInfo) {
+func (w *Window) GivenUpdate(bu *bgp.BgpInfo) {
 	SaveBgpUpdate(bu)
+	ipLoginfo := bgp.IpLogInfo{Window: w.Agetime}
+	var sum *bgp.UpdateSummary
+	pri_routes := make(map[uint64]bool)
+	post_routes := make(map[uint64]bool)
+	var details []bgp.IpLogInfo
 	// Add: find post ip_list according to Route
 	if bu.Msg_type == bgp.BGP_ADD {
-		rp := uint64(bu.New_ip_addr)>>(32-bu.New_ip_prefix)<<(40-bu.New_ip_prefix) + uint64(bu.New_ip_prefix)
+		rp := newRoutePrefix(bu)
+		sum = newUpdateSummary(bu, rp)
+		post_routes[rp] = true
 		ipLoginfo.PostRoute = rp
-		fmt.Printf("\033[33mUpdate ADD :\033[0m %+v\n", ipLoginfo)
-		for k, v := range postRoute2Dst[rp] {
+		util.Debugf("\033[33mUpdate ADD :\033[0m %+v\n", ipLoginfo)
+		for k, v := range w.routeDsts(false, rp) {
 			ipLoginfo.DstIp = k
+			ipLoginfo.DstAs = w.dstAs[k]
+			ipLoginfo.Observer = w.dstObs[k]
 			ipLoginfo.PostFlow = v
-			route, ok := priDst2Route[k]
+			route, ok := w.priRouteOf(k)
 			if ok {
-				ipLoginfo.PriRoute = route[len(route)-1].RoutePrefix
-				ipLoginfo.PriFlow = route[len(route)-1].Size
+				ipLoginfo.PriRoute = route.RoutePrefix
+				ipLoginfo.PriFlow = route.Size
+				sum.Away[w.routeAsn[ipLoginfo.PriRoute]] += ipLoginfo.PriFlow
+				pri_routes[ipLoginfo.PriRoute] = true
 			} else {
 				ipLoginfo.PriRoute = 0
 				ipLoginfo.PriFlow = 0
 			}
+			sum.Toward[bu.New_first_asn] += v
+			addDetail2Summary(sum, ipLoginfo)
+			details = append(details, ipLoginfo)
 			SaveDetailInfo(ipLoginfo)
 		}
+		w.addUntracked(sum, false, rp, bu.New_first_asn)
 	} else if bu.Msg_type == bgp.BGP_DELETE {
-		rp := uint64(bu.Old_ip_addr)>>(32-bu.Old_ip_prefix)<<(40-bu.Old_ip_prefix) + uint64(bu.Old_ip_prefix)
+		rp := oldRoutePrefix(bu)
+		sum = newUpdateSummary(bu, rp)
+		pri_routes[rp] = true
 		ipLoginfo.PriRoute = rp
-		fmt.Printf("\033[34mUpdate DEL :\033[0m %+v\n", ipLoginfo)
-		for k, v := range priRoute2Dst[rp] {
+		util.Debugf("\033[34mUpdate DEL :\033[0m %+v\n", ipLoginfo)
+		for k, v := range w.routeDsts(true, rp) {
 			ipLoginfo.DstIp = k
+			ipLoginfo.DstAs = w.dstAs[k]
+			ipLoginfo.Observer = w.dstObs[k]
 			ipLoginfo.PriFlow = v
-			route, ok := postDst2Route[k]
+			route, ok := w.postRouteOf(k)
 			if ok {
-				ipLoginfo.PostRoute = route[0].RoutePrefix
-				ipLoginfo.PostFlow = route[0].Size
+				ipLoginfo.PostRoute = route.RoutePrefix
+				ipLoginfo.PostFlow = route.Size
+				sum.Toward[w.routeAsn[ipLoginfo.PostRoute]] += ipLoginfo.PostFlow
+				post_routes[ipLoginfo.PostRoute] = true
 			} else {
 				ipLoginfo.PostRoute = 0
 				ipLoginfo.PostFlow = 0
 			}
+			sum.Away[bu.Old_first_asn] += v
+			addDetail2Summary(sum, ipLoginfo)
+			details = append(details, ipLoginfo)
 			SaveDetailInfo(ipLoginfo)
 		}
+		w.addUntracked(sum, true, rp, bu.Old_first_asn)
 	} else if bu.Msg_type == bgp.BGP_UPDATE {
 		// check availability
+		// Only a change of first-hop AS moves traffic between upstreams
+		rp := newRoutePrefix(bu)
+		sum = newUpdateSummary(bu, rp)
+		if bu.Old_first_asn != bu.New_first_asn {
+			if pri := w.routeBytes(true, rp); pri > 0 {
+				sum.Away[bu.Old_first_asn] += pri
+				sum.PriFlow += pri
+			}
+			if post := w.routeBytes(false, rp); post > 0 {
+				sum.Toward[bu.New_first_asn] += post
+				sum.PostFlow += post
+			}
+			sum.Moved = sum.PriFlow
+			if sum.PostFlow > sum.PriFlow {
+				sum.Moved = sum.PostFlow
+			}
+		}
 	} else {
 		util.PanicError(errors.New("func GivenUpdate: "), "Invalid Msg_type\n")
+		return
+	}
+	w.estimateConvergence(sum, pri_routes, post_routes)
+	w.learnRouteAsn(bu)
+	w.setErrorBound(sum)
+	sum.Window = w.Agetime
+	updatesProcessed.With(strconv.FormatInt(w.Agetime, 10), msgTypeName(bu.Msg_type)).Inc()
+	detailRecords.Add(uint64(len(details)))
+	emitUpdate(bu, sum, details)
+	SaveUpdateSummary(sum)
+
+	// rollups, events and rankings follow the primary window only
+	if w == Windows[0] {
+		addSummary2Bucket(sum)
+		addUpdate2Event(bu, sum, details)
+		addUpdate2Top(sum, details)
+	}
+}
+
+func addDetail2Summary(sum *bgp.UpdateSummary, info bgp.IpLogInfo) {
+	sum.DstCount++
+	sum.PriFlow += info.PriFlow
+	sum.PostFlow += info.PostFlow
+	if info.PostFlow > info.PriFlow {
+		sum.DstAs[info.DstAs] += info.PostFlow
+		sum.Moved += info.PostFlow
+	} else {
+		sum.DstAs[info.DstAs] += info.PriFlow
+		sum.Moved += info.PriFlow
 	}
 }
 
@@ -280,8 +495,47 @@ func SaveBgpUpdate(bu *bgp.BgpInfo) {
 	// }
 }
 
+func SaveUpdateSummary(sum *bgp.UpdateSummary) {
+	File_writer.WriteString(fmt.Sprintf("UPDATE summary: %+v\n", *sum))
+}
+
 func SaveDetailInfo(ipLoginfo bgp.IpLogInfo) {
-	fmt.Printf("\033[33mDetailed : %+v\033[0m\n", ipLoginfo)
+	util.Debugf("\033[33mDetailed : %+v\033[0m\n", ipLoginfo)
 	// Write to buffer and files
 	File_writer.WriteString(fmt.Sprintf("LOG info: %+v\n", ipLoginfo))
 }
+
+/*
+Shutdown helpers. Both must run on the goroutine that calls GivenCurrentTime,
+after it stopped ticking.
+*/
+
+// Advance the clock second by second from utime until every pending update of
+// every window has been handled. Returns the last time given.
+func Drain(utime int64, delay int64) int64 {
+	target := utime
+	for _, w := range Windows {
+		_, btimes := w.Updata_queue.CsItems()
+		for _, b := range btimes {
+			if t := b + delay + w.Agetime + w.Syncdevi; t > target {
+				target = t
+			}
+		}
+	}
+	for utime < target {
+		utime++
+		GivenCurrentTime(utime, delay)
+	}
+	return utime
+}
+
+// Write the open rollup bucket and events, then flush File_writer and the sinks
+func FlushReports() error {
+	if curBucket != nil {
+		flushBucket()
+	}
+	for _, ev := range openEvents {
+		closeEvent(ev)
+	}
+	return FlushOutput()
+}
@@ -0,0 +1,111 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/metrics"
+	"strconv"
+	"time"
+)
+
+// Pipeline health metrics, exposed by metrics.Default.Handler()
+
+var (
+	flowsIngested = metrics.Default.NewCounterVec("anaflow_flows_ingested_total",
+		"Flows parsed from each Loki server.", "source")
+	lokiLatency = metrics.Default.NewHistogram("anaflow_loki_request_duration_seconds",
+		"Latency of the Loki queries, reading the body included.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+	lokiErrors = metrics.Default.NewCounterVec("anaflow_loki_request_errors_total",
+		"Failed Loki queries.", "source")
+	lokiDeferred = metrics.Default.NewCounterVec("anaflow_loki_requests_deferred_total",
+		"Loki queries merged into the next one, as the previous query to the server was still running.", "source")
+	parseFailures = metrics.Default.NewCounterVec("anaflow_parse_failures_total",
+		"Loki responses, flow entries, BGP packets or feed events that could not be decoded.", "kind")
+	bgpPackets = metrics.Default.NewCounterVec("anaflow_bgp_packets_total",
+		"BGP packets decoded, per wire format.", "format")
+	malformedPackets = metrics.Default.NewCounterVec("anaflow_bgp_malformed_packets_total",
+		"BGP packets rejected, per reason.", "reason")
+	lateFlows = metrics.Default.NewCounter("anaflow_late_flows_total",
+		"Flows that arrived after the post-end cursor of the primary window had passed them.")
+	updatesProcessed = metrics.Default.NewCounterVec("anaflow_updates_processed_total",
+		"Updates handled, per window and type.", "window", "type")
+	detailRecords = metrics.Default.NewCounter("anaflow_detail_records_total",
+		"Per-destination detail records emitted.")
+	queueShed = metrics.Default.NewCounterVec("anaflow_queue_shed_total",
+		"Flows or updates dropped by a full queue, per window and queue.", "window", "queue")
+	queueBlocked = metrics.Default.NewCounterVec("anaflow_queue_blocked_total",
+		"Pushes that waited for room in a full queue, per window and queue.", "window", "queue")
+)
+
+func msgTypeName(t int32) string {
+	switch t {
+	case bgp.BGP_ADD:
+		return "add"
+	case bgp.BGP_DELETE:
+		return "delete"
+	case bgp.BGP_UPDATE:
+		return "update"
+	}
+	return "unknown"
+}
+
+func init() {
+	metrics.Default.NewGaugeFunc("anaflow_flow_queue_length",
+		"Flows buffered in the shared flow queue from the pri_start cursor of each window on.",
+		[]string{"window"}, func(emit func(float64, ...string)) {
+			for _, w := range Windows {
+				emit(float64(w.Flow_cursors.GetLength()), strconv.FormatInt(w.Agetime, 10))
+			}
+		})
+	metrics.Default.NewGaugeFunc("anaflow_update_queue_length", "Updates waiting in the update queue of each window.",
+		[]string{"window"}, func(emit func(float64, ...string)) {
+			for _, w := range Windows {
+				emit(float64(w.Updata_queue.GetLength()), strconv.FormatInt(w.Agetime, 10))
+			}
+		})
+	metrics.Default.NewGaugeFunc("anaflow_map_entries", "Entries of the route/dst maps of each window.",
+		[]string{"window", "map"}, func(emit func(float64, ...string)) {
+			State_mu.RLock()
+			defer State_mu.RUnlock()
+			for _, w := range Windows {
+				window := strconv.FormatInt(w.Agetime, 10)
+				emit(float64(len(w.priRoute2Dst)), window, "pri_route2dst")
+				emit(float64(len(w.priDst2Route)), window, "pri_dst2route")
+				emit(float64(len(w.postRoute2Dst)), window, "post_route2dst")
+				emit(float64(len(w.postDst2Route)), window, "post_dst2route")
+				if w.approximate() {
+					emit(float64(len(w.priSketch.routes)), window, "pri_sketch_routes")
+					emit(float64(w.priSketch.entries), window, "pri_heavy_hitters")
+					emit(float64(len(w.postSketch.routes)), window, "post_sketch_routes")
+					emit(float64(w.postSketch.entries), window, "post_heavy_hitters")
+				}
+			}
+		})
+	metrics.Default.NewGaugeFunc("anaflow_sketch_error_bound_bytes",
+		"Bytes a destination may be overcounted by in the approximate mode, per window.",
+		[]string{"window"}, func(emit func(float64, ...string)) {
+			State_mu.RLock()
+			defer State_mu.RUnlock()
+			for _, w := range Windows {
+				if w.approximate() {
+					emit(float64(w.errorBound()), strconv.FormatInt(w.Agetime, 10))
+				}
+			}
+		})
+	metrics.Default.NewGaugeFunc("anaflow_cursor_lag_seconds", "Wall clock minus the time of each window cursor.",
+		[]string{"window", "cursor"}, func(emit func(float64, ...string)) {
+			now := time.Now().Unix()
+			for _, w := range Windows {
+				window := strconv.FormatInt(w.Agetime, 10)
+				pri_s_t, pri_e_t, post_s_t, post_e_t := w.Flow_cursors.CursorTimes()
+				if post_e_t == 0 {
+					// no tick yet
+					continue
+				}
+				emit(float64(now-pri_s_t), window, "pri_start")
+				emit(float64(now-pri_e_t), window, "pri_end")
+				emit(float64(now-post_s_t), window, "post_start")
+				emit(float64(now-post_e_t), window, "post_end")
+				emit(float64(now-(post_e_t-w.Agetime)), window, "update")
+			}
+		})
+}
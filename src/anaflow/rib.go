@@ -0,0 +1,124 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"reflect"
+	"sync"
+)
+
+/*
+Adj-RIB-In of the sources that only announce and withdraw routes.
+
+BIRD tells which route an update replaces, a BGP session or a route feed does
+not. The routes a source announced are kept here, so that an announcement
+becomes a BGP_ADD, or a BGP_UPDATE against the route it replaces, and a
+withdrawal a BGP_DELETE of the route it removes. Announcing a route again with
+the same attributes is no update.
+*/
+
+type ribKey struct {
+	peer    uint32 // 0 if the source has one route per prefix
+	rp      uint64
+	path_id uint32
+}
+
+type ribRoute struct {
+	peer_addr uint32
+	peer_asn  uint32
+	nexthop   uint32
+	first_asn int32
+	path_len  int32
+	pref      int32
+	attrs     bgp.RouteAttrs
+}
+
+type adjRib struct {
+	source string
+	mu     sync.Mutex
+	routes map[ribKey]ribRoute
+}
+
+func newAdjRib(source string) *adjRib {
+	return &adjRib{source: source, routes: make(map[ribKey]ribRoute)}
+}
+
+func newRibRoute(peer_addr uint32, peer_asn uint32, nexthop uint32, pref int32, attrs bgp.RouteAttrs) ribRoute {
+	r := ribRoute{peer_addr: peer_addr, peer_asn: peer_asn, nexthop: nexthop, path_len: int32(len(attrs.As_path)), pref: pref, attrs: attrs}
+	if len(attrs.As_path) > 0 {
+		r.first_asn = int32(attrs.As_path[0])
+	}
+	return r
+}
+
+func (r *adjRib) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.routes)
+}
+
+func (r *adjRib) announce(key ribKey, route ribRoute, btime int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.routes[key]
+	r.routes[key] = route
+	switch {
+	case !ok:
+		r.queue(bgp.BGP_ADD, key, nil, &route, btime)
+	case !reflect.DeepEqual(old, route):
+		r.queue(bgp.BGP_UPDATE, key, &old, &route, btime)
+	}
+}
+
+func (r *adjRib) withdraw(key ribKey, btime int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.routes[key]; ok {
+		delete(r.routes, key)
+		r.queue(bgp.BGP_DELETE, key, &old, nil, btime)
+	}
+}
+
+// Withdraw the routes learned from peer, all of them if peer is 0
+func (r *adjRib) withdrawPeer(peer uint32, btime int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, old := range r.routes {
+		if peer == 0 || old.peer_addr == peer {
+			delete(r.routes, key)
+			r.queue(bgp.BGP_DELETE, key, &old, nil, btime)
+		}
+	}
+}
+
+func (r *adjRib) queue(msg_type int32, key ribKey, old *ribRoute, new *ribRoute, btime int64) {
+	bu := bgp.BgpInfo{Msg_type: msg_type, Btime: btime, Path_id: key.path_id}
+	if old != nil {
+		old.setOld(&bu, key.rp)
+	}
+	if new != nil {
+		new.setNew(&bu, key.rp)
+	}
+	deliver(bu, r.source)
+}
+
+// The route an update adds
+func newRouteOf(bu *bgp.BgpInfo) ribRoute {
+	return ribRoute{peer_addr: bu.Peer_addr, peer_asn: bu.Peer_asn, nexthop: bu.New_nexthop, first_asn: bu.New_first_asn,
+		path_len: bu.New_path_len, pref: bu.New_pref, attrs: bu.New_attrs}
+}
+
+// Fill the fields of bu about the route it replaces or removes
+func (route *ribRoute) setOld(bu *bgp.BgpInfo, rp uint64) {
+	bu.Old_ip_addr, bu.Old_ip_prefix = uint32(rp>>8), int32(rp&0xff)
+	bu.Old_nexthop, bu.Old_first_asn, bu.Old_path_len, bu.Old_pref = route.nexthop, route.first_asn, route.path_len, route.pref
+	bu.Old_attrs = route.attrs
+	bu.Peer_addr, bu.Peer_asn = route.peer_addr, route.peer_asn
+}
+
+// Fill the fields of bu about the route it adds
+func (route *ribRoute) setNew(bu *bgp.BgpInfo, rp uint64) {
+	bu.New_ip_addr, bu.New_ip_prefix = uint32(rp>>8), int32(rp&0xff)
+	bu.New_nexthop, bu.New_first_asn, bu.New_path_len, bu.New_pref = route.nexthop, route.first_asn, route.path_len, route.pref
+	bu.New_attrs = route.attrs
+	bu.Peer_addr, bu.Peer_asn = route.peer_addr, route.peer_asn
+}
@@ -0,0 +1,223 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/metrics"
+	"anaflow/src/util"
+	"sync"
+)
+
+/*
+RIB view: the current route of every prefix, to classify the updates.
+
+Anaflow only sees the changes of the routing table, so without a baseline it
+cannot tell an ADD that brings a new route from one that replaces a route. The
+view is loaded from a table dump, see RibSync, and kept current by every update
+queued:
+
+	new                ADD of a route the view does not hold
+	implicit_withdraw  ADD of a route the view holds, which it replaces
+	replacement        UPDATE, which names the route it replaces
+	withdraw           DELETE, the route is removed
+
+The class is only a label, the update is handled as it arrived. Routes are
+held by peer, prefix and add-path ID like in the Adj-RIB-In of rib.go, so the
+routes several peers or paths announce for a prefix are classified and
+withdrawn apart. BIRD exports one route per prefix, from peer 0 unless its
+messages name the peer. An update of peer 0 stands for the one route of its
+prefix, which the view may hold from any peer, e.g. from a birdc table that
+names them: it matches and replaces every route of the prefix.
+
+A table loaded after the start also gives the windows the first-hop ASN of the
+routes they have not learned from an update yet.
+*/
+
+type RibView struct {
+	mu       sync.Mutex
+	routes   map[ribKey]ribRoute
+	prefixes map[uint64][]ribKey // route prefix -> keys of its routes
+}
+
+// nil while the view is disabled
+var Rib_view *RibView
+
+var updatesClassified = metrics.Default.NewCounterVec("anaflow_updates_classified_total",
+	"Updates classified against the RIB view, per class.", "class")
+
+func init() {
+	metrics.Default.NewGaugeFunc("anaflow_rib_view_routes", "Prefixes with a route in the RIB view.",
+		nil, func(emit func(float64, ...string)) {
+			if v := Rib_view; v != nil {
+				emit(float64(v.len()))
+			}
+		})
+}
+
+func EnableRibView() {
+	Rib_view = &RibView{routes: make(map[ribKey]ribRoute, INITVOLUME), prefixes: make(map[uint64][]ribKey, INITVOLUME)}
+}
+
+func (v *RibView) len() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.prefixes)
+}
+
+// Whether the view holds the route of key, any route of its prefix for peer 0
+func (v *RibView) holds(key ribKey) bool {
+	if key.peer == 0 {
+		return len(v.prefixes[key.rp]) > 0
+	}
+	_, ok := v.routes[key]
+	return ok
+}
+
+func (v *RibView) insert(key ribKey, route ribRoute) {
+	if _, ok := v.routes[key]; !ok {
+		v.prefixes[key.rp] = append(v.prefixes[key.rp], key)
+	}
+	v.routes[key] = route
+}
+
+func (v *RibView) remove(key ribKey) {
+	if _, ok := v.routes[key]; !ok {
+		return
+	}
+	delete(v.routes, key)
+	keys := v.prefixes[key.rp]
+	for i := range keys {
+		if keys[i] == key {
+			keys[i] = keys[len(keys)-1]
+			keys = keys[:len(keys)-1]
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(v.prefixes, key.rp)
+	} else {
+		v.prefixes[key.rp] = keys
+	}
+}
+
+// Remove the route of key, every route of its prefix for peer 0
+func (v *RibView) withdraw(key ribKey) {
+	if key.peer != 0 {
+		v.remove(key)
+		return
+	}
+	for _, k := range v.prefixes[key.rp] {
+		delete(v.routes, k)
+	}
+	delete(v.prefixes, key.rp)
+}
+
+// Set the class of bu and update the view. Nothing else of bu changes.
+func (v *RibView) classify(bu *bgp.BgpInfo) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	old_key := ribKey{bu.Peer_addr, oldRoutePrefix(bu), bu.Path_id}
+	new_key := ribKey{bu.Peer_addr, newRoutePrefix(bu), bu.Path_id}
+	switch bu.Msg_type {
+	case bgp.BGP_ADD:
+		if v.holds(new_key) {
+			bu.Class = bgp.CLASS_IMPLICIT_WITHDRAW
+			v.withdraw(new_key)
+		} else {
+			bu.Class = bgp.CLASS_NEW
+		}
+		v.insert(new_key, newRouteOf(bu))
+	case bgp.BGP_UPDATE:
+		v.withdraw(old_key)
+		v.insert(new_key, newRouteOf(bu))
+		bu.Class = bgp.CLASS_REPLACEMENT
+	case bgp.BGP_DELETE:
+		v.withdraw(old_key)
+		bu.Class = bgp.CLASS_WITHDRAW
+	}
+	updatesClassified.With(bu.Class.String()).Inc()
+}
+
+// A table being loaded into the view. When it ends, its routes replace those
+// the view holds from the same peers and from peer 0; of several routes of a
+// peer and prefix it keeps the best one.
+type RibSync struct {
+	source string
+	routes map[ribKey]ribRoute
+}
+
+func NewRibSync(source string) *RibSync {
+	return &RibSync{source: source, routes: make(map[ribKey]ribRoute)}
+}
+
+func (s *RibSync) Add(e bgp.TableEntry) {
+	s.add(ribKey{peer: e.Peer_addr, rp: e.Route}, newRibRoute(e.Peer_addr, e.Peer_asn, e.Nexthop, e.Pref, e.Attrs))
+}
+
+func (s *RibSync) add(key ribKey, route ribRoute) {
+	if old, ok := s.routes[key]; !ok || betterRoute(&route, &old) {
+		s.routes[key] = route
+	}
+}
+
+// Replace the routes of the peers of routes, and those of peer 0 which stand
+// for any peer, by routes
+func (v *RibView) replace(routes map[ribKey]ribRoute) {
+	peers := map[uint32]bool{0: true}
+	for key := range routes {
+		peers[key.peer] = true
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key := range v.routes {
+		if peers[key.peer] {
+			v.remove(key)
+		}
+	}
+	for key, route := range routes {
+		v.insert(key, route)
+	}
+}
+
+// A short BGP decision process: highest preference, shortest AS path, lowest
+// origin, lowest MED, lowest peer address
+func betterRoute(a, b *ribRoute) bool {
+	switch {
+	case a.pref != b.pref:
+		return a.pref > b.pref
+	case a.path_len != b.path_len:
+		return a.path_len < b.path_len
+	case a.attrs.Origin != b.attrs.Origin:
+		return a.attrs.Origin < b.attrs.Origin
+	case a.attrs.Med != b.attrs.Med:
+		return a.attrs.Med < b.attrs.Med
+	}
+	return a.peer_addr < b.peer_addr
+}
+
+// Load the table into the view, if enabled, and the first-hop ASN of the best
+// route of each prefix into the windows. Returns the number of prefixes
+// loaded.
+func (s *RibSync) End() int {
+	if v := Rib_view; v != nil {
+		v.replace(s.routes)
+	}
+
+	best := make(map[uint64]ribRoute, len(s.routes))
+	for key, route := range s.routes {
+		if old, ok := best[key.rp]; !ok || betterRoute(&route, &old) {
+			best[key.rp] = route
+		}
+	}
+	State_mu.Lock()
+	for _, w := range Windows {
+		for rp, route := range best {
+			if _, ok := w.routeAsn[rp]; !ok {
+				w.routeAsn[rp] = route.first_asn
+			}
+		}
+	}
+	State_mu.Unlock()
+
+	util.Infof("RIB %s: %d prefixes loaded\n", s.source, len(best))
+	return len(best)
+}
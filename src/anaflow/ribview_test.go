@@ -0,0 +1,89 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"testing"
+)
+
+const (
+	ribPeerA = 0xc0000201
+	ribPeerB = 0xc0000202
+)
+
+func ribAdd(peer uint32, rp uint64) *bgp.BgpInfo {
+	return &bgp.BgpInfo{Msg_type: bgp.BGP_ADD, Peer_addr: peer, New_ip_addr: uint32(rp >> 8), New_ip_prefix: int32(rp & 0xff)}
+}
+
+func ribDelete(peer uint32, rp uint64) *bgp.BgpInfo {
+	return &bgp.BgpInfo{Msg_type: bgp.BGP_DELETE, Peer_addr: peer, Old_ip_addr: uint32(rp >> 8), Old_ip_prefix: int32(rp & 0xff)}
+}
+
+func checkClass(t *testing.T, v *RibView, bu *bgp.BgpInfo, class bgp.UpdateClass) {
+	t.Helper()
+	v.classify(bu)
+	if bu.Class != class {
+		t.Errorf("update %d of peer %x: class %s, want %s", bu.Msg_type, bu.Peer_addr, bu.Class, class)
+	}
+}
+
+// A birdc table names the peers, the BIRD updates come from peer 0
+func TestRibViewSyncThenBird(t *testing.T) {
+	SetupWindows(60, 0, nil)
+	EnableRibView()
+	defer func() { Rib_view = nil }()
+	v := Rib_view
+
+	const p8, p24, pNew = 0x0a000000<<8 | 8, 0xc6336400<<8 | 24, 0xc0000200<<8 | 24
+	table := NewRibSync("birdc:test")
+	table.Add(bgp.TableEntry{Route: p8, Peer_addr: ribPeerA, Peer_asn: 64512, Nexthop: ribPeerA, Pref: 100})
+	table.Add(bgp.TableEntry{Route: p8, Peer_addr: ribPeerB, Peer_asn: 64513, Nexthop: ribPeerB, Pref: 100})
+	table.Add(bgp.TableEntry{Route: p24, Peer_addr: ribPeerA, Peer_asn: 64512, Nexthop: ribPeerA, Pref: 100})
+	if n := table.End(); n != 2 {
+		t.Fatalf("%d prefixes loaded, want 2", n)
+	}
+
+	checkClass(t, v, ribAdd(0, p8), bgp.CLASS_IMPLICIT_WITHDRAW)
+	if len(v.routes) != 2 || !v.holds(ribKey{rp: p8}) || v.holds(ribKey{peer: ribPeerA, rp: p8}) {
+		t.Errorf("the BIRD route did not replace the routes of its prefix: %v", v.routes)
+	}
+	checkClass(t, v, ribDelete(0, p24), bgp.CLASS_WITHDRAW)
+	checkClass(t, v, ribAdd(0, pNew), bgp.CLASS_NEW)
+	checkClass(t, v, ribAdd(0, pNew), bgp.CLASS_IMPLICIT_WITHDRAW)
+	if n := v.len(); n != 2 {
+		t.Errorf("%d prefixes in the view, want 2", n)
+	}
+}
+
+// A table replaces the routes of its peers and of peer 0, not the others
+func TestRibViewSyncReplaces(t *testing.T) {
+	SetupWindows(60, 0, nil)
+	EnableRibView()
+	defer func() { Rib_view = nil }()
+	v := Rib_view
+
+	const p1, p2, p3 = 0x0a000000<<8 | 8, 0xc6336400<<8 | 24, 0xc0000200<<8 | 24
+	checkClass(t, v, ribAdd(ribPeerA, p1), bgp.CLASS_NEW)
+	checkClass(t, v, ribAdd(ribPeerA, p2), bgp.CLASS_NEW)
+	checkClass(t, v, ribAdd(ribPeerB, p1), bgp.CLASS_NEW)
+	checkClass(t, v, ribAdd(0, p3), bgp.CLASS_NEW)
+
+	table := NewRibSync("mrt:test")
+	table.Add(bgp.TableEntry{Route: p1, Peer_addr: ribPeerA, Peer_asn: 64512, Nexthop: ribPeerA, Pref: 100})
+	table.End()
+
+	for key, want := range map[ribKey]bool{
+		{peer: ribPeerA, rp: p1}: true,
+		{peer: ribPeerA, rp: p2}: false,
+		{peer: ribPeerB, rp: p1}: true,
+		{rp: p3}:                 false,
+	} {
+		if _, ok := v.routes[key]; ok != want {
+			t.Errorf("route of peer %x prefix %x in the view: %t, want %t", key.peer, key.rp, ok, want)
+		}
+	}
+	if n := v.len(); n != 1 {
+		t.Errorf("%d prefixes in the view, want 1", n)
+	}
+	checkClass(t, v, ribDelete(ribPeerB, p1), bgp.CLASS_WITHDRAW)
+	checkClass(t, v, ribAdd(ribPeerB, p1), bgp.CLASS_NEW)
+}
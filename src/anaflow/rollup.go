@@ -0,0 +1,121 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+	"fmt"
+)
+
+/*
+Per-AS rollups.
+
+Each handled update produces a bgp.UpdateSummary telling how many bytes moved
+away from and toward every first-hop AS, and which destination ASes were hit.
+Summaries are also folded into time buckets of Rollup_bucket seconds, so that
+capacity planners can see which upstreams absorbed traffic in a period.
+*/
+
+// Length of a rollup bucket (seconds). Set by main before the first tick.
+var Rollup_bucket int64 = 300
+
+type rollupBucket struct {
+	start   int64
+	updates int
+	away    map[int32]uint64
+	toward  map[int32]uint64
+	dstAs   map[uint32]uint64
+
+	converge []int64
+	drain    []int64
+}
+
+var curBucket *rollupBucket
+
+func newUpdateSummary(bu *bgp.BgpInfo, rp uint64) *bgp.UpdateSummary {
+	return &bgp.UpdateSummary{
+		Btime:     bu.Btime,
+		Msg_type:  bu.Msg_type,
+		Route:     rp,
+		Source:    bu.Source,
+		Class:     bu.Class,
+		Peer_addr: bu.Peer_addr,
+		Peer_asn:  bu.Peer_asn,
+		Old_attrs: bu.Old_attrs,
+		New_attrs: bu.New_attrs,
+		Away:      make(map[int32]uint64),
+		Toward:    make(map[int32]uint64),
+		DstAs:     make(map[uint32]uint64),
+	}
+}
+
+// keep routeAsn in line with the update that has just been handled
+func (w *Window) learnRouteAsn(bu *bgp.BgpInfo) {
+	switch bu.Msg_type {
+	case bgp.BGP_ADD, bgp.BGP_UPDATE:
+		w.routeAsn[newRoutePrefix(bu)] = bu.New_first_asn
+	case bgp.BGP_DELETE:
+		delete(w.routeAsn, oldRoutePrefix(bu))
+	}
+}
+
+func (w *Window) forgetDstAs(dst uint32) {
+	_, ok_pri := w.priDst2Route[dst]
+	_, ok_post := w.postDst2Route[dst]
+	if w.approximate() {
+		_, ok_pri = w.priSketch.dsts[dst]
+		_, ok_post = w.postSketch.dsts[dst]
+	}
+	if !ok_pri && !ok_post {
+		delete(w.dstAs, dst)
+		delete(w.dstObs, dst)
+	}
+}
+
+func addSummary2Bucket(sum *bgp.UpdateSummary) {
+	start := sum.Btime / Rollup_bucket * Rollup_bucket
+	if curBucket != nil && curBucket.start != start {
+		flushBucket()
+	}
+	if curBucket == nil {
+		curBucket = &rollupBucket{
+			start:  start,
+			away:   make(map[int32]uint64),
+			toward: make(map[int32]uint64),
+			dstAs:  make(map[uint32]uint64),
+		}
+	}
+
+	curBucket.updates++
+	for k, v := range sum.Away {
+		curBucket.away[k] += v
+	}
+	for k, v := range sum.Toward {
+		curBucket.toward[k] += v
+	}
+	for k, v := range sum.DstAs {
+		curBucket.dstAs[k] += v
+	}
+	if sum.Converge >= 0 {
+		curBucket.converge = append(curBucket.converge, sum.Converge)
+	}
+	if sum.Drain >= 0 {
+		curBucket.drain = append(curBucket.drain, sum.Drain)
+	}
+}
+
+// Flush the current bucket once the analysis cursor has left it
+func checkBucket(btime int64) {
+	if curBucket != nil && btime >= curBucket.start+Rollup_bucket {
+		flushBucket()
+	}
+}
+
+func flushBucket() {
+	b := curBucket
+	curBucket = nil
+	util.Infof("\033[36mAS rollup [%d, %d):\033[0m %d updates\n", b.start, b.start+Rollup_bucket, b.updates)
+	File_writer.WriteString(fmt.Sprintf("AS rollup: start=%d len=%d updates=%d away=%v toward=%v dst_as=%v\n",
+		b.start, Rollup_bucket, b.updates, b.away, b.toward, b.dstAs))
+	File_writer.WriteString(fmt.Sprintf("Convergence: start=%d len=%d converge={%s} drain={%s}\n",
+		b.start, Rollup_bucket, latencyStats(b.converge), latencyStats(b.drain)))
+}
@@ -10,88 +10,115 @@ package anaflow
 import (
 	"anaflow/src/bgp"
 	"anaflow/src/util"
-	"bytes"
-	"encoding/binary"
+	"bufio"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
-	"syscall"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/buger/jsonparser"
 )
 
-// BUR Implement
-const buf_len = 1000
-
-/* Packet Format
- 		msg_type 		4 byte
-		1: add RTE
-		2: delete RTE
-		3: change RTE attr
-
-	OLD_RTE_INFO(all 0 if not exists)
-		old_ip_addr 	4 byte
-		old_ip_prefix 	4 byte
-		old_nexthop 	4 byte
-		old_first_asn 	4 byte
-		old_path_len 	4 byte
-		old_pref 		4 byte
-
-	NEW_RTE_INFO(all 0 if not exists)
-		new_ip_addr 	4 byte
-		new_ip_prefix 	4 byte
-		new_nexthop 	4 byte
-		new_first_asn 	4 byte
-		new_path_len 	4 byte
-		new_pref 		4 byte
-*/
-
-func Packet2info(buf []byte, bgpinfo *bgp.BgpInfo) {
-	byteBuffer := bytes.NewReader(buf)
-	if err := binary.Read(byteBuffer, binary.LittleEndian, bgpinfo); err != nil {
-		util.CheckError(err)
+// BUR Implement, the listeners are in source.go
+
+// Packets are bgp messages, framed or legacy, see bgp/wire.go
+func Packet2info(buf []byte, bgpinfo *bgp.BgpInfo) error {
+	version, err := bgp.UnmarshalMessage(buf, bgpinfo)
+	if err != nil {
+		util.Warnf("%s\n", err.Error())
+		parseFailures.With("bgp").Inc()
+		reason := "other"
+		if werr, ok := err.(*bgp.WireError); ok {
+			reason = werr.Reason
+		}
+		malformedPackets.With(reason).Inc()
+		return err
 	}
+	if version == 0 {
+		bgpPackets.With("legacy").Inc()
+	} else {
+		bgpPackets.With("v" + strconv.Itoa(version)).Inc()
+	}
+	return nil
 }
 
-func RunBgpReceiver(uq *util.GCsqueue[bgp.BgpInfo]) {
-	socket_file := "/tmp/c2gsocket"
-	socket_name := "unixgram"
-	addr, err := net.ResolveUnixAddr(socket_name, socket_file)
-	util.CheckError(err)
-	syscall.Unlink(socket_file)
-
-	listener, err := net.ListenUnixgram(socket_name, addr)
-	util.CheckError((err))
-	defer listener.Close()
-
-	buf := make([]byte, buf_len)
+// Read consecutive packets, as written by BIRD, and call fn on each route
+// update of them. Returns the number of packets passed to fn.
+func ReadPackets(r io.Reader, fn func(bgp.BgpInfo)) (int, error) {
+	n := 0
+	br := bufio.NewReader(r)
 	bgpinfo := new(bgp.BgpInfo)
 	for {
-		size, _, err := listener.ReadFromUnix(buf)
-		util.CheckError(err)
-		content := buf[:size]
-		Packet2info(content, bgpinfo)
-		// fmt.Printf("test result : %#v\n", bgpinfo)
-		uq.CsPush(*bgpinfo, bgpinfo.Btime)
+		msg, err := bgp.ReadMessage(br)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("packet %d: %w", n, err)
+		}
+		if err := Packet2info(msg, bgpinfo); err != nil {
+			return n, fmt.Errorf("packet %d: %w", n, err)
+		}
+		if bgp.MessageType(msg) != bgp.MsgRouteUpdate {
+			continue
+		}
+		fn(*bgpinfo)
+		n++
 	}
 }
 
 // FR Implement
 
-func RequestLoki(utime int64, url string) {
+// Loki servers with a request running
+var lokiRunning sync.Map
+
+// Run RequestLoki in the background unless the previous request to the same
+// server is still running, e.g. with its flows waiting on a full flow queue
+// of the block policy. Returns whether it was started; the caller asks for
+// the flows of a request not started with the next one, so that waiting
+// requests do not pile up.
+func StartLoki(utime int64, source string, url string) bool {
+	if _, running := lokiRunning.LoadOrStore(source, true); running {
+		lokiDeferred.With(source).Inc()
+		return false
+	}
+	go func() {
+		defer lokiRunning.Delete(source)
+		RequestLoki(utime, source, url)
+	}()
+	return true
+}
+
+// source is the Loki server the url points to
+func RequestLoki(utime int64, source string, url string) {
+	start := time.Now()
 	resp, err := http.Get(url)
-	util.PanicError(err, "Request Loki error")
+	if util.CheckError(err) {
+		lokiErrors.With(source).Inc()
+		return
+	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
-	util.PanicError(err, "Read Loki Packet error")
+	lokiLatency.Observe(time.Since(start).Seconds())
+	if util.CheckError(err) {
+		lokiErrors.With(source).Inc()
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		util.Warnf("Error Loki %s answered %s\n", source, resp.Status)
+		lokiErrors.With(source).Inc()
+		return
+	}
 
-	data := *dataPreprocess(body)
-	Json2Flow(data)
+	n, err := DecodeLoki(body, AddFlow2Q)
+	if util.CheckError(err) {
+		parseFailures.With("loki").Inc()
+	}
+	flowsIngested.With(source).Add(uint64(n))
 
-	fmt.Printf("After RequestLoki, FlowQueue's length is %d\n", Flow_queue.GetLength())
+	util.Debugf("After RequestLoki, FlowQueue's length is %d\n", Flow_queue.GetLength())
 }
 
 /*
@@ -137,15 +164,33 @@ func dataPreprocess(bytes []byte) *[]byte {
 	return &newbyte
 }
 
-func Json2Flow(data []byte) {
-	jsonparser.ArrayEach(data, ParseEachElement, shared_path...)
+// Parse a raw Loki response and call fn on every flow of it. Returns the
+// number of flows passed to fn.
+func DecodeLoki(body []byte, fn func(bgp.Flow)) (int, error) {
+	return json2Flow(*dataPreprocess(body), fn)
 }
 
-func ParseEachElement(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+func json2Flow(data []byte, fn func(bgp.Flow)) (int, error) {
+	n := 0
+	_, err := jsonparser.ArrayEach(data, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		if flow, ok := parseFlow(value, err); ok {
+			fn(flow)
+			n++
+		}
+	}, shared_path...)
+	return n, err
+}
+
+func parseFlow(value []byte, err error) (bgp.Flow, bool) {
 	var flow_entry bgp.Flow
 	var tv int64
+	failed := err != nil
 	jsonparser.EachKey(value,
 		func(idx int, value []byte, vt jsonparser.ValueType, err error) {
+			if err != nil {
+				failed = true
+				return
+			}
 			switch idx {
 			case 0:
 				tv, _ = jsonparser.ParseInt(value)
@@ -181,5 +226,9 @@ func ParseEachElement(value []byte, dataType jsonparser.ValueType, offset int, e
 			}
 		}, paths...)
 
-	AddFlow2Q(flow_entry)
+	if failed {
+		parseFailures.With("flow").Inc()
+		return flow_entry, false
+	}
+	return flow_entry, true
 }
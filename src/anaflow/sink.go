@@ -0,0 +1,71 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+)
+
+// Consumer of the scope results. OnUpdate runs on the analysis goroutine for
+// every handled update of every window, OnEvent for every closed routing
+// event, so neither must block.
+type Sink interface {
+	OnUpdate(bu *bgp.BgpInfo, sum *bgp.UpdateSummary, details []bgp.IpLogInfo)
+	OnEvent(ev *bgp.EventSummary)
+	Flush() error
+	Close() error
+}
+
+// Registered with AddSink, under State_mu. File_writer is always written.
+var Sinks []Sink
+
+func emitUpdate(bu *bgp.BgpInfo, sum *bgp.UpdateSummary, details []bgp.IpLogInfo) {
+	for _, s := range Sinks {
+		s.OnUpdate(bu, sum, details)
+	}
+}
+
+func emitEvent(ev *bgp.EventSummary) {
+	for _, s := range Sinks {
+		s.OnEvent(ev)
+	}
+}
+
+// Flush File_writer and every sink, returning the first error. A sink is not
+// removed, and so not closed, while it flushes.
+func FlushOutput() error {
+	State_mu.RLock()
+	defer State_mu.RUnlock()
+
+	err := File_writer.Flush()
+	for _, s := range Sinks {
+		if e := s.Flush(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func CloseSinks() {
+	for _, s := range Sinks {
+		util.CheckError(s.Close())
+	}
+}
+
+// Register s while the analysis is running
+func AddSink(s Sink) {
+	State_mu.Lock()
+	defer State_mu.Unlock()
+	Sinks = append(Sinks, s)
+}
+
+// Unregister s, which the caller closes
+func RemoveSink(s Sink) {
+	State_mu.Lock()
+	defer State_mu.Unlock()
+	for i, v := range Sinks {
+		if v == s {
+			Sinks = append(Sinks[:i:i], Sinks[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"math"
+)
+
+/*
+Approximate flow state, for more destinations than the maps can hold.
+
+In the exact mode every window counts the bytes of every destination on every
+route prefix, so a DDoS or a scan grows the maps with each new address. In the
+approximate mode each side of a window, pri and post, keeps instead:
+
+	a count-min sketch of the bytes per route prefix and destination
+	the exact bytes of every route prefix
+	the heavy hitters of every route prefix, the destinations with the most
+	bytes, up to Sketch_heavy of them
+
+Sketch_memory bounds both: three quarters for the two sketches, a quarter for
+the heavy hitters of both sides. Once the heavy hitters use up their share, a
+route prefix only replaces its own. The totals per route prefix come on top,
+as many as the routes with traffic. The updates see the heavy hitters as the
+destinations of a route; the bytes of the other destinations only count in
+the totals of the summary.
+
+An estimate never undercounts. It overcounts by at most Error_bound, e/width
+times the bytes in the sketch, with probability Confidence, 1 - e^-depth.
+*/
+
+// Approximate mode, 0 for the exact mode
+var Sketch_memory int64 // bytes per window
+var Sketch_depth = 4
+var Sketch_heavy = 16 // heavy hitters per route prefix
+
+// rough size of a heavy hitter, counted in its map and in the dst index
+const heavyHitterBytes = 64
+
+var sketchSeeds = [...]uint64{
+	0x9e3779b97f4a7c15, 0xbf58476d1ce4e5b9, 0x94d049bb133111eb, 0xd6e8feb86659fd93,
+	0xa0761d6478bd642f, 0xe7037ed1a0b428db, 0x8ebc6af09c88c6e3, 0x589965cc75374cc3,
+}
+
+type sketchRoute struct {
+	total uint64
+	heavy map[uint32]uint64 // dst -> estimated bytes when last counted
+}
+
+// One side of a window in the approximate mode
+type flowSketch struct {
+	width  int
+	depth  int
+	counts []uint64 // depth rows of width counters
+	bytes  uint64   // bytes in the sketch
+
+	routes      map[uint64]*sketchRoute
+	dsts        map[uint32][]uint64 // dst -> route prefixes it is a heavy hitter of
+	entries     int
+	max_entries int
+}
+
+// Counters per row, rows and heavy hitters of a side, 0 in the exact mode
+func sketchSize() (int, int, int) {
+	if Sketch_memory <= 0 {
+		return 0, 0, 0
+	}
+	width := int(Sketch_memory * 3 / 4 / 2 / int64(Sketch_depth) / 8)
+	return width, Sketch_depth, int(Sketch_memory / 4 / 2 / heavyHitterBytes)
+}
+
+// The sides of a window, nil in the exact mode
+func newFlowSketches() (*flowSketch, *flowSketch) {
+	width, depth, max_entries := sketchSize()
+	if width == 0 {
+		return nil, nil
+	}
+	return newFlowSketch(width, depth, max_entries), newFlowSketch(width, depth, max_entries)
+}
+
+func newFlowSketch(width int, depth int, max_entries int) *flowSketch {
+	return &flowSketch{
+		width:       width,
+		depth:       depth,
+		counts:      make([]uint64, width*depth),
+		routes:      make(map[uint64]*sketchRoute),
+		dsts:        make(map[uint32][]uint64),
+		max_entries: max_entries,
+	}
+}
+
+func sketchHash(seed uint64, rp uint64, dst uint32) uint64 {
+	// splitmix64 finalizer
+	x := seed ^ rp*0xff51afd7ed558ccd ^ uint64(dst)
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+func (s *flowSketch) cell(row int, rp uint64, dst uint32) *uint64 {
+	return &s.counts[row*s.width+int(sketchHash(sketchSeeds[row], rp, dst)%uint64(s.width))]
+}
+
+// Bytes of dst on rp, never less than the true count
+func (s *flowSketch) estimate(rp uint64, dst uint32) uint64 {
+	r, ok := s.routes[rp]
+	if !ok {
+		return 0
+	}
+	est := r.total
+	for row := 0; row < s.depth; row++ {
+		if c := *s.cell(row, rp, dst); c < est {
+			est = c
+		}
+	}
+	return est
+}
+
+func (s *flowSketch) errorBound() uint64 {
+	return uint64(math.E / float64(s.width) * float64(s.bytes))
+}
+
+func (s *flowSketch) confidence() float64 {
+	return 1 - math.Exp(-float64(s.depth))
+}
+
+// Count the bytes of a flow. Returns the destination that stopped being a
+// heavy hitter to make room for dst, if any.
+func (s *flowSketch) add(rp uint64, dst uint32, size uint64) (evicted uint32, ok bool) {
+	for row := 0; row < s.depth; row++ {
+		*s.cell(row, rp, dst) += size
+	}
+	s.bytes += size
+	r, found := s.routes[rp]
+	if !found {
+		r = &sketchRoute{heavy: make(map[uint32]uint64)}
+		s.routes[rp] = r
+	}
+	r.total += size
+
+	est := s.estimate(rp, dst)
+	if _, tracked := r.heavy[dst]; tracked {
+		r.heavy[dst] = est
+		return 0, false
+	}
+	if len(r.heavy) < Sketch_heavy && s.entries < s.max_entries {
+		s.track(rp, r, dst, est)
+		return 0, false
+	}
+
+	// replace the smallest heavy hitter of the route
+	var min_dst uint32
+	min_est := uint64(math.MaxUint64)
+	for d, e := range r.heavy {
+		if e < min_est {
+			min_dst, min_est = d, e
+		}
+	}
+	if len(r.heavy) == 0 || est <= min_est {
+		return 0, false
+	}
+	s.untrack(rp, r, min_dst)
+	s.track(rp, r, dst, est)
+	return min_dst, true
+}
+
+// Uncount the bytes of a flow added before
+func (s *flowSketch) sub(rp uint64, dst uint32, size uint64) {
+	for row := 0; row < s.depth; row++ {
+		c := s.cell(row, rp, dst)
+		if *c < size {
+			*c = 0
+		} else {
+			*c -= size
+		}
+	}
+	if s.bytes < size {
+		s.bytes = 0
+	} else {
+		s.bytes -= size
+	}
+	r, found := s.routes[rp]
+	if !found {
+		return
+	}
+	if r.total <= size {
+		for d := range r.heavy {
+			s.untrack(rp, r, d)
+		}
+		delete(s.routes, rp)
+		return
+	}
+	r.total -= size
+	if _, tracked := r.heavy[dst]; tracked {
+		if est := s.estimate(rp, dst); est > 0 {
+			r.heavy[dst] = est
+		} else {
+			s.untrack(rp, r, dst)
+		}
+	}
+}
+
+func (s *flowSketch) track(rp uint64, r *sketchRoute, dst uint32, est uint64) {
+	r.heavy[dst] = est
+	s.dsts[dst] = append(s.dsts[dst], rp)
+	s.entries++
+}
+
+func (s *flowSketch) untrack(rp uint64, r *sketchRoute, dst uint32) {
+	delete(r.heavy, dst)
+	s.entries--
+	routes := s.dsts[dst]
+	for i, p := range routes {
+		if p == rp {
+			routes = append(routes[:i], routes[i+1:]...)
+			break
+		}
+	}
+	if len(routes) == 0 {
+		delete(s.dsts, dst)
+	} else {
+		s.dsts[dst] = routes
+	}
+}
+
+// Heavy hitters of rp with their current estimates
+func (s *flowSketch) routeDsts(rp uint64) map[uint32]uint64 {
+	r, ok := s.routes[rp]
+	if !ok {
+		return nil
+	}
+	m := make(map[uint32]uint64, len(r.heavy))
+	for dst := range r.heavy {
+		m[dst] = s.estimate(rp, dst)
+	}
+	return m
+}
+
+// Route prefixes dst is a heavy hitter of, largest estimate last
+func (s *flowSketch) dstRoutes(dst uint32) []bgp.IpInfo {
+	var routes []bgp.IpInfo
+	for _, rp := range s.dsts[dst] {
+		info := bgp.IpInfo{RoutePrefix: rp, Size: s.estimate(rp, dst)}
+		routes = append(routes, info)
+		for i := len(routes) - 1; i > 0 && routes[i].Size < routes[i-1].Size; i-- {
+			routes[i], routes[i-1] = routes[i-1], routes[i]
+		}
+	}
+	return routes
+}
+
+func (s *flowSketch) routeBytes(rp uint64) uint64 {
+	if r, ok := s.routes[rp]; ok {
+		return r.total
+	}
+	return 0
+}
+
+/*
+Window accessors that read the maps in the exact mode and the sketches in the
+approximate mode.
+*/
+
+func (w *Window) approximate() bool {
+	return w.priSketch != nil
+}
+
+// Destinations of rp and their bytes
+func (w *Window) routeDsts(pri bool, rp uint64) map[uint32]uint64 {
+	switch {
+	case pri && w.priSketch != nil:
+		return w.priSketch.routeDsts(rp)
+	case pri:
+		return w.priRoute2Dst[rp]
+	case w.postSketch != nil:
+		return w.postSketch.routeDsts(rp)
+	}
+	return w.postRoute2Dst[rp]
+}
+
+// Routes of dst and their bytes, oldest first in the exact mode
+func (w *Window) dstRoutes(pri bool, dst uint32) []bgp.IpInfo {
+	switch {
+	case pri && w.priSketch != nil:
+		return w.priSketch.dstRoutes(dst)
+	case pri:
+		return w.priDst2Route[dst]
+	case w.postSketch != nil:
+		return w.postSketch.dstRoutes(dst)
+	}
+	return w.postDst2Route[dst]
+}
+
+// The route dst used last before the update: the latest one in the exact
+// mode, the one with the most bytes in the approximate mode
+func (w *Window) priRouteOf(dst uint32) (bgp.IpInfo, bool) {
+	routes := w.dstRoutes(true, dst)
+	if len(routes) == 0 {
+		return bgp.IpInfo{}, false
+	}
+	return routes[len(routes)-1], true
+}
+
+// The route dst used first after the update: the earliest one in the exact
+// mode, the one with the most bytes in the approximate mode
+func (w *Window) postRouteOf(dst uint32) (bgp.IpInfo, bool) {
+	routes := w.dstRoutes(false, dst)
+	if len(routes) == 0 {
+		return bgp.IpInfo{}, false
+	}
+	if w.approximate() {
+		return routes[len(routes)-1], true
+	}
+	return routes[0], true
+}
+
+// Bytes of every destination of rp
+func (w *Window) routeBytes(pri bool, rp uint64) uint64 {
+	switch {
+	case pri && w.priSketch != nil:
+		return w.priSketch.routeBytes(rp)
+	case !pri && w.postSketch != nil:
+		return w.postSketch.routeBytes(rp)
+	}
+	var n uint64
+	for _, v := range w.routeDsts(pri, rp) {
+		n += v
+	}
+	return n
+}
+
+// Error bound of the estimates of both sides
+func (w *Window) errorBound() uint64 {
+	if !w.approximate() {
+		return 0
+	}
+	pri, post := w.priSketch.errorBound(), w.postSketch.errorBound()
+	if post > pri {
+		return post
+	}
+	return pri
+}
+
+// The bytes of rp outside its heavy hitters, which the summary of an update
+// of rp counts as a whole
+func (w *Window) addUntracked(sum *bgp.UpdateSummary, pri bool, rp uint64, asn int32) {
+	if !w.approximate() {
+		return
+	}
+	rest := w.routeBytes(pri, rp)
+	for _, v := range w.routeDsts(pri, rp) {
+		if v >= rest {
+			rest = 0
+			break
+		}
+		rest -= v
+	}
+	if rest == 0 {
+		return
+	}
+	if pri {
+		sum.Away[asn] += rest
+		sum.PriFlow += rest
+	} else {
+		sum.Toward[asn] += rest
+		sum.PostFlow += rest
+	}
+	sum.Moved += rest
+}
+
+func (w *Window) setErrorBound(sum *bgp.UpdateSummary) {
+	if w.approximate() {
+		sum.Error_bound = w.errorBound()
+		sum.Confidence = w.priSketch.confidence()
+	}
+}
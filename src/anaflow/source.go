@@ -0,0 +1,356 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/metrics"
+	"anaflow/src/util"
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+BGP update sources.
+
+A source pushes every update it receives to the update queues, tagged in
+Source with the connection it came on. Datagram sockets are the historical
+BIRD transport. Stream sockets, unix or TCP with optional TLS, carry the same
+messages back to back, framed by their header, and accept any number of BIRD
+instances. The BGP speaker of speaker.go is a source too.
+
+A stream source can ask every sender for its table on connect, see
+Dump_request; the table loads into the RIB view of ribview.go.
+
+Backpressure is per sender: while Max_pending_updates updates of a connection
+wait in the primary queue, that connection stops reading, so its sender blocks
+instead of losing messages. The other connections go on.
+*/
+
+type UpdateSource interface {
+	Name() string
+	// Receive until done is closed. Returns early only if it cannot listen.
+	Run(done <-chan struct{}) error
+}
+
+// Updates of a connection waiting in the primary queue before it stops reading, 0 for no limit
+var Max_pending_updates int
+
+// largest framed message
+const buf_len = bgp.HeaderLen + 0xffff + bgp.ChecksumLen
+
+var (
+	updatesReceived = metrics.Default.NewCounterVec("anaflow_updates_received_total",
+		"Updates received, per source.", "source")
+	sourceBlocked = metrics.Default.NewCounterVec("anaflow_source_blocked_total",
+		"Times a source stopped reading because too many updates were pending.", "source")
+	sourceConnections int64
+)
+
+func init() {
+	metrics.Default.NewGaugeFunc("anaflow_source_connections", "Connected stream senders.",
+		nil, func(emit func(float64, ...string)) {
+			emit(float64(atomic.LoadInt64(&sourceConnections)))
+		})
+}
+
+// Updates of one source waiting in the primary queue
+type sourceBound struct {
+	name    string
+	mu      sync.Mutex
+	room    *sync.Cond // signalled as its updates leave the queue, or on done
+	pending int
+	closed  bool
+	stop    chan struct{}
+}
+
+var (
+	sourceBounds_mu sync.Mutex
+	sourceBounds    = make(map[string]*sourceBound)
+)
+
+// Track the updates the source name delivers until release. A source name is
+// open once at a time.
+func newSourceBound(name string, done <-chan struct{}) *sourceBound {
+	b := &sourceBound{name: name, stop: make(chan struct{})}
+	b.room = sync.NewCond(&b.mu)
+	sourceBounds_mu.Lock()
+	sourceBounds[name] = b
+	sourceBounds_mu.Unlock()
+	go func() {
+		select {
+		case <-done:
+		case <-b.stop:
+		}
+		b.mu.Lock()
+		b.closed = true
+		b.room.Broadcast()
+		b.mu.Unlock()
+	}()
+	return b
+}
+
+func (b *sourceBound) release() {
+	sourceBounds_mu.Lock()
+	if sourceBounds[b.name] == b {
+		delete(sourceBounds, b.name)
+	}
+	sourceBounds_mu.Unlock()
+	close(b.stop)
+}
+
+// Wait until fewer than Max_pending_updates updates of the source are
+// pending. Returns false if done was closed meanwhile.
+func (b *sourceBound) wait() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	blocked := false
+	for !b.closed && Max_pending_updates > 0 && b.pending >= Max_pending_updates {
+		if !blocked {
+			sourceBlocked.With(b.name).Inc()
+			blocked = true
+		}
+		b.room.Wait()
+	}
+	return !b.closed
+}
+
+// Count of the primary update queue, with the queue locked
+func countPending(bu bgp.BgpInfo, delta int) {
+	sourceBounds_mu.Lock()
+	b := sourceBounds[bu.Source]
+	sourceBounds_mu.Unlock()
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if b.pending += delta; b.pending < 0 {
+		// queued before the source opened
+		b.pending = 0
+	}
+	if delta < 0 {
+		b.room.Signal()
+	}
+	b.mu.Unlock()
+}
+
+// Hand a received message to the analysis
+func receive(msg []byte, source string) {
+	var bu bgp.BgpInfo
+	if Packet2info(msg, &bu) != nil {
+		return
+	}
+	if typ := bgp.MessageType(msg); typ != bgp.MsgRouteUpdate {
+		util.Warnf("Source %s: message type %d outside a table dump\n", source, typ)
+		return
+	}
+	deliver(bu, source)
+}
+
+func deliver(bu bgp.BgpInfo, source string) {
+	bu.Source = source
+	updatesReceived.With(source).Inc()
+	AddUpdate2Q(bu)
+}
+
+// One message per datagram on a unixgram socket
+type DatagramSource struct {
+	Path string
+}
+
+func (s *DatagramSource) Name() string {
+	return "unixgram:" + s.Path
+}
+
+func (s *DatagramSource) Run(done <-chan struct{}) error {
+	socket_name := "unixgram"
+	addr, err := net.ResolveUnixAddr(socket_name, s.Path)
+	if err != nil {
+		return err
+	}
+	syscall.Unlink(s.Path)
+
+	listener, err := net.ListenUnixgram(socket_name, addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go func() {
+		<-done
+		listener.Close()
+	}()
+
+	name := s.Name()
+	bound := newSourceBound(name, done)
+	defer bound.release()
+	buf := make([]byte, buf_len)
+	for bound.wait() {
+		size, _, err := listener.ReadFromUnix(buf)
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		if util.CheckError(err) {
+			continue
+		}
+		receive(buf[:size], name)
+	}
+	return nil
+}
+
+// Messages back to back on unix or TCP stream connections
+type StreamSource struct {
+	Network string      // "unix" or "tcp"
+	Addr    string      // socket path or host:port
+	TLS     *tls.Config // TCP only, nil for plain TCP
+
+	Dump_request bool // ask every sender for its table on connect
+}
+
+func (s *StreamSource) Name() string {
+	return s.Network + ":" + s.Addr
+}
+
+func (s *StreamSource) Run(done <-chan struct{}) error {
+	if s.Network == "unix" {
+		syscall.Unlink(s.Addr)
+	}
+	listener, err := net.Listen(s.Network, s.Addr)
+	if err != nil {
+		return err
+	}
+	if s.TLS != nil {
+		listener = tls.NewListener(listener, s.TLS)
+	}
+	return acceptLoop(listener, done, s.serve)
+}
+
+// Serve every connection of listener in its own goroutine until done is
+// closed, which also closes the connections. seq numbers the connections.
+func acceptLoop(listener net.Listener, done <-chan struct{}, serve func(c net.Conn, seq int, done <-chan struct{})) error {
+	var mu sync.Mutex
+	conns := make(map[net.Conn]bool)
+	go func() {
+		<-done
+		listener.Close()
+		mu.Lock()
+		for c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for seq := 1; ; seq++ {
+		c, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		mu.Lock()
+		conns[c] = true
+		mu.Unlock()
+		wg.Add(1)
+		go func(c net.Conn, seq int) {
+			defer wg.Done()
+			serve(c, seq, done)
+			mu.Lock()
+			delete(conns, c)
+			mu.Unlock()
+		}(c, seq)
+	}
+}
+
+// Identity of the sender: the subject of its client certificate with the
+// connection number, else its address and port, else the connection number for
+// unix sockets.
+func (s *StreamSource) identity(c net.Conn, seq int) (string, error) {
+	if tc, ok := c.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tc.Handshake(); err != nil {
+			return "", err
+		}
+		tc.SetDeadline(time.Time{})
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return fmt.Sprintf("tls:%s#%d", certs[0].Subject.CommonName, seq), nil
+		}
+	}
+	if s.Network == "tcp" {
+		return s.Network + ":" + c.RemoteAddr().String(), nil
+	}
+	return fmt.Sprintf("%s#%d", s.Name(), seq), nil
+}
+
+func (s *StreamSource) serve(c net.Conn, seq int, done <-chan struct{}) {
+	defer c.Close()
+	name, err := s.identity(c, seq)
+	if err != nil {
+		util.Warnf("Source %s: %s\n", s.Name(), err.Error())
+		return
+	}
+	atomic.AddInt64(&sourceConnections, 1)
+	defer atomic.AddInt64(&sourceConnections, -1)
+	util.Infof("Source %s connected\n", name)
+
+	if s.Dump_request {
+		c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := c.Write(bgp.MarshalDumpRequest()); err != nil {
+			util.Warnf("Source %s: dump request: %s\n", name, err.Error())
+		}
+	}
+
+	bound := newSourceBound(name, done)
+	defer bound.release()
+	var table *RibSync
+	r := bufio.NewReaderSize(c, buf_len)
+	for bound.wait() {
+		msg, err := bgp.ReadMessage(r)
+		if err == io.EOF {
+			util.Infof("Source %s disconnected\n", name)
+			return
+		}
+		if err != nil {
+			select {
+			case <-done:
+			default:
+				util.Warnf("Source %s: %s\n", name, err.Error())
+			}
+			return
+		}
+		switch bgp.MessageType(msg) {
+		case bgp.MsgTableEntry:
+			var bu bgp.BgpInfo
+			if Packet2info(msg, &bu) != nil {
+				continue
+			}
+			if table == nil {
+				table = NewRibSync(name)
+			}
+			table.add(ribKey{bu.Peer_addr, newRoutePrefix(&bu), 0}, newRouteOf(&bu))
+		case bgp.MsgDumpEnd:
+			if table == nil {
+				table = NewRibSync(name)
+			}
+			table.End()
+			table = nil
+		default:
+			receive(msg, name)
+		}
+	}
+}
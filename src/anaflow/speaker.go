@@ -0,0 +1,288 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/metrics"
+	"anaflow/src/util"
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Passive BGP speaker.
+
+Instead of BIRD, the routers themselves can send the updates: Anaflow accepts
+BGP sessions from the configured neighbors, never connects nor announces a
+route. The OPENs negotiate 4-byte ASNs and add-path reception for IPv4
+unicast. iBGP sessions, as from route reflectors, are neighbors with our own
+ASN; the reflector attributes are ignored.
+
+Every session keeps the routes of its peer in an Adj-RIB-In, see rib.go, keyed
+by prefix and path id. When the session goes down its routes are withdrawn.
+*/
+
+type Neighbor struct {
+	Addr uint32
+	Asn  uint32 // our own ASN for iBGP
+}
+
+type BgpSpeaker struct {
+	Listen    string // host:port
+	Asn       uint32
+	Router_id uint32
+	Hold_time uint16 // proposed, the session uses the smaller of both OPENs
+	Neighbors []Neighbor
+}
+
+// Waiting for the OPEN and the KEEPALIVE of the peer, RFC 4271 8.2.2
+const bgpOpenTimeout = 4 * time.Minute
+
+// LOCAL_PREF of eBGP routes, which do not carry it
+const bgpDefaultPref = 100
+
+var (
+	bgpNotifications = metrics.Default.NewCounterVec("anaflow_bgp_notifications_total",
+		"BGP NOTIFICATION messages, per direction and error code.", "direction", "code")
+
+	bgpSessionsMu sync.Mutex
+	bgpSessions   = make(map[uint32]*bgpSession) // by peer address
+)
+
+func init() {
+	metrics.Default.NewGaugeFunc("anaflow_bgp_adj_rib_in_routes", "Routes received on each BGP session.",
+		[]string{"peer"}, func(emit func(float64, ...string)) {
+			bgpSessionsMu.Lock()
+			defer bgpSessionsMu.Unlock()
+			for addr, s := range bgpSessions {
+				emit(float64(s.rib.len()), util.IPint2string(addr))
+			}
+		})
+}
+
+type bgpSession struct {
+	peer Neighbor
+	name string
+	conn net.Conn
+	wmu  sync.Mutex // writes of the keepalive goroutine and the session
+
+	hold     time.Duration
+	as4      bool
+	add_path bool
+
+	rib *adjRib
+}
+
+func (s *BgpSpeaker) Name() string {
+	return "bgp:" + s.Listen
+}
+
+func (s *BgpSpeaker) Run(done <-chan struct{}) error {
+	listener, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return err
+	}
+	return acceptLoop(listener, done, s.serve)
+}
+
+func (s *BgpSpeaker) neighbor(c net.Conn) (Neighbor, bool) {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		if ip := addr.IP.To4(); ip != nil {
+			a := util.IPbyte2int([]byte(ip.String()))
+			for _, n := range s.Neighbors {
+				if n.Addr == a {
+					return n, true
+				}
+			}
+		}
+	}
+	return Neighbor{}, false
+}
+
+func (s *BgpSpeaker) serve(c net.Conn, seq int, done <-chan struct{}) {
+	defer c.Close()
+	peer, ok := s.neighbor(c)
+	if !ok {
+		util.Warnf("BGP: connection from %s, not a neighbor\n", c.RemoteAddr())
+		return
+	}
+	name := "bgp:" + util.IPint2string(peer.Addr)
+	sess := &bgpSession{peer: peer, name: name, conn: c, rib: newAdjRib(name)}
+
+	bgpSessionsMu.Lock()
+	_, dup := bgpSessions[peer.Addr]
+	if !dup {
+		bgpSessions[peer.Addr] = sess
+	}
+	bgpSessionsMu.Unlock()
+	if dup {
+		// connection rejected, the established session stays
+		sess.notify(&bgp.Notification{Code: bgp.ERR_CEASE, Subcode: 5})
+		return
+	}
+	defer func() {
+		bgpSessionsMu.Lock()
+		delete(bgpSessions, peer.Addr)
+		bgpSessionsMu.Unlock()
+	}()
+
+	err := sess.run(s, done)
+	select {
+	case <-done:
+		// stopping, the routes are still there
+		return
+	default:
+	}
+	var n *bgp.Notification
+	switch {
+	case errors.As(err, &n):
+		sess.notify(n)
+		util.Warnf("Session %s down: %s\n", sess.name, err.Error())
+	case err == io.EOF:
+		util.Warnf("Session %s down: connection closed\n", sess.name)
+	case err != nil:
+		util.Warnf("Session %s down: %s\n", sess.name, err.Error())
+	}
+	sess.rib.withdrawPeer(0, time.Now().Unix())
+}
+
+// Send a NOTIFICATION, the session ends anyway so errors are ignored
+func (sess *bgpSession) notify(n *bgp.Notification) {
+	bgpNotifications.With("sent", strconv.Itoa(int(n.Code))).Inc()
+	sess.write(bgp.MarshalNotification(n))
+}
+
+func (sess *bgpSession) write(msg []byte) error {
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	sess.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := sess.conn.Write(msg)
+	return err
+}
+
+// Read the next message, failing once the hold time passes without one
+func (sess *bgpSession) read(r io.Reader, timeout time.Duration) (uint8, []byte, error) {
+	if timeout > 0 {
+		sess.conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		sess.conn.SetReadDeadline(time.Time{})
+	}
+	typ, body, err := bgp.ReadBgp4(r)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return 0, nil, &bgp.Notification{Code: bgp.ERR_HOLD_TIMER}
+	}
+	if err == nil && typ == bgp.MSG_NOTIFICATION {
+		n := bgp.ParseNotification(body)
+		bgpNotifications.With("received", strconv.Itoa(int(n.Code))).Inc()
+		return 0, nil, errors.New("received " + n.Error())
+	}
+	return typ, body, err
+}
+
+// OPEN, KEEPALIVE, then UPDATEs until an error or done
+func (sess *bgpSession) run(s *BgpSpeaker, done <-chan struct{}) error {
+	r := bufio.NewReaderSize(sess.conn, bgp.Bgp4MaxLen)
+	open := &bgp.Open{Asn: s.Asn, Hold_time: s.Hold_time, Router_id: s.Router_id, As4: true, Add_path: true}
+	if err := sess.write(bgp.MarshalOpen(open)); err != nil {
+		return err
+	}
+
+	typ, body, err := sess.read(r, bgpOpenTimeout)
+	if err != nil {
+		return err
+	}
+	if typ != bgp.MSG_OPEN {
+		return &bgp.Notification{Code: bgp.ERR_FSM, Subcode: 1}
+	}
+	peer, err := bgp.ParseOpen(body)
+	if err != nil {
+		return err
+	}
+	if peer.Asn != sess.peer.Asn {
+		return &bgp.Notification{Code: bgp.ERR_OPEN, Subcode: 2}
+	}
+	if peer.Asn == s.Asn && peer.Router_id == s.Router_id {
+		return &bgp.Notification{Code: bgp.ERR_OPEN, Subcode: 3}
+	}
+	hold := s.Hold_time
+	if peer.Hold_time < hold {
+		hold = peer.Hold_time
+	}
+	sess.hold = time.Duration(hold) * time.Second
+	sess.as4 = peer.As4
+	sess.add_path = peer.Add_path
+	if err := sess.write(bgp.MarshalKeepalive()); err != nil {
+		return err
+	}
+
+	typ, _, err = sess.read(r, bgpOpenTimeout)
+	if err != nil {
+		return err
+	}
+	if typ != bgp.MSG_KEEPALIVE {
+		return &bgp.Notification{Code: bgp.ERR_FSM, Subcode: 2}
+	}
+	util.Infof("Session %s established, AS %d, hold time %d, 4-byte ASN %v, add-path %v\n",
+		sess.name, peer.Asn, hold, sess.as4, sess.add_path)
+
+	if sess.hold > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go sess.keepalive(stop)
+	}
+	bound := newSourceBound(sess.name, done)
+	defer bound.release()
+	for bound.wait() {
+		typ, body, err := sess.read(r, sess.hold)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case bgp.MSG_UPDATE:
+			u, err := bgp.ParseUpdate(body, sess.as4, sess.add_path)
+			if err != nil {
+				return err
+			}
+			sess.apply(u)
+		case bgp.MSG_OPEN:
+			return &bgp.Notification{Code: bgp.ERR_FSM, Subcode: 3}
+		}
+	}
+	return nil
+}
+
+func (sess *bgpSession) keepalive(stop <-chan struct{}) {
+	ticker := time.NewTicker(sess.hold / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if sess.write(bgp.MarshalKeepalive()) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Update the Adj-RIB-In, which queues a BgpInfo per route that changed
+func (sess *bgpSession) apply(u *bgp.Update) {
+	btime := time.Now().Unix()
+	for _, n := range u.Withdrawn {
+		sess.rib.withdraw(ribKey{sess.peer.Addr, uint64(n.Addr)<<8 + uint64(n.Prefix), n.Path_id}, btime)
+	}
+
+	pref := int32(bgpDefaultPref)
+	if u.Has_local_pref {
+		pref = int32(u.Local_pref)
+	}
+	route := newRibRoute(sess.peer.Addr, sess.peer.Asn, u.Nexthop, pref, u.Attrs)
+	for _, n := range u.Nlri {
+		sess.rib.announce(ribKey{sess.peer.Addr, uint64(n.Addr)<<8 + uint64(n.Prefix), n.Path_id}, route, btime)
+	}
+}
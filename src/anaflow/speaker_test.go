@@ -0,0 +1,305 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	testLocalAsn = 64500
+	testLoopback = 0x7f000001
+)
+
+// A BGP peer driving a session of the speaker over loopback
+type testPeer struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Start a speaker with one neighbor, 127.0.0.1 in AS peer_asn. stop closes it
+// and waits for its sessions to end.
+func startSpeaker(t *testing.T, peer_asn uint32) (addr string, stop func()) {
+	t.Helper()
+	SetupWindows(60, 0, nil)
+	drainUpdates()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &BgpSpeaker{Asn: testLocalAsn, Router_id: 1, Hold_time: 90,
+		Neighbors: []Neighbor{{Addr: testLoopback, Asn: peer_asn}}}
+	done := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- acceptLoop(listener, done, s.serve)
+	}()
+	return listener.Addr().String(), func() {
+		close(done)
+		if err := <-finished; err != nil {
+			t.Errorf("accept loop: %v", err)
+		}
+	}
+}
+
+func dialPeer(t *testing.T, addr string) *testPeer {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testPeer{t, c, bufio.NewReader(c)}
+}
+
+func (p *testPeer) send(msg []byte) {
+	p.t.Helper()
+	if _, err := p.conn.Write(msg); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *testPeer) expect(typ uint8) []byte {
+	p.t.Helper()
+	got, body, err := bgp.ReadBgp4(p.r)
+	if err != nil {
+		p.t.Fatalf("waiting for message type %d: %v", typ, err)
+	}
+	if got != typ {
+		p.t.Fatalf("message type %d, want %d", got, typ)
+	}
+	return body
+}
+
+// Read the NOTIFICATION the speaker ends the session with
+func (p *testPeer) expectNotification(code uint8, subcode uint8) {
+	p.t.Helper()
+	n := bgp.ParseNotification(p.expect(bgp.MSG_NOTIFICATION))
+	if n.Code != code || n.Subcode != subcode {
+		p.t.Fatalf("notification %d/%d, want %d/%d", n.Code, n.Subcode, code, subcode)
+	}
+	if _, _, err := bgp.ReadBgp4(p.r); err != io.EOF {
+		p.t.Fatalf("err %v after the notification, want io.EOF", err)
+	}
+}
+
+func bgp4(typ uint8, body []byte) []byte {
+	msg := make([]byte, bgp.Bgp4HeaderLen, bgp.Bgp4HeaderLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(bgp.Bgp4HeaderLen+len(body)))
+	msg[18] = typ
+	return append(msg, body...)
+}
+
+// OPEN of the peer. add_path announces that it sends path ids.
+func peerOpen(asn uint32, as4 bool, add_path bool) []byte {
+	caps := []byte{1, 4, 0, 1, 0, 1}
+	if as4 {
+		caps = append(caps, 65, 4, byte(asn>>24), byte(asn>>16), byte(asn>>8), byte(asn))
+	}
+	if add_path {
+		caps = append(caps, 69, 4, 0, 1, 1, 3)
+	}
+	if asn > 0xffff {
+		asn = bgp.AS_TRANS
+	}
+	body := []byte{4, byte(asn >> 8), byte(asn), 0, 90, 10, 0, 0, 2, byte(2 + len(caps)), 2, byte(len(caps))}
+	return bgp4(bgp.MSG_OPEN, append(body, caps...))
+}
+
+func attr(typ uint8, value ...byte) []byte {
+	return append([]byte{0x40, typ, byte(len(value))}, value...)
+}
+
+func asPath(asn_len int, asns ...uint32) []byte {
+	v := []byte{2, byte(len(asns))}
+	for _, asn := range asns {
+		if asn_len == 4 {
+			v = binary.BigEndian.AppendUint32(v, asn)
+		} else {
+			v = binary.BigEndian.AppendUint16(v, uint16(asn))
+		}
+	}
+	return v
+}
+
+func nlri(add_path bool, prefixes ...bgp.Nlri) []byte {
+	var b []byte
+	for _, n := range prefixes {
+		if add_path {
+			b = binary.BigEndian.AppendUint32(b, n.Path_id)
+		}
+		size := (int(n.Prefix) + 7) / 8
+		b = append(b, byte(n.Prefix))
+		b = append(b, binary.BigEndian.AppendUint32(nil, n.Addr)[:size]...)
+	}
+	return b
+}
+
+func peerUpdate(withdrawn []byte, attrs []byte, announced []byte) []byte {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(withdrawn)))
+	body = append(body, withdrawn...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+	return bgp4(bgp.MSG_UPDATE, append(body, announced...))
+}
+
+// OPEN and KEEPALIVE both ways. Returns the OPEN of the speaker.
+func (p *testPeer) establish(asn uint32, as4 bool, add_path bool) *bgp.Open {
+	p.t.Helper()
+	open, err := bgp.ParseOpen(p.expect(bgp.MSG_OPEN))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.send(peerOpen(asn, as4, add_path))
+	p.expect(bgp.MSG_KEEPALIVE)
+	p.send(bgp.MarshalKeepalive())
+	return open
+}
+
+func drainUpdates() {
+	for _, ok := Updata_queue.CsPop(); ok; _, ok = Updata_queue.CsPop() {
+	}
+}
+
+// Wait for n updates in the primary queue and pop them
+func popUpdates(t *testing.T, n int) []bgp.BgpInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for Updata_queue.GetLength() < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	var updates []bgp.BgpInfo
+	for bu, ok := Updata_queue.CsPop(); ok; bu, ok = Updata_queue.CsPop() {
+		updates = append(updates, bu)
+	}
+	if len(updates) != n {
+		t.Fatalf("%d updates queued, want %d", len(updates), n)
+	}
+	return updates
+}
+
+func TestSpeakerSessionAs4AddPath(t *testing.T) {
+	const peer_asn = 4200000001
+	addr, stop := startSpeaker(t, peer_asn)
+	defer stop()
+	p := dialPeer(t, addr)
+	defer p.conn.Close()
+
+	open := p.establish(peer_asn, true, true)
+	if !open.As4 || open.Asn != testLocalAsn || open.Hold_time != 90 || open.Router_id != 1 {
+		t.Fatalf("OPEN of the speaker %+v", open)
+	}
+
+	// two paths of 10.0.0.0/8, then path 1 withdrawn
+	path := attr(bgp.ATTR_AS_PATH, asPath(4, peer_asn, 64600)...)
+	attrs := append(append(attr(bgp.ATTR_ORIGIN, 0), path...), attr(bgp.ATTR_NEXT_HOP, 192, 0, 2, 1)...)
+	p.send(peerUpdate(nil, attrs, nlri(true, bgp.Nlri{Path_id: 1, Addr: 0x0a000000, Prefix: 8}, bgp.Nlri{Path_id: 2, Addr: 0x0a000000, Prefix: 8})))
+	p.send(bgp.MarshalKeepalive())
+	p.send(peerUpdate(nlri(true, bgp.Nlri{Path_id: 1, Addr: 0x0a000000, Prefix: 8}), nil, nil))
+
+	first_asn := uint32(peer_asn)
+	updates := popUpdates(t, 3)
+	for i, bu := range updates[:2] {
+		if bu.Msg_type != bgp.BGP_ADD || bu.New_ip_addr != 0x0a000000 || bu.New_ip_prefix != 8 ||
+			bu.New_nexthop != 0xc0000201 || bu.New_first_asn != int32(first_asn) || bu.New_path_len != 2 ||
+			bu.Peer_addr != testLoopback || bu.Source != "bgp:127.0.0.1" {
+			t.Fatalf("update %d: %+v", i, bu)
+		}
+	}
+	if updates[0].Path_id+updates[1].Path_id != 3 {
+		t.Fatalf("path ids %d and %d, want 1 and 2", updates[0].Path_id, updates[1].Path_id)
+	}
+	if bu := updates[2]; bu.Msg_type != bgp.BGP_DELETE || bu.Path_id != 1 || bu.Old_nexthop != 0xc0000201 {
+		t.Fatalf("withdrawal %+v", bu)
+	}
+
+	// a NOTIFICATION ends the session, which withdraws path 2
+	p.send(bgp.MarshalNotification(&bgp.Notification{Code: bgp.ERR_CEASE, Subcode: 2}))
+	if _, _, err := bgp.ReadBgp4(p.r); err != io.EOF {
+		t.Fatalf("err %v after the notification, want io.EOF", err)
+	}
+	if bu := popUpdates(t, 1)[0]; bu.Msg_type != bgp.BGP_DELETE || bu.Path_id != 2 {
+		t.Fatalf("withdrawal at session end %+v", bu)
+	}
+}
+
+func TestSpeakerSessionTwoByteAsn(t *testing.T) {
+	addr, stop := startSpeaker(t, 64512)
+	defer stop()
+	p := dialPeer(t, addr)
+	defer p.conn.Close()
+	p.establish(64512, false, false)
+
+	// AS_TRANS in AS_PATH, the 4-byte ASN in AS4_PATH
+	path := attr(bgp.ATTR_AS_PATH, asPath(2, 64512, bgp.AS_TRANS)...)
+	path4 := append([]byte{0xc0}, attr(bgp.ATTR_AS4_PATH, asPath(4, 4200000002)...)[1:]...)
+	attrs := append(append(append(attr(bgp.ATTR_ORIGIN, 2), path...), path4...), attr(bgp.ATTR_NEXT_HOP, 192, 0, 2, 9)...)
+	attrs = append(attrs, attr(bgp.ATTR_LOCAL_PREF, 0, 0, 0, 150)...)
+	p.send(peerUpdate(nil, attrs, nlri(false, bgp.Nlri{Addr: 0xc6336400, Prefix: 24})))
+
+	bu := popUpdates(t, 1)[0]
+	if bu.Msg_type != bgp.BGP_ADD || bu.New_ip_addr != 0xc6336400 || bu.New_ip_prefix != 24 || bu.New_pref != 150 {
+		t.Fatalf("update %+v", bu)
+	}
+	if got := bu.New_attrs.As_path; len(got) != 2 || got[0] != 64512 || got[1] != 4200000002 {
+		t.Fatalf("AS path %v, want [64512 4200000002]", got)
+	}
+
+	// an UPDATE without NEXT_HOP is an error, the session ends and withdraws the route
+	p.send(peerUpdate(nil, append(attr(bgp.ATTR_ORIGIN, 0), path...), nlri(false, bgp.Nlri{Addr: 0x0a000000, Prefix: 8})))
+	p.expectNotification(bgp.ERR_UPDATE, 3)
+	if bu := popUpdates(t, 1)[0]; bu.Msg_type != bgp.BGP_DELETE || bu.Old_ip_addr != 0xc6336400 {
+		t.Fatalf("withdrawal at session end %+v", bu)
+	}
+}
+
+func TestSpeakerRejectsBadSessions(t *testing.T) {
+	addr, stop := startSpeaker(t, 64512)
+	defer stop()
+
+	// wrong peer ASN
+	p := dialPeer(t, addr)
+	p.expect(bgp.MSG_OPEN)
+	p.send(peerOpen(64513, true, false))
+	p.expectNotification(bgp.ERR_OPEN, 2)
+	p.conn.Close()
+
+	// UPDATE before the session is established
+	p = dialPeer(t, addr)
+	p.expect(bgp.MSG_OPEN)
+	p.send(peerUpdate(nil, nil, nil))
+	p.expectNotification(bgp.ERR_FSM, 1)
+	p.conn.Close()
+
+	// bad marker
+	p = dialPeer(t, addr)
+	p.expect(bgp.MSG_OPEN)
+	bad := peerOpen(64512, true, false)
+	bad[0] = 0
+	p.send(bad)
+	p.expectNotification(bgp.ERR_HEADER, 1)
+	p.conn.Close()
+
+	// truncated OPEN, then the connection closed
+	p = dialPeer(t, addr)
+	p.expect(bgp.MSG_OPEN)
+	p.send(peerOpen(64512, true, false)[:25])
+	p.conn.(*net.TCPConn).CloseWrite()
+	if _, _, err := bgp.ReadBgp4(p.r); err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("err %v after a truncated OPEN, want io.EOF", err)
+	}
+	p.conn.Close()
+	if n := Updata_queue.GetLength(); n != 0 {
+		t.Fatalf("%d updates queued by rejected sessions", n)
+	}
+}
@@ -0,0 +1,162 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"fmt"
+	"sort"
+)
+
+/*
+Rolling Top-N over the scope results.
+
+Results are kept in one-minute buckets of analysis time, and a window of any
+length up to the largest one in Topn_windows is answered by merging its buckets.
+Three rankings are tracked: the updates that moved most bytes, the destination
+/24 prefixes that were hit hardest and the routes updated most often.
+*/
+
+// Number of entries per ranking. Set by main.
+var Topn_n int = 10
+
+// Windows (seconds) reported every Topn_report seconds
+var Topn_windows = []int64{300, 3600, 86400}
+var Topn_report int64 = 300
+
+const topBucketLen = 60
+
+type TopEntry struct {
+	Key   uint64 `json:"key"`
+	Value uint64 `json:"value"`
+}
+
+type TopUpdate struct {
+	Btime    int64  `json:"btime"`
+	Msg_type int32  `json:"msg_type"`
+	Route    uint64 `json:"route"`
+	Moved    uint64 `json:"moved"`
+	DstCount int    `json:"dst_count"`
+}
+
+type TopReport struct {
+	Window      int64       `json:"window"`
+	End         int64       `json:"end"`
+	Updates     []TopUpdate `json:"updates"`
+	DstPrefixes []TopEntry  `json:"dst_prefixes"`
+	Routes      []TopEntry  `json:"routes"`
+}
+
+type topBucket struct {
+	updates     []TopUpdate // only the Topn_n biggest of the minute
+	dstPrefixes map[uint64]uint64
+	routes      map[uint64]uint64
+}
+
+var topBuckets map[int64]*topBucket
+var topNow int64
+var topLastReport int64
+
+func init() {
+	topBuckets = make(map[int64]*topBucket)
+}
+
+func addUpdate2Top(sum *bgp.UpdateSummary, details []bgp.IpLogInfo) {
+	start := sum.Btime / topBucketLen * topBucketLen
+	b, ok := topBuckets[start]
+	if !ok {
+		b = &topBucket{
+			dstPrefixes: make(map[uint64]uint64),
+			routes:      make(map[uint64]uint64),
+		}
+		topBuckets[start] = b
+	}
+
+	b.updates = append(b.updates, TopUpdate{sum.Btime, sum.Msg_type, sum.Route, sum.Moved, sum.DstCount})
+	sortTopUpdates(b.updates)
+	if len(b.updates) > Topn_n {
+		b.updates = b.updates[:Topn_n]
+	}
+
+	b.routes[sum.Route]++
+	for _, d := range details {
+		// dst /24 in the same uint32 IP + uint8 Prefix layout as routes
+		p := uint64(d.DstIp)>>8<<16 + 24
+		if d.PostFlow > d.PriFlow {
+			b.dstPrefixes[p] += d.PostFlow
+		} else {
+			b.dstPrefixes[p] += d.PriFlow
+		}
+	}
+}
+
+func sortTopUpdates(u []TopUpdate) {
+	sort.Slice(u, func(i, j int) bool { return u[i].Moved > u[j].Moved })
+}
+
+func topEntries(m map[uint64]uint64) []TopEntry {
+	entries := make([]TopEntry, 0, len(m))
+	for k, v := range m {
+		entries = append(entries, TopEntry{k, v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Value != entries[j].Value {
+			return entries[i].Value > entries[j].Value
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > Topn_n {
+		entries = entries[:Topn_n]
+	}
+	return entries
+}
+
+// Rankings over the last window seconds of analysis time
+func TopN(window int64) TopReport {
+	report := TopReport{Window: window, End: topNow, Updates: []TopUpdate{}}
+	prefixes := make(map[uint64]uint64)
+	routes := make(map[uint64]uint64)
+	for start, b := range topBuckets {
+		if start+topBucketLen <= topNow-window {
+			continue
+		}
+		report.Updates = append(report.Updates, b.updates...)
+		for k, v := range b.dstPrefixes {
+			prefixes[k] += v
+		}
+		for k, v := range b.routes {
+			routes[k] += v
+		}
+	}
+	sortTopUpdates(report.Updates)
+	if len(report.Updates) > Topn_n {
+		report.Updates = report.Updates[:Topn_n]
+	}
+	report.DstPrefixes = topEntries(prefixes)
+	report.Routes = topEntries(routes)
+	return report
+}
+
+// Advance the Top-N clock, drop expired buckets and write the periodic report
+func checkTopN(btime int64) {
+	topNow = btime
+	var max_window int64
+	for _, w := range Topn_windows {
+		if w > max_window {
+			max_window = w
+		}
+	}
+	for start := range topBuckets {
+		if start+topBucketLen <= topNow-max_window {
+			delete(topBuckets, start)
+		}
+	}
+
+	if Topn_report <= 0 || topNow-topLastReport < Topn_report {
+		return
+	}
+	topLastReport = topNow
+	for _, w := range Topn_windows {
+		r := TopN(w)
+		File_writer.WriteString(fmt.Sprintf("TOPN: window=%d end=%d updates=%+v dst_prefixes=%+v routes=%+v\n",
+			r.Window, r.End, r.Updates, r.DstPrefixes, r.Routes))
+	}
+}
@@ -0,0 +1,103 @@
+package anaflow
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+	"strconv"
+)
+
+/*
+Observation windows.
+
+The same update can be analysed with several agetimes at once: short windows
+catch fast shifts, long ones give stable volume estimates. Overrides restrict
+the windows applied to the updates of a prefix or of a peer (next hop).
+*/
+
+type WindowOverride struct {
+	Route   uint64  // uint32 IP + uint8 Prefix, 0 if the override is per peer
+	Nexthop uint32  // peer next hop, 0 if the override is per prefix
+	Windows []int64 // agetimes applied to the matching updates
+}
+
+// Checked in order, the first match wins
+var Window_overrides []WindowOverride
+
+// Build Windows over a new flow queue. The primary window uses agetime and
+// the global update queue, every extra agetime gets a window of its own.
+func SetupWindows(agetime int64, syncdevi int64, extra []int64) {
+	Flow_queue = util.NewFlowCsqueue()
+	Windows = []*Window{NewWindow(agetime, syncdevi, Flow_queue, Updata_queue)}
+	for _, a := range extra {
+		if a == agetime {
+			continue
+		}
+		Windows = append(Windows, NewWindow(a, syncdevi, Flow_queue, util.NewGCsqueue[bgp.BgpInfo]()))
+	}
+}
+
+// Bound the flow queue and the update queue of every window. The bounds are
+// copied for each queue, with its shed and blocked counters set: window "all"
+// for the shared flow queue.
+func BoundQueues(flows util.Bound, updates util.Bound) {
+	Flow_queue.SetBound(queueBound(flows, "all", "flow"))
+	for _, w := range Windows {
+		window := strconv.FormatInt(w.Agetime, 10)
+		w.Updata_queue.SetBound(queueBound(updates, window, "update"))
+	}
+}
+
+// Close the flow queue and the update queues, so that no source blocks on
+// them any more
+func CloseQueues() {
+	Flow_queue.Close()
+	for _, w := range Windows {
+		w.Updata_queue.Close()
+	}
+}
+
+func queueBound(b util.Bound, window string, queue string) util.Bound {
+	b.Shed = queueShed.With(window, queue).Inc
+	b.Blocked = queueBlocked.With(window, queue).Inc
+	return b
+}
+
+// Whether route a is equal to or more specific than route b
+func routeCovers(b uint64, a uint64) bool {
+	pb := b & 0xff
+	pa := a & 0xff
+	if pa < pb {
+		return false
+	}
+	return a>>8>>(32-pb) == b>>8>>(32-pb)
+}
+
+func (o *WindowOverride) matches(bu *bgp.BgpInfo) bool {
+	if o.Nexthop != 0 && (o.Nexthop == bu.New_nexthop || o.Nexthop == bu.Old_nexthop) {
+		return true
+	}
+	if o.Route != 0 {
+		if bu.Msg_type == bgp.BGP_DELETE {
+			return routeCovers(o.Route, oldRoutePrefix(bu))
+		}
+		return routeCovers(o.Route, newRoutePrefix(bu))
+	}
+	return false
+}
+
+// Whether the update is analysed by this window
+func (w *Window) analyses(bu *bgp.BgpInfo) bool {
+	for i := range Window_overrides {
+		o := &Window_overrides[i]
+		if !o.matches(bu) {
+			continue
+		}
+		for _, a := range o.Windows {
+			if a == w.Agetime {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package bgp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Path attributes of a route, as far as they explain a routing decision
+type RouteAttrs struct {
+	As_path           []uint32 // flattened, AS_SETs included in order
+	Communities       []Community
+	Large_communities []LargeCommunity
+	Med               uint32
+	Origin            Origin
+	Rpki              Rpki // validation state of the origin AS
+}
+
+const (
+	ORIGIN_IGP Origin = iota
+	ORIGIN_EGP
+	ORIGIN_INCOMPLETE
+)
+
+const (
+	RPKI_UNKNOWN Rpki = iota // not validated
+	RPKI_VALID
+	RPKI_INVALID
+	RPKI_NOT_FOUND
+)
+
+type Origin uint8
+type Rpki uint8
+
+var originNames = []string{"igp", "egp", "incomplete"}
+var rpkiNames = []string{"unknown", "valid", "invalid", "not_found"}
+var classNames = []string{"unknown", "new", "implicit_withdraw", "replacement", "withdraw"}
+
+func enumString(names []string, v uint8) string {
+	if int(v) < len(names) {
+		return names[v]
+	}
+	return strconv.Itoa(int(v))
+}
+
+func enumParse(names []string, s string) (uint8, error) {
+	for i, n := range names {
+		if n == s {
+			return uint8(i), nil
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown value %q, want one of %v", s, names)
+	}
+	return uint8(v), nil
+}
+
+func (o Origin) String() string {
+	return enumString(originNames, uint8(o))
+}
+
+func (o Origin) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+func (o *Origin) UnmarshalText(b []byte) error {
+	v, err := enumParse(originNames, string(b))
+	*o = Origin(v)
+	return err
+}
+
+func (r Rpki) String() string {
+	return enumString(rpkiNames, uint8(r))
+}
+
+func (r Rpki) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Rpki) UnmarshalText(b []byte) error {
+	v, err := enumParse(rpkiNames, string(b))
+	*r = Rpki(v)
+	return err
+}
+
+func (c UpdateClass) String() string {
+	return enumString(classNames, uint8(c))
+}
+
+func (c UpdateClass) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *UpdateClass) UnmarshalText(b []byte) error {
+	v, err := enumParse(classNames, string(b))
+	*c = UpdateClass(v)
+	return err
+}
+
+// RFC 1997 community, ASN in the high 16 bits
+type Community uint32
+
+func (c Community) String() string {
+	return fmt.Sprintf("%d:%d", c>>16, c&0xffff)
+}
+
+func (c Community) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Community) UnmarshalText(b []byte) error {
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 2 {
+		return fmt.Errorf("community %q is not asn:value", b)
+	}
+	asn, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return err
+	}
+	value, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return err
+	}
+	*c = Community(asn<<16 | value)
+	return nil
+}
+
+// RFC 8092 large community
+type LargeCommunity struct {
+	Global uint32
+	Local1 uint32
+	Local2 uint32
+}
+
+func (c LargeCommunity) String() string {
+	return fmt.Sprintf("%d:%d:%d", c.Global, c.Local1, c.Local2)
+}
+
+func (c LargeCommunity) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *LargeCommunity) UnmarshalText(b []byte) error {
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("large community %q is not global:local1:local2", b)
+	}
+	var v [3]uint32
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return err
+		}
+		v[i] = uint32(n)
+	}
+	*c = LargeCommunity{v[0], v[1], v[2]}
+	return nil
+}
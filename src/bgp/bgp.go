@@ -7,7 +7,19 @@ const (
 	BGP_UPDATE
 )
 
-// Communication Message with BIRD
+// How an update changes the RIB view, see ribview.go
+type UpdateClass uint8
+
+const (
+	CLASS_UNKNOWN           UpdateClass = iota // no RIB view
+	CLASS_NEW                                  // route the view did not hold
+	CLASS_IMPLICIT_WITHDRAW                    // announcement over a route of the same peer and path
+	CLASS_REPLACEMENT                          // update naming the route it replaces
+	CLASS_WITHDRAW
+)
+
+// Communication Message with BIRD. The field layout is also the legacy wire
+// format, see wire.go
 type BgpInfo struct {
 	Msg_type int32
 	Padding  int32 // used to handle alignment difference between C struct and GO struct
@@ -27,6 +39,16 @@ type BgpInfo struct {
 	New_pref      int32
 
 	Btime int64
+
+	Source string      // connection the update was received on, not on the wire
+	Class  UpdateClass // set by the RIB view, not on the wire
+
+	// Not in the legacy format
+	Peer_addr uint32 // session the update was learned on
+	Peer_asn  uint32
+	Path_id   uint32 // add-path ID, not on the wire
+	Old_attrs RouteAttrs
+	New_attrs RouteAttrs
 }
 
 /*
@@ -67,9 +89,62 @@ type IpInfo struct {
 }
 
 type IpLogInfo struct {
+	Window    int64 // agetime of the observation window
 	DstIp     uint32
+	DstAs     uint32
+	Observer  uint32 // router that last reported a flow to DstIp
 	PriRoute  uint64
 	PriFlow   uint64
 	PostRoute uint64
 	PostFlow  uint64
 }
+
+// Per-update rollup of the bytes shifted between first-hop ASes
+type UpdateSummary struct {
+	Window   int64 // agetime of the observation window
+	Btime    int64
+	Msg_type int32
+	Route    uint64 // uint32 IP + uint8 Prefix of the updated route
+	DstCount int
+	PriFlow  uint64
+	PostFlow uint64
+	Moved    uint64 // bytes that changed route, max(pri, post) per destination
+	Converge int64  // seconds until post-route traffic converged, -1 if unknown
+	Drain    int64  // seconds until pri-route traffic drained, -1 if unknown
+
+	// Approximate mode only: the bytes of a destination may be overcounted by
+	// Error_bound, with probability Confidence
+	Error_bound uint64
+	Confidence  float64
+
+	// Attributes of the update, to tell which policy change caused the shift
+	Source    string
+	Class     UpdateClass
+	Peer_addr uint32
+	Peer_asn  uint32
+	Old_attrs RouteAttrs
+	New_attrs RouteAttrs
+
+	Away   map[int32]uint64  // first-hop ASN -> bytes shifted away from it
+	Toward map[int32]uint64  // first-hop ASN -> bytes shifted toward it
+	DstAs  map[uint32]uint64 // destination ASN -> affected bytes
+}
+
+// Routing event: the updates of one next hop and first-hop ASN arriving less
+// than the event gap apart, summed over their destinations
+type EventSummary struct {
+	Window    int64 // agetime of the primary window
+	Peer_addr uint32
+	Nexthop   uint32
+	First_asn int32
+	Start     int64 // Btime of the first update
+	End       int64 // Btime of the last update
+	Updates   int
+	Types     map[int32]int // update type -> updates
+	Routes    int
+	DstCount  int
+	PriFlow   uint64
+	PostFlow  uint64
+	Moved     uint64 // max(pri, post) per destination
+	Gbps      float64
+}
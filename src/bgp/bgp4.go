@@ -0,0 +1,430 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+BGP-4 messages (RFC 4271) as far as a passive, receive-only speaker needs
+them: IPv4 unicast only, capabilities for 4-byte ASNs (RFC 6793) and add-path
+reception (RFC 7911).
+
+Parse errors are *Notification values, ready to be sent to the peer before
+closing the session.
+*/
+
+// Message types
+const (
+	MSG_OPEN = iota + 1
+	MSG_UPDATE
+	MSG_NOTIFICATION
+	MSG_KEEPALIVE
+)
+
+// NOTIFICATION error codes
+const (
+	ERR_HEADER = iota + 1
+	ERR_OPEN
+	ERR_UPDATE
+	ERR_HOLD_TIMER
+	ERR_FSM
+	ERR_CEASE
+)
+
+// Path attribute type codes
+const (
+	ATTR_ORIGIN          = 1
+	ATTR_AS_PATH         = 2
+	ATTR_NEXT_HOP        = 3
+	ATTR_MED             = 4
+	ATTR_LOCAL_PREF      = 5
+	ATTR_COMMUNITIES     = 8
+	ATTR_AS4_PATH        = 17
+	ATTR_LARGE_COMMUNITY = 32
+)
+
+const (
+	attrFlagExtendedLen = 0x10
+
+	optParamCapabilities = 2
+	capMultiprotocol     = 1
+	capAs4               = 65
+	capAddPath           = 69
+	addPathReceive       = 1
+	addPathSend          = 2
+	afiIPv4              = 1
+	safiUnicast          = 1
+
+	segmentSet      = 1
+	segmentSequence = 2
+
+	bgp4Version            = 4
+	bgp4MinOpenLen         = Bgp4HeaderLen + 10
+	bgp4MinUpdateLen       = Bgp4HeaderLen + 4
+	bgp4MinNotificationLen = Bgp4HeaderLen + 2
+)
+
+const (
+	Bgp4HeaderLen = 19
+	Bgp4MaxLen    = 4096
+	AS_TRANS      = 23456 // 2-byte stand-in of a 4-byte ASN
+)
+
+// A NOTIFICATION, received from the peer or about to be sent to it
+type Notification struct {
+	Code    uint8
+	Subcode uint8
+	Data    []byte
+}
+
+func (n *Notification) Error() string {
+	return fmt.Sprintf("BGP notification %d/%d", n.Code, n.Subcode)
+}
+
+func notify(code uint8, subcode uint8, data ...byte) *Notification {
+	return &Notification{code, subcode, data}
+}
+
+// Parameters of an OPEN
+type Open struct {
+	Asn       uint32 // the 4-byte ASN if As4
+	Hold_time uint16
+	Router_id uint32
+	As4       bool // 4-byte ASN capability
+	Add_path  bool // add-path: we receive, or the peer sends, IPv4 unicast path ids
+}
+
+func bgp4Message(typ uint8, body []byte) []byte {
+	msg := make([]byte, Bgp4HeaderLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(len(msg)))
+	msg[18] = typ
+	copy(msg[Bgp4HeaderLen:], body)
+	return msg
+}
+
+// OPEN advertising IPv4 unicast, and the 4-byte ASN and add-path capabilities
+// set in o
+func MarshalOpen(o *Open) []byte {
+	caps := []byte{capMultiprotocol, 4, 0, afiIPv4, 0, safiUnicast}
+	if o.As4 {
+		caps = append(caps, capAs4, 4, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(caps[len(caps)-4:], o.Asn)
+	}
+	if o.Add_path {
+		caps = append(caps, capAddPath, 4, 0, afiIPv4, safiUnicast, addPathReceive)
+	}
+
+	asn := o.Asn
+	if asn > 0xffff {
+		asn = AS_TRANS
+	}
+	body := make([]byte, 10, 12+len(caps))
+	body[0] = bgp4Version
+	binary.BigEndian.PutUint16(body[1:], uint16(asn))
+	binary.BigEndian.PutUint16(body[3:], o.Hold_time)
+	binary.BigEndian.PutUint32(body[5:], o.Router_id)
+	body[9] = byte(2 + len(caps))
+	body = append(body, optParamCapabilities, byte(len(caps)))
+	return bgp4Message(MSG_OPEN, append(body, caps...))
+}
+
+// Add_path is set if the peer sends path ids for IPv4 unicast
+func ParseOpen(body []byte) (*Open, error) {
+	if body[0] != bgp4Version {
+		return nil, notify(ERR_OPEN, 1, 0, bgp4Version)
+	}
+	o := &Open{
+		Asn:       uint32(binary.BigEndian.Uint16(body[1:])),
+		Hold_time: binary.BigEndian.Uint16(body[3:]),
+		Router_id: binary.BigEndian.Uint32(body[5:]),
+	}
+	if o.Hold_time == 1 || o.Hold_time == 2 {
+		return nil, notify(ERR_OPEN, 6)
+	}
+	if o.Router_id == 0 {
+		return nil, notify(ERR_OPEN, 3)
+	}
+
+	params := body[10:]
+	if int(body[9]) != len(params) {
+		return nil, notify(ERR_HEADER, 2)
+	}
+	for len(params) > 0 {
+		if len(params) < 2 || len(params) < 2+int(params[1]) {
+			return nil, notify(ERR_OPEN, 0)
+		}
+		typ, value := params[0], params[2:2+params[1]]
+		params = params[2+params[1]:]
+		if typ != optParamCapabilities {
+			return nil, notify(ERR_OPEN, 4)
+		}
+		for len(value) > 0 {
+			if len(value) < 2 || len(value) < 2+int(value[1]) {
+				return nil, notify(ERR_OPEN, 0)
+			}
+			code, c := value[0], value[2:2+value[1]]
+			value = value[2+value[1]:]
+			switch {
+			case code == capAs4 && len(c) == 4:
+				o.As4 = true
+				o.Asn = binary.BigEndian.Uint32(c)
+			case code == capAddPath:
+				for ; len(c) >= 4; c = c[4:] {
+					if binary.BigEndian.Uint16(c) == afiIPv4 && c[2] == safiUnicast && c[3]&addPathSend != 0 {
+						o.Add_path = true
+					}
+				}
+			}
+		}
+	}
+	return o, nil
+}
+
+func MarshalKeepalive() []byte {
+	return bgp4Message(MSG_KEEPALIVE, nil)
+}
+
+func MarshalNotification(n *Notification) []byte {
+	return bgp4Message(MSG_NOTIFICATION, append([]byte{n.Code, n.Subcode}, n.Data...))
+}
+
+func ParseNotification(body []byte) *Notification {
+	return &Notification{body[0], body[1], body[2:]}
+}
+
+// Read the next message, returns its type and its body after the header
+func ReadBgp4(r io.Reader) (uint8, []byte, error) {
+	head := make([]byte, Bgp4HeaderLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+	for _, b := range head[:16] {
+		if b != 0xff {
+			return 0, nil, notify(ERR_HEADER, 1)
+		}
+	}
+	length := int(binary.BigEndian.Uint16(head[16:]))
+	typ := head[18]
+	bad_len := notify(ERR_HEADER, 2, head[16:18]...)
+	switch {
+	case length < Bgp4HeaderLen || length > Bgp4MaxLen:
+		return 0, nil, bad_len
+	case typ == MSG_OPEN && length < bgp4MinOpenLen,
+		typ == MSG_UPDATE && length < bgp4MinUpdateLen,
+		typ == MSG_NOTIFICATION && length < bgp4MinNotificationLen,
+		typ == MSG_KEEPALIVE && length != Bgp4HeaderLen:
+		return 0, nil, bad_len
+	case typ < MSG_OPEN || typ > MSG_KEEPALIVE:
+		return 0, nil, notify(ERR_HEADER, 3, typ)
+	}
+
+	body := make([]byte, length-Bgp4HeaderLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// IPv4 prefix, with the path id if add-path is on
+type Nlri struct {
+	Path_id uint32
+	Addr    uint32
+	Prefix  int32
+}
+
+type Update struct {
+	Withdrawn      []Nlri
+	Nlri           []Nlri
+	Nexthop        uint32
+	Local_pref     uint32
+	Has_local_pref bool
+	Attrs          RouteAttrs
+}
+
+func parseNlri(b []byte, add_path bool) ([]Nlri, error) {
+	var prefixes []Nlri
+	for len(b) > 0 {
+		var n Nlri
+		if add_path {
+			if len(b) < 4 {
+				return nil, notify(ERR_UPDATE, 10)
+			}
+			n.Path_id = binary.BigEndian.Uint32(b)
+			b = b[4:]
+		}
+		if len(b) < 1 || b[0] > 32 || len(b) < 1+int(b[0]+7)/8 {
+			return nil, notify(ERR_UPDATE, 10)
+		}
+		n.Prefix = int32(b[0])
+		size := int(b[0]+7) / 8
+		var addr [4]byte
+		copy(addr[:], b[1:1+size])
+		n.Addr = binary.BigEndian.Uint32(addr[:])
+		if n.Prefix < 32 {
+			n.Addr &^= 0xffffffff >> n.Prefix
+		}
+		prefixes = append(prefixes, n)
+		b = b[1+size:]
+	}
+	return prefixes, nil
+}
+
+// AS_PATH segments flattened, AS_SETs in order, confederation segments left out
+func parseAsPath(b []byte, asn_len int) ([]uint32, error) {
+	path := []uint32{}
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1])*asn_len {
+			return nil, notify(ERR_UPDATE, 11)
+		}
+		typ, n := b[0], int(b[1])
+		seg := b[2 : 2+n*asn_len]
+		b = b[2+n*asn_len:]
+		if typ != segmentSet && typ != segmentSequence {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			if asn_len == 4 {
+				path = append(path, binary.BigEndian.Uint32(seg[4*i:]))
+			} else {
+				path = append(path, uint32(binary.BigEndian.Uint16(seg[2*i:])))
+			}
+		}
+	}
+	return path, nil
+}
+
+// Parse an UPDATE body. as4 and add_path are the negotiated capabilities.
+func ParseUpdate(body []byte, as4 bool, add_path bool) (*Update, error) {
+	u := new(Update)
+	malformed := notify(ERR_UPDATE, 1)
+	wlen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+wlen+2 {
+		return nil, malformed
+	}
+	var err error
+	if u.Withdrawn, err = parseNlri(body[2:2+wlen], add_path); err != nil {
+		return nil, err
+	}
+	body = body[2+wlen:]
+	alen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+alen {
+		return nil, malformed
+	}
+	attrs := body[2 : 2+alen]
+	if u.Nlri, err = parseNlri(body[2+alen:], add_path); err != nil {
+		return nil, err
+	}
+
+	seen, err := parseAttrs(attrs, as4, u)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Nlri) > 0 {
+		for _, typ := range []uint8{ATTR_ORIGIN, ATTR_AS_PATH, ATTR_NEXT_HOP} {
+			if !seen[typ] {
+				return nil, notify(ERR_UPDATE, 3, typ)
+			}
+		}
+	}
+	return u, nil
+}
+
+// Decode the path attributes into u, returns the types found
+func parseAttrs(attrs []byte, as4 bool, u *Update) (map[uint8]bool, error) {
+	malformed := notify(ERR_UPDATE, 1)
+	var err error
+	asn_len := 2
+	if as4 {
+		asn_len = 4
+	}
+	var as4_path []uint32
+	seen := make(map[uint8]bool)
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return nil, malformed
+		}
+		flags, typ := attrs[0], attrs[1]
+		hlen, vlen := 3, int(attrs[2])
+		if flags&attrFlagExtendedLen != 0 {
+			if len(attrs) < 4 {
+				return nil, malformed
+			}
+			hlen, vlen = 4, int(binary.BigEndian.Uint16(attrs[2:]))
+		}
+		if len(attrs) < hlen+vlen {
+			return nil, notify(ERR_UPDATE, 5)
+		}
+		v := attrs[hlen : hlen+vlen]
+		attr := attrs[:hlen+vlen]
+		attrs = attrs[hlen+vlen:]
+		if seen[typ] {
+			return nil, malformed
+		}
+		seen[typ] = true
+
+		length_error := notify(ERR_UPDATE, 5, attr...)
+		switch typ {
+		case ATTR_ORIGIN:
+			if vlen != 1 {
+				return nil, length_error
+			}
+			if v[0] > byte(ORIGIN_INCOMPLETE) {
+				return nil, notify(ERR_UPDATE, 6, attr...)
+			}
+			u.Attrs.Origin = Origin(v[0])
+		case ATTR_AS_PATH:
+			if u.Attrs.As_path, err = parseAsPath(v, asn_len); err != nil {
+				return nil, err
+			}
+		case ATTR_AS4_PATH:
+			// a broken optional attribute is ignored (RFC 6793 6)
+			as4_path, _ = parseAsPath(v, 4)
+		case ATTR_NEXT_HOP:
+			if vlen != 4 {
+				return nil, length_error
+			}
+			u.Nexthop = binary.BigEndian.Uint32(v)
+		case ATTR_MED:
+			if vlen != 4 {
+				return nil, length_error
+			}
+			u.Attrs.Med = binary.BigEndian.Uint32(v)
+		case ATTR_LOCAL_PREF:
+			if vlen != 4 {
+				return nil, length_error
+			}
+			u.Local_pref = binary.BigEndian.Uint32(v)
+			u.Has_local_pref = true
+		case ATTR_COMMUNITIES:
+			if vlen%4 != 0 {
+				return nil, length_error
+			}
+			for ; len(v) > 0; v = v[4:] {
+				u.Attrs.Communities = append(u.Attrs.Communities, Community(binary.BigEndian.Uint32(v)))
+			}
+		case ATTR_LARGE_COMMUNITY:
+			if vlen%12 != 0 {
+				return nil, length_error
+			}
+			for ; len(v) > 0; v = v[12:] {
+				u.Attrs.Large_communities = append(u.Attrs.Large_communities,
+					LargeCommunity{binary.BigEndian.Uint32(v), binary.BigEndian.Uint32(v[4:]), binary.BigEndian.Uint32(v[8:])})
+			}
+		}
+	}
+
+	// the 4-byte ASNs of a 2-byte session replace the AS_TRANS of the path tail
+	if !as4 && as4_path != nil && len(as4_path) <= len(u.Attrs.As_path) {
+		head := u.Attrs.As_path[:len(u.Attrs.As_path)-len(as4_path)]
+		u.Attrs.As_path = append(head, as4_path...)
+	}
+	return seen, nil
+}
@@ -0,0 +1,369 @@
+package bgp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+Routing tables dumped by other tools, read to know the routes in place before
+the first update.
+
+	MRT    TABLE_DUMP_V2 (RFC 6396), IPv4 unicast with or without path ids
+	       (RFC 8050), e.g. the RIB files of RIPE RIS and RouteViews or of
+	       `birdc dump` through `mrt dump`
+	birdc  the output of `birdc show route`, better `show route all` which
+	       has the AS paths; only the best route of a prefix is read
+*/
+
+// A route of a table dump
+type TableEntry struct {
+	Route     uint64 // uint32 IP + uint8 Prefix
+	Peer_addr uint32
+	Peer_asn  uint32
+	Nexthop   uint32
+	Pref      int32
+	Attrs     RouteAttrs
+}
+
+const (
+	mrtTableDumpV2      = 13
+	mrtPeerIndexTable   = 1
+	mrtRibIPv4Unicast   = 2
+	mrtRibIPv4AddPath   = 8
+	mrtHeaderLen        = 12
+	mrtPeerTypeIPv6     = 0x01
+	mrtPeerTypeAs4      = 0x02
+	tableDefaultPref    = 100
+	tableMaxMrtRecord   = 16 << 20
+	birdcMaxLine        = 1 << 20
+	routePrefixHostBits = 8
+)
+
+type mrtPeer struct {
+	addr uint32 // 0 for IPv6 peers
+	asn  uint32
+}
+
+func mrtError(format string, args ...interface{}) error {
+	return fmt.Errorf("MRT: "+format, args...)
+}
+
+// Read an MRT file and call fn on every IPv4 unicast route. Records of other
+// types are skipped. Returns the number of routes passed to fn.
+func ReadMrt(r io.Reader, fn func(TableEntry)) (int, error) {
+	br := bufio.NewReader(r)
+	var peers []mrtPeer
+	n := 0
+	head := make([]byte, mrtHeaderLen)
+	for {
+		if _, err := io.ReadFull(br, head); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, mrtError("record header: %w", err)
+		}
+		typ := binary.BigEndian.Uint16(head[4:])
+		subtype := binary.BigEndian.Uint16(head[6:])
+		length := binary.BigEndian.Uint32(head[8:])
+		if length > tableMaxMrtRecord {
+			return n, mrtError("record of %d bytes", length)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return n, mrtError("record body: %w", err)
+		}
+		if typ != mrtTableDumpV2 {
+			continue
+		}
+
+		var err error
+		switch subtype {
+		case mrtPeerIndexTable:
+			peers, err = parseMrtPeers(body)
+		case mrtRibIPv4Unicast, mrtRibIPv4AddPath:
+			var entries []TableEntry
+			entries, err = parseMrtRib(body, peers, subtype == mrtRibIPv4AddPath)
+			for _, e := range entries {
+				fn(e)
+			}
+			n += len(entries)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func parseMrtPeers(b []byte) ([]mrtPeer, error) {
+	r := &fieldReader{b: b}
+	r.next(4) // collector BGP ID
+	r.next(r.u16())
+	count := r.u16()
+	peers := make([]mrtPeer, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		typ := r.u8()
+		r.next(4) // peer BGP ID
+		var p mrtPeer
+		if typ&mrtPeerTypeIPv6 != 0 {
+			r.next(16)
+		} else {
+			p.addr = r.u32()
+		}
+		if typ&mrtPeerTypeAs4 != 0 {
+			p.asn = r.u32()
+		} else {
+			p.asn = uint32(r.u16())
+		}
+		peers = append(peers, p)
+	}
+	if r.err != nil {
+		return nil, mrtError("peer index table truncated")
+	}
+	return peers, nil
+}
+
+func parseMrtRib(b []byte, peers []mrtPeer, add_path bool) ([]TableEntry, error) {
+	r := &fieldReader{b: b}
+	r.u32() // sequence number
+	prefix := int(r.u8())
+	if prefix > 32 {
+		return nil, mrtError("prefix length %d", prefix)
+	}
+	var addr [4]byte
+	copy(addr[:], r.next((prefix+7)/8))
+	ip := binary.BigEndian.Uint32(addr[:])
+	if prefix < 32 {
+		ip &^= 0xffffffff >> prefix
+	}
+	route := uint64(ip)<<routePrefixHostBits + uint64(prefix)
+
+	count := r.u16()
+	entries := make([]TableEntry, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		index := r.u16()
+		r.u32() // originated time
+		if add_path {
+			r.u32()
+		}
+		attrs := r.next(r.u16())
+		if r.err != nil {
+			break
+		}
+		if index >= len(peers) {
+			return nil, mrtError("peer index %d of %d peers", index, len(peers))
+		}
+
+		// TABLE_DUMP_V2 always has 4-byte ASNs
+		u := new(Update)
+		if _, err := parseAttrs(attrs, true, u); err != nil {
+			return nil, mrtError("%s: %w", routeString(route), err)
+		}
+		e := TableEntry{Route: route, Peer_addr: peers[index].addr, Peer_asn: peers[index].asn,
+			Nexthop: u.Nexthop, Pref: tableDefaultPref, Attrs: u.Attrs}
+		if u.Has_local_pref {
+			e.Pref = int32(u.Local_pref)
+		}
+		entries = append(entries, e)
+	}
+	if r.err != nil {
+		return nil, mrtError("RIB entry truncated")
+	}
+	return entries, nil
+}
+
+func routeString(route uint64) string {
+	ip := uint32(route >> routePrefixHostBits)
+	return fmt.Sprintf("%d.%d.%d.%d/%d", ip>>24, ip>>16&0xff, ip>>8&0xff, ip&0xff, route&0xff)
+}
+
+func parseIPv4(s string) (uint32, bool) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip), true
+}
+
+func parseRoute(cidr string) (uint64, bool) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ipnet.IP.To4() == nil {
+		return 0, false
+	}
+	prefix, _ := ipnet.Mask.Size()
+	return uint64(binary.BigEndian.Uint32(ipnet.IP.To4()))<<routePrefixHostBits + uint64(prefix), true
+}
+
+// A route of `birdc show route` starts on the line of its prefix, or on an
+// indented line of the same prefix, with the protocol in brackets and the
+// preference in parentheses:
+//
+//	10.0.0.0/8     unicast [bgp1 2024-01-01] * (100) [AS65001i]      BIRD 2
+//	10.0.0.0/8     via 192.0.2.1 on eth0 [bgp1 2024-01-01 from 192.0.2.1] * (100) [AS65001i]   BIRD 1
+//
+// The indented lines after it hold its next hops and attributes.
+func birdcRouteHeader(fields []string) (pref int32, ok bool) {
+	bracket := false
+	for _, f := range fields {
+		bracket = bracket || strings.HasPrefix(f, "[")
+		if bracket && strings.HasPrefix(f, "(") && strings.HasSuffix(f, ")") {
+			// (pref) or (pref/igp metric)
+			p := strings.SplitN(f[1:len(f)-1], "/", 2)[0]
+			if v, err := strconv.ParseInt(p, 10, 32); err == nil {
+				return int32(v), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Numbers of an attribute value, separators and set or confederation
+// delimiters left out
+func birdcNumbers(s string) ([]uint32, error) {
+	var numbers []uint32
+	for _, f := range strings.FieldsFunc(s, func(c rune) bool { return strings.ContainsRune(" ,{}()[]", c) }) {
+		v, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, uint32(v))
+	}
+	return numbers, nil
+}
+
+type birdcRoute struct {
+	entry TableEntry
+	best  bool
+}
+
+// Parse the attribute and next hop lines of a route
+func (br *birdcRoute) parseLine(line string) error {
+	e := &br.entry
+	key, value, found := strings.Cut(line, ":")
+	value = strings.TrimSpace(value)
+	var err error
+	switch {
+	case strings.HasPrefix(line, "via ") && e.Nexthop == 0:
+		e.Nexthop, _ = parseIPv4(strings.Fields(line)[1])
+	case !found:
+	case key == "BGP.origin":
+		err = e.Attrs.Origin.UnmarshalText([]byte(strings.ToLower(value)))
+	case key == "BGP.as_path":
+		e.Attrs.As_path, err = birdcNumbers(value)
+		if e.Attrs.As_path == nil {
+			e.Attrs.As_path = []uint32{}
+		}
+	case key == "BGP.next_hop" && e.Nexthop == 0:
+		e.Nexthop, _ = parseIPv4(strings.Fields(value + " ")[0])
+	case key == "BGP.med":
+		var v []uint32
+		if v, err = birdcNumbers(value); err == nil && len(v) == 1 {
+			e.Attrs.Med = v[0]
+		}
+	case key == "BGP.local_pref":
+		var v []uint32
+		if v, err = birdcNumbers(value); err == nil && len(v) == 1 {
+			e.Pref = int32(v[0])
+		}
+	case key == "BGP.community":
+		var v []uint32
+		v, err = birdcNumbers(value)
+		if len(v)%2 != 0 {
+			err = errors.New("community is not (asn,value)")
+		}
+		for i := 0; err == nil && i < len(v); i += 2 {
+			e.Attrs.Communities = append(e.Attrs.Communities, Community(v[i]<<16|v[i+1]&0xffff))
+		}
+	case key == "BGP.large_community":
+		var v []uint32
+		v, err = birdcNumbers(value)
+		if len(v)%3 != 0 {
+			err = errors.New("large community is not (global, local1, local2)")
+		}
+		for i := 0; err == nil && i < len(v); i += 3 {
+			e.Attrs.Large_communities = append(e.Attrs.Large_communities, LargeCommunity{v[i], v[i+1], v[i+2]})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+// Read the output of `birdc show route [all]` and call fn on the best route of
+// every IPv4 prefix, the first one if none is marked best. Returns the number
+// of routes passed to fn.
+func ReadBirdc(r io.Reader, fn func(TableEntry)) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), birdcMaxLine)
+	n := 0
+	var route uint64
+	var valid bool
+	var routes []*birdcRoute
+
+	flush := func() {
+		if len(routes) == 0 {
+			return
+		}
+		pick := routes[0]
+		for _, br := range routes {
+			if br.best {
+				pick = br
+				break
+			}
+		}
+		fn(pick.entry)
+		n++
+		routes = routes[:0]
+	}
+
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(line, "BIRD ") || strings.HasPrefix(line, "Table ") {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			// a new prefix
+			flush()
+			route, valid = parseRoute(fields[0])
+			fields = fields[1:]
+		}
+		if !valid {
+			// IPv6 and the other networks
+			continue
+		}
+
+		if pref, ok := birdcRouteHeader(fields); ok {
+			br := &birdcRoute{entry: TableEntry{Route: route, Pref: pref}}
+			for i, f := range fields {
+				switch {
+				case f == "*":
+					br.best = true
+				case f == "via" && i+1 < len(fields):
+					br.entry.Nexthop, _ = parseIPv4(fields[i+1])
+				case f == "from" && i+1 < len(fields):
+					br.entry.Peer_addr, _ = parseIPv4(strings.TrimSuffix(fields[i+1], "]"))
+				}
+			}
+			routes = append(routes, br)
+			continue
+		}
+		if len(routes) > 0 {
+			if err := routes[len(routes)-1].parseLine(strings.TrimSpace(line)); err != nil {
+				return n, fmt.Errorf("birdc line %d: %w", lineno, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+	flush()
+	return n, nil
+}
@@ -0,0 +1,283 @@
+package bgp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func mrtRecord(typ uint16, subtype uint16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 1700000000)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, subtype)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+// Peer 0 is 192.0.2.1 in AS 4200000001, peer 1 an IPv6 peer in AS 64512
+func mrtPeers() []byte {
+	b := []byte{10, 0, 0, 1, 0, 4}
+	b = append(b, "rib1"...)
+	b = binary.BigEndian.AppendUint16(b, 2)
+	b = append(b, mrtPeerTypeAs4, 192, 0, 2, 1, 192, 0, 2, 1)
+	b = binary.BigEndian.AppendUint32(b, 4200000001)
+	b = append(b, mrtPeerTypeIPv6, 192, 0, 2, 2)
+	b = append(b, make([]byte, 16)...)
+	b = binary.BigEndian.AppendUint16(b, 64512)
+	return mrtRecord(mrtTableDumpV2, mrtPeerIndexTable, b)
+}
+
+type mrtEntry struct {
+	peer  uint16
+	attrs []byte
+}
+
+func mrtRib(subtype uint16, addr []byte, prefix uint8, entries ...mrtEntry) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 7)
+	b = append(append(b, prefix), addr...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(entries)))
+	for i, e := range entries {
+		b = binary.BigEndian.AppendUint16(b, e.peer)
+		b = binary.BigEndian.AppendUint32(b, 1700000000)
+		if subtype == mrtRibIPv4AddPath {
+			b = binary.BigEndian.AppendUint32(b, uint32(i+1))
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(e.attrs)))
+		b = append(b, e.attrs...)
+	}
+	return mrtRecord(mrtTableDumpV2, subtype, b)
+}
+
+func mrtAttr(typ uint8, value ...byte) []byte {
+	return append([]byte{0x40, typ, byte(len(value))}, value...)
+}
+
+// ORIGIN, a 4-byte AS_PATH and NEXT_HOP, then the extra attributes
+func mrtAttrs(nexthop byte, asn uint32, extra ...[]byte) []byte {
+	path := binary.BigEndian.AppendUint32([]byte{2, 1}, asn)
+	b := append(mrtAttr(ATTR_ORIGIN, byte(ORIGIN_EGP)), mrtAttr(ATTR_AS_PATH, path...)...)
+	b = append(b, mrtAttr(ATTR_NEXT_HOP, 192, 0, 2, nexthop)...)
+	for _, e := range extra {
+		b = append(b, e...)
+	}
+	return b
+}
+
+// The peer index, a route with an entry of each peer, a record of another
+// type and an add-path route
+func testMrt() []byte {
+	return bytes.Join([][]byte{
+		mrtPeers(),
+		mrtRib(mrtRibIPv4Unicast, []byte{10}, 8,
+			mrtEntry{0, mrtAttrs(1, 4200000001, mrtAttr(ATTR_LOCAL_PREF, 0, 0, 0, 150), mrtAttr(ATTR_COMMUNITIES, 0xfc, 0, 0, 1))},
+			mrtEntry{1, mrtAttrs(2, 64512)}),
+		mrtRecord(16, 4, []byte{1, 2, 3}),
+		mrtRib(mrtRibIPv4AddPath, []byte{198, 51, 100}, 24, mrtEntry{0, mrtAttrs(1, 4200000001, mrtAttr(ATTR_MED, 0, 0, 0, 20))}),
+	}, nil)
+}
+
+func readMrt(b []byte) ([]TableEntry, int, error) {
+	var entries []TableEntry
+	n, err := ReadMrt(bytes.NewReader(b), func(e TableEntry) { entries = append(entries, e) })
+	return entries, n, err
+}
+
+func TestReadMrt(t *testing.T) {
+	entries, n, err := readMrt(testMrt())
+	if err != nil || n != 3 || len(entries) != 3 {
+		t.Fatalf("%d routes, %d passed, err %v", n, len(entries), err)
+	}
+	want := []TableEntry{
+		{Route: 0x0a000000<<8 | 8, Peer_addr: 0xc0000201, Peer_asn: 4200000001, Nexthop: 0xc0000201, Pref: 150,
+			Attrs: RouteAttrs{As_path: []uint32{4200000001}, Communities: []Community{0xfc000001}, Origin: ORIGIN_EGP}},
+		{Route: 0x0a000000<<8 | 8, Peer_addr: 0, Peer_asn: 64512, Nexthop: 0xc0000202, Pref: tableDefaultPref,
+			Attrs: RouteAttrs{As_path: []uint32{64512}, Origin: ORIGIN_EGP}},
+		{Route: 0xc6336400<<8 | 24, Peer_addr: 0xc0000201, Peer_asn: 4200000001, Nexthop: 0xc0000201, Pref: tableDefaultPref,
+			Attrs: RouteAttrs{As_path: []uint32{4200000001}, Med: 20, Origin: ORIGIN_EGP}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("read %+v, want %+v", entries, want)
+	}
+}
+
+func TestReadMrtMalformed(t *testing.T) {
+	peers := mrtPeers()
+	entry := mrtEntry{0, mrtAttrs(1, 4200000001)}
+	rib := mrtRib(mrtRibIPv4Unicast, []byte{10}, 8, entry)
+
+	// a record that claims more than the limit
+	huge := mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, nil)
+	binary.BigEndian.PutUint32(huge[8:], tableMaxMrtRecord+1)
+
+	// the records end inside their fields
+	cut_peers := mrtRecord(mrtTableDumpV2, mrtPeerIndexTable, peers[mrtHeaderLen:len(peers)-1])
+	cut_rib := mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, rib[mrtHeaderLen:len(rib)-1])
+	cut_prefix := mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, []byte{0, 0, 0, 7, 24, 198})
+
+	cases := []struct {
+		name string
+		mrt  []byte
+	}{
+		{"record too long", append(peers, huge...)},
+		{"peer index truncated", cut_peers},
+		{"RIB entry truncated", append(peers, cut_rib...)},
+		{"prefix truncated", append(peers, cut_prefix...)},
+		{"prefix length", append(peers, mrtRib(mrtRibIPv4Unicast, []byte{10, 0, 0, 0, 0}, 33, entry)...)},
+		{"RIB before the peer index", rib},
+		{"peer index", append(peers, mrtRib(mrtRibIPv4Unicast, []byte{10}, 8, mrtEntry{2, entry.attrs})...)},
+		{"origin", append(peers, mrtRib(mrtRibIPv4Unicast, []byte{10}, 8, mrtEntry{0, mrtAttr(ATTR_ORIGIN, 3)})...)},
+		{"attribute length", append(peers, mrtRib(mrtRibIPv4Unicast, []byte{10}, 8, mrtEntry{0, entry.attrs[:len(entry.attrs)-1]})...)},
+		{"as path", append(peers, mrtRib(mrtRibIPv4Unicast, []byte{10}, 8, mrtEntry{0, mrtAttr(ATTR_AS_PATH, 2, 2, 0, 0, 0, 1)})...)},
+	}
+	for _, c := range cases {
+		entries, n, err := readMrt(c.mrt)
+		if err == nil || !strings.HasPrefix(err.Error(), "MRT: ") {
+			t.Errorf("%s: err %v, want an MRT error", c.name, err)
+		}
+		if n != 0 || len(entries) != 0 {
+			t.Errorf("%s: %d routes read", c.name, n)
+		}
+	}
+}
+
+func TestReadMrtTruncated(t *testing.T) {
+	mrt := testMrt()
+	full, _, _ := readMrt(mrt)
+
+	// only a cut at the end of a record is no error
+	var ends []int
+	for b := mrt; len(b) > 0; {
+		b = b[mrtHeaderLen+int(binary.BigEndian.Uint32(b[8:])):]
+		ends = append(ends, len(mrt)-len(b))
+	}
+
+	for cut := 1; cut < len(mrt); cut++ {
+		at_end := false
+		for _, end := range ends {
+			at_end = at_end || cut == end
+		}
+		entries, n, err := readMrt(mrt[:cut])
+		if at_end != (err == nil) {
+			t.Fatalf("cut at %d of %d: err %v", cut, len(mrt), err)
+		}
+		if n != len(entries) {
+			t.Fatalf("cut at %d: %d routes counted, %d passed", cut, n, len(entries))
+		}
+		if n > 0 && !reflect.DeepEqual(entries, full[:n]) {
+			t.Fatalf("cut at %d: read %+v", cut, entries)
+		}
+	}
+}
+
+const testBirdc = `BIRD 2.0.12 ready.
+Table master4:
+10.0.0.0/8           unicast [bgp2 2024-01-01 from 192.0.2.2] (100) [AS64601i]
+	via 192.0.2.2 on eth0
+	Type: BGP univ
+	BGP.as_path: 64513 64601
+                     unicast [bgp1 2024-01-01 from 192.0.2.1] * (100) [AS64600i]
+	via 192.0.2.1 on eth0
+	Type: BGP univ
+	BGP.origin: IGP
+	BGP.as_path: 64512 64600
+	BGP.next_hop: 192.0.2.1
+	BGP.local_pref: 150
+	BGP.community: (64512,1) (64512,2)
+	BGP.large_community: (64512, 1, 2)
+198.51.100.0/24      via 192.0.2.3 on eth0 [bgp3 2024-01-01 from 192.0.2.3] (100/20) [AS64700e]
+	Type: BGP univ
+	BGP.origin: EGP
+	BGP.as_path: 64514 {64700 64701}
+	BGP.med: 20
+2001:db8::/32        unicast [bgp6 2024-01-01] * (100) [AS64800i]
+	BGP.as_path: 64800
+`
+
+func readBirdc(s string) ([]TableEntry, int, error) {
+	var entries []TableEntry
+	n, err := ReadBirdc(strings.NewReader(s), func(e TableEntry) { entries = append(entries, e) })
+	return entries, n, err
+}
+
+func TestReadBirdc(t *testing.T) {
+	entries, n, err := readBirdc(testBirdc)
+	if err != nil || n != 2 || len(entries) != 2 {
+		t.Fatalf("%d routes, %d passed, err %v", n, len(entries), err)
+	}
+	want := []TableEntry{
+		{Route: 0x0a000000<<8 | 8, Peer_addr: 0xc0000201, Nexthop: 0xc0000201, Pref: 150,
+			Attrs: RouteAttrs{As_path: []uint32{64512, 64600}, Communities: []Community{64512<<16 | 1, 64512<<16 | 2},
+				Large_communities: []LargeCommunity{{64512, 1, 2}}, Origin: ORIGIN_IGP}},
+		{Route: 0xc6336400<<8 | 24, Peer_addr: 0xc0000203, Nexthop: 0xc0000203, Pref: 100,
+			Attrs: RouteAttrs{As_path: []uint32{64514, 64700, 64701}, Med: 20, Origin: ORIGIN_EGP}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("read %+v, want %+v", entries, want)
+	}
+}
+
+func TestReadBirdcMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		old  string
+		new  string
+		line int
+	}{
+		{"origin", "BGP.origin: IGP", "BGP.origin: best", 10},
+		{"as path", "BGP.as_path: 64512 64600", "BGP.as_path: 64512 AS64600", 11},
+		{"local pref", "BGP.local_pref: 150", "BGP.local_pref: -1", 13},
+		{"community", "(64512,1) (64512,2)", "(64512,1,2)", 14},
+		{"large community", "(64512, 1, 2)", "(64512, 1)", 15},
+		{"med", "BGP.med: 20", "BGP.med: 0x14", 20},
+	}
+	for _, c := range cases {
+		if !strings.Contains(testBirdc, c.old) {
+			t.Fatalf("%s: %q not in the output", c.name, c.old)
+		}
+		_, _, err := readBirdc(strings.Replace(testBirdc, c.old, c.new, 1))
+		if err == nil || !strings.HasPrefix(err.Error(), "birdc line ") {
+			t.Errorf("%s: err %v, want a birdc error", c.name, err)
+			continue
+		}
+		if want := "birdc line " + strconv.Itoa(c.line) + ":"; !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: err %v, want it on line %d", c.name, err, c.line)
+		}
+	}
+
+	// a line over the limit
+	long := testBirdc + "\t" + strings.Repeat("x", birdcMaxLine) + "\n"
+	if _, _, err := readBirdc(long); err != bufio.ErrTooLong {
+		t.Fatalf("err %v, want bufio.ErrTooLong", err)
+	}
+}
+
+func TestReadBirdcTruncated(t *testing.T) {
+	full, _, _ := readBirdc(testBirdc)
+
+	// the output cut anywhere gives the routes before the cut, the last one
+	// with part of its attributes, or an error on a cut attribute value
+	for cut := 0; cut < len(testBirdc); cut++ {
+		entries, n, err := readBirdc(testBirdc[:cut])
+		if n != len(entries) || n > len(full) {
+			t.Fatalf("cut at %d: %d routes counted, %d passed", cut, n, len(entries))
+		}
+		if err != nil {
+			if !strings.HasPrefix(err.Error(), "birdc line ") {
+				t.Fatalf("cut at %d: err %v", cut, err)
+			}
+			continue
+		}
+		for i := 0; i+1 < n; i++ {
+			if !reflect.DeepEqual(entries[i], full[i]) {
+				t.Fatalf("cut at %d: route %d read as %+v", cut, i, entries[i])
+			}
+		}
+		if n > 0 && entries[n-1].Route != full[n-1].Route {
+			t.Fatalf("cut at %d: last route %s, want %s", cut, routeString(entries[n-1].Route), routeString(full[n-1].Route))
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package bgp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+/*
+Wire format of the messages BIRD sends to Anaflow.
+
+A message is a header, a payload and a checksum, in network byte order:
+
+	magic     4 byte  "AFBM"
+	version   1 byte  1
+	type      1 byte  1: route update, 2: dump request, 3: table entry, 4: dump end
+	length    2 byte  payload length
+	payload   length byte
+	checksum  4 byte  CRC-32C of the header and the payload
+
+Route update payload:
+
+	msg_type  4 byte   1: add RTE, 2: delete RTE, 3: change RTE attr
+	old route 24 byte  ip_addr, ip_prefix, nexthop, first_asn, path_len, pref (all 0 if not exists)
+	new route 24 byte  same as old route
+	btime     8 byte   unix seconds
+	peer_addr 4 byte   optional from here on, as a whole
+	peer_asn  4 byte
+	old attrs          attributes of the old route
+	new attrs          attributes of the new route
+
+Route attributes:
+
+	origin      1 byte  0: IGP, 1: EGP, 2: INCOMPLETE
+	rpki        1 byte  0: unknown, 1: valid, 2: invalid, 3: not found
+	med         4 byte
+	n           2 byte  AS path length
+	as_path     n * 4 byte
+	n           2 byte  number of communities
+	communities n * 4 byte
+	n           2 byte  number of large communities
+	large       n * 12 byte  global, local1, local2
+
+A dump request asks BIRD, on a stream connection, for its current table: one
+table entry per route, a route update payload adding it, then a dump end. The
+dump request and the dump end have no payload.
+
+Fields added later go after the known ones. A decoder reads the fields it knows
+and skips the rest, so the version only changes for incompatible layouts.
+
+A 64-byte message without the magic is the legacy raw little-endian C struct,
+laid out as BgpInfo with its Padding field.
+*/
+
+const (
+	WireMagic   = 0x4146424d // "AFBM"
+	WireVersion = 1
+
+	MsgRouteUpdate = 1
+	MsgDumpRequest = 2
+	MsgTableEntry  = 3
+	MsgDumpEnd     = 4
+
+	HeaderLen   = 8
+	ChecksumLen = 4
+	LegacyLen   = 64
+
+	routeLen        = 24
+	updatePayloadV1 = 4 + 2*routeLen + 8
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Why a message was rejected, Reason is a short label for counters
+type WireError struct {
+	Reason string
+	Detail string
+}
+
+func (e *WireError) Error() string {
+	return fmt.Sprintf("malformed BGP message (%s): %s", e.Reason, e.Detail)
+}
+
+func wireError(reason string, format string, args ...interface{}) error {
+	return &WireError{reason, fmt.Sprintf(format, args...)}
+}
+
+func putRoute(b []byte, ip uint32, prefix int32, nexthop uint32, asn int32, path_len int32, pref int32) {
+	binary.BigEndian.PutUint32(b[0:], ip)
+	binary.BigEndian.PutUint32(b[4:], uint32(prefix))
+	binary.BigEndian.PutUint32(b[8:], nexthop)
+	binary.BigEndian.PutUint32(b[12:], uint32(asn))
+	binary.BigEndian.PutUint32(b[16:], uint32(path_len))
+	binary.BigEndian.PutUint32(b[20:], uint32(pref))
+}
+
+func attrsLen(a *RouteAttrs) int {
+	return 6 + 2 + 4*len(a.As_path) + 2 + 4*len(a.Communities) + 2 + 12*len(a.Large_communities)
+}
+
+func putAttrs(b []byte, a *RouteAttrs) []byte {
+	be := binary.BigEndian
+	b[0] = byte(a.Origin)
+	b[1] = byte(a.Rpki)
+	be.PutUint32(b[2:], a.Med)
+	b = b[6:]
+	be.PutUint16(b, uint16(len(a.As_path)))
+	for i, asn := range a.As_path {
+		be.PutUint32(b[2+4*i:], asn)
+	}
+	b = b[2+4*len(a.As_path):]
+	be.PutUint16(b, uint16(len(a.Communities)))
+	for i, c := range a.Communities {
+		be.PutUint32(b[2+4*i:], uint32(c))
+	}
+	b = b[2+4*len(a.Communities):]
+	be.PutUint16(b, uint16(len(a.Large_communities)))
+	for i, c := range a.Large_communities {
+		be.PutUint32(b[2+12*i:], c.Global)
+		be.PutUint32(b[6+12*i:], c.Local1)
+		be.PutUint32(b[10+12*i:], c.Local2)
+	}
+	return b[2+12*len(a.Large_communities):]
+}
+
+func newMessage(typ uint8, length int) []byte {
+	msg := make([]byte, HeaderLen+length+ChecksumLen)
+	binary.BigEndian.PutUint32(msg[0:], WireMagic)
+	msg[4] = WireVersion
+	msg[5] = typ
+	binary.BigEndian.PutUint16(msg[6:], uint16(length))
+	return msg
+}
+
+func sealMessage(msg []byte) []byte {
+	end := len(msg) - ChecksumLen
+	binary.BigEndian.PutUint32(msg[end:], crc32.Checksum(msg[:end], castagnoli))
+	return msg
+}
+
+// Encode bu as a framed route update message. Fails if the attributes do not
+// fit in one message.
+func MarshalUpdate(bu *BgpInfo) ([]byte, error) {
+	return marshalRoute(MsgRouteUpdate, bu)
+}
+
+// Encode bu, adding a route, as a table entry of a dump
+func MarshalTableEntry(bu *BgpInfo) ([]byte, error) {
+	return marshalRoute(MsgTableEntry, bu)
+}
+
+func MarshalDumpRequest() []byte {
+	return sealMessage(newMessage(MsgDumpRequest, 0))
+}
+
+func MarshalDumpEnd() []byte {
+	return sealMessage(newMessage(MsgDumpEnd, 0))
+}
+
+func marshalRoute(typ uint8, bu *BgpInfo) ([]byte, error) {
+	length := updatePayloadV1 + 8 + attrsLen(&bu.Old_attrs) + attrsLen(&bu.New_attrs)
+	if length > 0xffff {
+		return nil, wireError("size", "route update payload of %d bytes does not fit in a message", length)
+	}
+	msg := newMessage(typ, length)
+
+	p := msg[HeaderLen:]
+	binary.BigEndian.PutUint32(p[0:], uint32(bu.Msg_type))
+	putRoute(p[4:], bu.Old_ip_addr, bu.Old_ip_prefix, bu.Old_nexthop, bu.Old_first_asn, bu.Old_path_len, bu.Old_pref)
+	putRoute(p[4+routeLen:], bu.New_ip_addr, bu.New_ip_prefix, bu.New_nexthop, bu.New_first_asn, bu.New_path_len, bu.New_pref)
+	binary.BigEndian.PutUint64(p[4+2*routeLen:], uint64(bu.Btime))
+	p = p[updatePayloadV1:]
+	binary.BigEndian.PutUint32(p[0:], bu.Peer_addr)
+	binary.BigEndian.PutUint32(p[4:], bu.Peer_asn)
+	p = putAttrs(p[8:], &bu.Old_attrs)
+	putAttrs(p, &bu.New_attrs)
+	return sealMessage(msg), nil
+}
+
+func decodeLegacy(b []byte, bu *BgpInfo) {
+	le := binary.LittleEndian
+	*bu = BgpInfo{
+		Msg_type:      int32(le.Uint32(b[0:])),
+		Padding:       int32(le.Uint32(b[4:])),
+		Old_ip_addr:   le.Uint32(b[8:]),
+		Old_ip_prefix: int32(le.Uint32(b[12:])),
+		Old_nexthop:   le.Uint32(b[16:]),
+		Old_first_asn: int32(le.Uint32(b[20:])),
+		Old_path_len:  int32(le.Uint32(b[24:])),
+		Old_pref:      int32(le.Uint32(b[28:])),
+		New_ip_addr:   le.Uint32(b[32:]),
+		New_ip_prefix: int32(le.Uint32(b[36:])),
+		New_nexthop:   le.Uint32(b[40:]),
+		New_first_asn: int32(le.Uint32(b[44:])),
+		New_path_len:  int32(le.Uint32(b[48:])),
+		New_pref:      int32(le.Uint32(b[52:])),
+		Btime:         int64(le.Uint64(b[56:])),
+	}
+}
+
+// Reads the fields in order, failing on the first one past the end of the payload
+type fieldReader struct {
+	b   []byte
+	err error
+}
+
+func (r *fieldReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.b) < n {
+		r.err = wireError("payload", "route attributes truncated")
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *fieldReader) u8() uint8   { return r.next(1)[0] }
+func (r *fieldReader) u16() int    { return int(binary.BigEndian.Uint16(r.next(2))) }
+func (r *fieldReader) u32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+
+func (r *fieldReader) attrs(a *RouteAttrs) {
+	a.Origin = Origin(r.u8())
+	a.Rpki = Rpki(r.u8())
+	a.Med = r.u32()
+	for n := r.u16(); n > 0 && r.err == nil; n-- {
+		a.As_path = append(a.As_path, r.u32())
+	}
+	for n := r.u16(); n > 0 && r.err == nil; n-- {
+		a.Communities = append(a.Communities, Community(r.u32()))
+	}
+	for n := r.u16(); n > 0 && r.err == nil; n-- {
+		a.Large_communities = append(a.Large_communities, LargeCommunity{r.u32(), r.u32(), r.u32()})
+	}
+}
+
+func decodeUpdate(p []byte, bu *BgpInfo) error {
+	if len(p) < updatePayloadV1 {
+		return wireError("payload", "route update payload of %d bytes, want at least %d", len(p), updatePayloadV1)
+	}
+	be := binary.BigEndian
+	o := p[4:]
+	n := p[4+routeLen:]
+	*bu = BgpInfo{
+		Msg_type:      int32(be.Uint32(p[0:])),
+		Old_ip_addr:   be.Uint32(o[0:]),
+		Old_ip_prefix: int32(be.Uint32(o[4:])),
+		Old_nexthop:   be.Uint32(o[8:]),
+		Old_first_asn: int32(be.Uint32(o[12:])),
+		Old_path_len:  int32(be.Uint32(o[16:])),
+		Old_pref:      int32(be.Uint32(o[20:])),
+		New_ip_addr:   be.Uint32(n[0:]),
+		New_ip_prefix: int32(be.Uint32(n[4:])),
+		New_nexthop:   be.Uint32(n[8:]),
+		New_first_asn: int32(be.Uint32(n[12:])),
+		New_path_len:  int32(be.Uint32(n[16:])),
+		New_pref:      int32(be.Uint32(n[20:])),
+		Btime:         int64(be.Uint64(p[4+2*routeLen:])),
+	}
+	if len(p) == updatePayloadV1 {
+		return nil
+	}
+
+	r := &fieldReader{b: p[updatePayloadV1:]}
+	bu.Peer_addr = r.u32()
+	bu.Peer_asn = r.u32()
+	r.attrs(&bu.Old_attrs)
+	r.attrs(&bu.New_attrs)
+	return r.err
+}
+
+// Check the decoded values, whatever the format
+func checkUpdate(bu *BgpInfo) error {
+	if bu.Msg_type < BGP_ADD || bu.Msg_type > BGP_UPDATE {
+		return wireError("msg_type", "unknown msg_type %d", bu.Msg_type)
+	}
+	if bu.Old_ip_prefix < 0 || bu.Old_ip_prefix > 32 || bu.New_ip_prefix < 0 || bu.New_ip_prefix > 32 {
+		return wireError("prefix", "prefix length %d/%d out of range", bu.Old_ip_prefix, bu.New_ip_prefix)
+	}
+	return nil
+}
+
+// Decode one whole message into bu, which is left empty for the messages
+// without a route, see MessageType. Returns the wire version, 0 for the legacy
+// format.
+func UnmarshalMessage(msg []byte, bu *BgpInfo) (int, error) {
+	if len(msg) < 4 || binary.BigEndian.Uint32(msg) != WireMagic {
+		if len(msg) != LegacyLen {
+			return 0, wireError("size", "%d bytes without magic, legacy messages are %d bytes", len(msg), LegacyLen)
+		}
+		decodeLegacy(msg, bu)
+		return 0, checkUpdate(bu)
+	}
+
+	if len(msg) < HeaderLen+ChecksumLen {
+		return 0, wireError("size", "%d bytes, shorter than header and checksum", len(msg))
+	}
+	version := int(msg[4])
+	if version != WireVersion {
+		return version, wireError("version", "version %d, supported %d", version, WireVersion)
+	}
+	length := int(binary.BigEndian.Uint16(msg[6:]))
+	if len(msg) != HeaderLen+length+ChecksumLen {
+		return version, wireError("size", "%d bytes for a payload of %d", len(msg), length)
+	}
+	end := HeaderLen + length
+	if crc32.Checksum(msg[:end], castagnoli) != binary.BigEndian.Uint32(msg[end:]) {
+		return version, wireError("checksum", "checksum mismatch")
+	}
+
+	switch msg[5] {
+	case MsgRouteUpdate, MsgTableEntry:
+		if err := decodeUpdate(msg[HeaderLen:end], bu); err != nil {
+			return version, err
+		}
+	case MsgDumpRequest, MsgDumpEnd:
+		if length != 0 {
+			return version, wireError("payload", "%d bytes of payload in a message without one", length)
+		}
+		*bu = BgpInfo{}
+		return version, nil
+	default:
+		return version, wireError("type", "unknown message type %d", msg[5])
+	}
+	return version, checkUpdate(bu)
+}
+
+// Type of a message, MsgRouteUpdate for the legacy format
+func MessageType(msg []byte) int {
+	if len(msg) < HeaderLen || binary.BigEndian.Uint32(msg) != WireMagic {
+		return MsgRouteUpdate
+	}
+	return int(msg[5])
+}
+
+// Read the next message of a byte stream, framed or legacy. Returns io.EOF only
+// at a message boundary.
+func ReadMessage(r *bufio.Reader) ([]byte, error) {
+	head, err := r.Peek(HeaderLen)
+	if err == io.EOF && len(head) == 0 {
+		return nil, io.EOF
+	}
+	size := LegacyLen
+	if len(head) >= 4 && binary.BigEndian.Uint32(head) == WireMagic {
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size = HeaderLen + int(binary.BigEndian.Uint16(head[6:])) + ChecksumLen
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
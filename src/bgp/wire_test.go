@@ -0,0 +1,228 @@
+package bgp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func testUpdate() BgpInfo {
+	return BgpInfo{
+		Msg_type:      BGP_UPDATE,
+		Old_ip_addr:   0x0a000000,
+		Old_ip_prefix: 8,
+		Old_nexthop:   0xc0000201,
+		Old_first_asn: 64512,
+		Old_path_len:  2,
+		Old_pref:      100,
+		New_ip_addr:   0x0a000000,
+		New_ip_prefix: 8,
+		New_nexthop:   0xc0000202,
+		New_first_asn: 64513,
+		New_path_len:  1,
+		New_pref:      200,
+		Btime:         1700000000,
+		Peer_addr:     0xc0000202,
+		Peer_asn:      64513,
+		Old_attrs: RouteAttrs{
+			As_path:     []uint32{64512, 64600},
+			Communities: []Community{Community(64512<<16 | 1)},
+			Med:         10,
+			Origin:      ORIGIN_EGP,
+		},
+		New_attrs: RouteAttrs{
+			As_path:           []uint32{64513},
+			Large_communities: []LargeCommunity{{64513, 1, 2}},
+			Rpki:              RPKI_VALID,
+		},
+	}
+}
+
+// Rewrite the payload of msg and seal it again
+func reframe(msg []byte, payload []byte) []byte {
+	out := newMessage(msg[5], len(payload))
+	out[4] = msg[4]
+	copy(out[HeaderLen:], payload)
+	return sealMessage(out)
+}
+
+func payloadOf(msg []byte) []byte {
+	return append([]byte(nil), msg[HeaderLen:len(msg)-ChecksumLen]...)
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	bu := testUpdate()
+	msg, err := MarshalUpdate(&bu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got BgpInfo
+	version, err := UnmarshalMessage(msg, &got)
+	if err != nil || version != WireVersion {
+		t.Fatalf("version %d, err %v", version, err)
+	}
+	if !reflect.DeepEqual(got, bu) {
+		t.Fatalf("decoded %+v, want %+v", got, bu)
+	}
+	if typ := MessageType(msg); typ != MsgRouteUpdate {
+		t.Fatalf("type %d, want %d", typ, MsgRouteUpdate)
+	}
+
+	entry, err := MarshalTableEntry(&bu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnmarshalMessage(entry, &got); err != nil || MessageType(entry) != MsgTableEntry {
+		t.Fatalf("table entry: type %d, err %v", MessageType(entry), err)
+	}
+	for _, msg := range [][]byte{MarshalDumpRequest(), MarshalDumpEnd()} {
+		if _, err := UnmarshalMessage(msg, &got); err != nil || !reflect.DeepEqual(got, BgpInfo{}) {
+			t.Fatalf("message type %d: %+v, err %v", MessageType(msg), got, err)
+		}
+	}
+}
+
+func TestWireOptionalAndLaterFields(t *testing.T) {
+	bu := testUpdate()
+	msg, _ := MarshalUpdate(&bu)
+
+	// without the optional fields
+	var got BgpInfo
+	if _, err := UnmarshalMessage(reframe(msg, payloadOf(msg)[:updatePayloadV1]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Btime != bu.Btime || got.Peer_addr != 0 || got.New_attrs.As_path != nil {
+		t.Fatalf("v1 payload decoded as %+v", got)
+	}
+
+	// fields added later are skipped
+	longer := append(payloadOf(msg), 1, 2, 3, 4, 5)
+	if _, err := UnmarshalMessage(reframe(msg, longer), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, bu) {
+		t.Fatalf("decoded %+v with later fields, want %+v", got, bu)
+	}
+}
+
+func TestWireLegacy(t *testing.T) {
+	msg := make([]byte, LegacyLen)
+	le := binary.LittleEndian
+	le.PutUint32(msg[0:], BGP_ADD)
+	le.PutUint32(msg[32:], 0x0a000000)
+	le.PutUint32(msg[36:], 8)
+	le.PutUint32(msg[40:], 0xc0000201)
+	le.PutUint64(msg[56:], 1700000000)
+	var bu BgpInfo
+	version, err := UnmarshalMessage(msg, &bu)
+	if err != nil || version != 0 {
+		t.Fatalf("version %d, err %v", version, err)
+	}
+	if bu.Msg_type != BGP_ADD || bu.New_ip_addr != 0x0a000000 || bu.New_ip_prefix != 8 || bu.Btime != 1700000000 {
+		t.Fatalf("decoded %+v", bu)
+	}
+}
+
+func TestWireMalformed(t *testing.T) {
+	bu := testUpdate()
+	msg, _ := MarshalUpdate(&bu)
+	payload := payloadOf(msg)
+
+	bad_crc := append([]byte(nil), msg...)
+	bad_crc[HeaderLen+10] ^= 0xff
+
+	bad_version := append([]byte(nil), msg...)
+	bad_version[4] = WireVersion + 1
+	bad_version = sealMessage(bad_version)
+
+	bad_type := append([]byte(nil), msg...)
+	bad_type[5] = 9
+	bad_type = sealMessage(bad_type)
+
+	bad_length := append([]byte(nil), msg...)
+	binary.BigEndian.PutUint16(bad_length[6:], uint16(len(payload)+1))
+
+	dump_end := reframe(MarshalDumpEnd(), []byte{0})
+
+	short_payload := reframe(msg, payload[:updatePayloadV1-1])
+
+	// the AS path of the old route claims more ASNs than follow
+	long_path := append([]byte(nil), payload...)
+	binary.BigEndian.PutUint16(long_path[updatePayloadV1+8+6:], 1000)
+	long_path = reframe(msg, long_path)
+
+	// peer_addr without the rest of the optional fields
+	cut_attrs := reframe(msg, payload[:updatePayloadV1+4])
+
+	bad_msg_type := append([]byte(nil), payload...)
+	binary.BigEndian.PutUint32(bad_msg_type[0:], 7)
+	bad_msg_type = reframe(msg, bad_msg_type)
+
+	bad_prefix := append([]byte(nil), payload...)
+	binary.BigEndian.PutUint32(bad_prefix[4+routeLen+4:], 33)
+	bad_prefix = reframe(msg, bad_prefix)
+
+	cases := []struct {
+		name   string
+		msg    []byte
+		reason string
+	}{
+		{"empty", nil, "size"},
+		{"legacy size", make([]byte, LegacyLen-1), "size"},
+		{"header only", msg[:HeaderLen], "size"},
+		{"truncated", msg[:len(msg)-1], "size"},
+		{"checksum", bad_crc, "checksum"},
+		{"version", bad_version, "version"},
+		{"type", bad_type, "type"},
+		{"length", bad_length, "size"},
+		{"dump end payload", dump_end, "payload"},
+		{"short payload", short_payload, "payload"},
+		{"as path past the end", long_path, "payload"},
+		{"attributes cut", cut_attrs, "payload"},
+		{"msg_type", bad_msg_type, "msg_type"},
+		{"prefix", bad_prefix, "prefix"},
+	}
+	for _, c := range cases {
+		var got BgpInfo
+		_, err := UnmarshalMessage(c.msg, &got)
+		var we *WireError
+		if !errors.As(err, &we) {
+			t.Errorf("%s: err %v, want a WireError", c.name, err)
+			continue
+		}
+		if we.Reason != c.reason {
+			t.Errorf("%s: reason %q, want %q", c.name, we.Reason, c.reason)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	bu := testUpdate()
+	msg, _ := MarshalUpdate(&bu)
+	legacy := make([]byte, LegacyLen)
+	binary.LittleEndian.PutUint32(legacy, BGP_ADD)
+	stream := bytes.Join([][]byte{msg, MarshalDumpEnd(), legacy, msg}, nil)
+
+	r := bufio.NewReader(bytes.NewReader(stream))
+	for i, want := range [][]byte{msg, MarshalDumpEnd(), legacy, msg} {
+		got, err := ReadMessage(r)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("message %d: %d bytes, err %v", i, len(got), err)
+		}
+	}
+	if _, err := ReadMessage(r); err != io.EOF {
+		t.Fatalf("err %v at the end, want io.EOF", err)
+	}
+
+	// cut anywhere inside a message
+	for cut := 1; cut < len(msg); cut++ {
+		r := bufio.NewReader(bytes.NewReader(msg[:cut]))
+		if _, err := ReadMessage(r); err != io.ErrUnexpectedEOF {
+			t.Fatalf("cut at %d: err %v, want io.ErrUnexpectedEOF", cut, err)
+		}
+	}
+}
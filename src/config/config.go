@@ -0,0 +1,416 @@
+/*
+Typed configuration, loaded from the TOML file and validated as a whole.
+
+Unknown keys and missing required sections are errors, as are values breaking
+the timing constraints of the analysis:
+
+	delay > interval + loki_delay   a flow must be queued before UTIME-delay passes its end
+	syncdevi < agetime              of every window, or the pre and post windows overlap
+
+Every problem found is reported, not only the first one.
+*/
+package config
+
+import (
+	"anaflow/src/util"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+type Url struct {
+	Servers   []string `mapstructure:"servers"`
+	Base_path string   `mapstructure:"base_path"`
+}
+
+type QueryParams struct {
+	Interval      int64 `mapstructure:"interval"`
+	Loki_delay    int64 `mapstructure:"loki_delay"`
+	Limit_per_sec int64 `mapstructure:"limit_per_sec"`
+}
+
+type TimeSettings struct {
+	Delay    int64 `mapstructure:"delay"`
+	Agetime  int64 `mapstructure:"agetime"`
+	Syncdevi int64 `mapstructure:"syncdevi"`
+}
+
+type WindowOverride struct {
+	Prefix  string  `mapstructure:"prefix"`
+	Peer    string  `mapstructure:"peer"`
+	Windows []int64 `mapstructure:"windows"`
+}
+
+type Windows struct {
+	Agetimes []int64          `mapstructure:"agetimes"`
+	Override []WindowOverride `mapstructure:"override"`
+}
+
+type AlertRule struct {
+	Name            string   `mapstructure:"name"`
+	Min_bytes       uint64   `mapstructure:"min_bytes"`
+	Min_dsts        int      `mapstructure:"min_dsts"`
+	Blackhole_bytes uint64   `mapstructure:"blackhole_bytes"`
+	Watchlist       []string `mapstructure:"watchlist"`
+}
+
+type Alerts struct {
+	Webhooks   []string    `mapstructure:"webhooks"`
+	Retries    int         `mapstructure:"retries"`
+	Dedup      int64       `mapstructure:"dedup"`
+	Rate_limit int         `mapstructure:"rate_limit"`
+	Rule       []AlertRule `mapstructure:"rule"`
+}
+
+type Receiver struct {
+	Unix_stream   string `mapstructure:"unix_stream"`
+	Tcp_listen    string `mapstructure:"tcp_listen"`
+	Tls_cert      string `mapstructure:"tls_cert"`
+	Tls_key       string `mapstructure:"tls_key"`
+	Tls_client_ca string `mapstructure:"tls_client_ca"`
+	Max_pending   int    `mapstructure:"max_pending"`
+}
+
+type BgpNeighbor struct {
+	Address string `mapstructure:"address"`
+	Asn     int64  `mapstructure:"asn"`
+}
+
+type Speaker struct {
+	Listen    string        `mapstructure:"listen"`
+	Asn       int64         `mapstructure:"asn"`
+	Router_id string        `mapstructure:"router_id"`
+	Hold_time int64         `mapstructure:"hold_time"`
+	Neighbor  []BgpNeighbor `mapstructure:"neighbor"`
+}
+
+type Feed struct {
+	Format string `mapstructure:"format"`
+	Path   string `mapstructure:"path"`
+	Socket string `mapstructure:"socket"`
+}
+
+type Rib struct {
+	View          bool   `mapstructure:"view"`
+	Mrt_file      string `mapstructure:"mrt_file"`
+	Birdc_file    string `mapstructure:"birdc_file"`
+	Birdc_command string `mapstructure:"birdc_command"`
+	Dump_request  bool   `mapstructure:"dump_request"`
+}
+
+type Approximate struct {
+	Enabled       bool  `mapstructure:"enabled"`
+	Memory_mb     int64 `mapstructure:"memory_mb"`
+	Depth         int   `mapstructure:"depth"`
+	Heavy_hitters int   `mapstructure:"heavy_hitters"`
+}
+
+type Queues struct {
+	Max_flows   int    `mapstructure:"max_flows"`
+	Max_updates int    `mapstructure:"max_updates"`
+	Policy      string `mapstructure:"policy"`
+	Sample_rate int    `mapstructure:"sample_rate"`
+}
+
+type Config struct {
+	Url           Url          `mapstructure:"url"`
+	Query_params  QueryParams  `mapstructure:"query_params"`
+	Time_settings TimeSettings `mapstructure:"time_settings"`
+
+	Rollup struct {
+		Bucket int64 `mapstructure:"bucket"`
+	} `mapstructure:"rollup"`
+	Convergence struct {
+		Fraction float64 `mapstructure:"fraction"`
+		Smooth   int64   `mapstructure:"smooth"`
+	} `mapstructure:"convergence"`
+	Event struct {
+		Gap int64 `mapstructure:"gap"`
+	} `mapstructure:"event"`
+	Topn struct {
+		N               int     `mapstructure:"n"`
+		Windows         []int64 `mapstructure:"windows"`
+		Report_interval int64   `mapstructure:"report_interval"`
+	} `mapstructure:"topn"`
+	Windows    Windows `mapstructure:"windows"`
+	Checkpoint struct {
+		File     string `mapstructure:"file"`
+		Interval int64  `mapstructure:"interval"`
+	} `mapstructure:"checkpoint"`
+	Output struct {
+		Flush_interval int64 `mapstructure:"flush_interval"`
+	} `mapstructure:"output"`
+	Shutdown struct {
+		Drain bool `mapstructure:"drain"`
+	} `mapstructure:"shutdown"`
+	Api struct {
+		Listen string `mapstructure:"listen"`
+	} `mapstructure:"api"`
+	Store struct {
+		Path string `mapstructure:"path"`
+	} `mapstructure:"store"`
+	Receiver    Receiver    `mapstructure:"receiver"`
+	Speaker     Speaker     `mapstructure:"speaker"`
+	Feed        []Feed      `mapstructure:"feed"`
+	Rib         Rib         `mapstructure:"rib"`
+	Approximate Approximate `mapstructure:"approximate"`
+	Queues      Queues      `mapstructure:"queues"`
+	Alerts      Alerts      `mapstructure:"alerts"`
+}
+
+// Keys that must be present, the other ones have the defaults below
+var required = []string{
+	"url.servers",
+	"url.base_path",
+	"query_params.interval",
+	"query_params.loki_delay",
+	"query_params.limit_per_sec",
+	"time_settings.delay",
+	"time_settings.agetime",
+	"time_settings.syncdevi",
+}
+
+var defaults = map[string]interface{}{
+	"rollup.bucket":             300,
+	"convergence.fraction":      0.9,
+	"convergence.smooth":        10,
+	"event.gap":                 5,
+	"topn.n":                    10,
+	"topn.windows":              []int64{300, 3600, 86400},
+	"topn.report_interval":      300,
+	"speaker.hold_time":         90,
+	"approximate.memory_mb":     64,
+	"approximate.depth":         4,
+	"approximate.heavy_hitters": 16,
+	"queues.max_flows":          10000000,
+	"queues.max_updates":        1000000,
+	"queues.policy":             "drop_oldest",
+	"queues.sample_rate":        10,
+}
+
+// Read and validate the config file
+func Load(path string) (*Config, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	var errs []error
+	missing := make(map[string]bool)
+	for _, key := range required {
+		if v.IsSet(key) {
+			continue
+		}
+		section := key[:strings.IndexByte(key, '.')]
+		if !v.IsSet(section) {
+			if !missing[section] {
+				errs = append(errs, fmt.Errorf("missing section [%s]", section))
+			}
+		} else {
+			errs = append(errs, fmt.Errorf("missing key %s", key))
+		}
+		missing[section] = true
+	}
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+
+	// the known keys are decoded even if there are unknown ones
+	cfg := new(Config)
+	decoded := true
+	if err := v.UnmarshalExact(cfg); err != nil {
+		var derr *mapstructure.Error
+		if !errors.As(err, &derr) {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+		for _, e := range derr.Errors {
+			decoded = decoded && strings.Contains(e, "has invalid keys")
+			errs = append(errs, errors.New(e))
+		}
+	}
+	if decoded && len(missing) == 0 {
+		errs = append(errs, cfg.validate()...)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("config %s:\n%w", path, errors.Join(errs...))
+	}
+	return cfg, nil
+}
+
+// Agetimes of all windows, time_settings.agetime first
+func (c *Config) WindowAgetimes() []int64 {
+	agetimes := []int64{c.Time_settings.Agetime}
+	for _, a := range c.Windows.Agetimes {
+		dup := false
+		for _, b := range agetimes {
+			dup = dup || a == b
+		}
+		if !dup {
+			agetimes = append(agetimes, a)
+		}
+	}
+	return agetimes
+}
+
+func checkURL(key string, s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: %q is not an http(s)://host[:port] URL", key, s)
+	}
+	return nil
+}
+
+func (c *Config) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(len(c.Url.Servers) > 0, "url.servers: no Loki server")
+	for _, s := range c.Url.Servers {
+		if err := checkURL("url.servers", s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	check(strings.HasPrefix(c.Url.Base_path, "/"), "url.base_path: %q must start with /", c.Url.Base_path)
+
+	q := &c.Query_params
+	t := &c.Time_settings
+	check(q.Interval > 0, "query_params.interval must be > 0, got %d", q.Interval)
+	check(q.Loki_delay >= 0, "query_params.loki_delay must be >= 0, got %d", q.Loki_delay)
+	check(q.Limit_per_sec > 0, "query_params.limit_per_sec must be > 0, got %d", q.Limit_per_sec)
+	check(t.Delay > q.Interval+q.Loki_delay,
+		"time_settings.delay (%d) must be > query_params.interval + query_params.loki_delay (%d + %d), or the flows arrive after their window is analysed",
+		t.Delay, q.Interval, q.Loki_delay)
+	check(t.Syncdevi >= 0, "time_settings.syncdevi must be >= 0, got %d", t.Syncdevi)
+
+	agetimes := c.WindowAgetimes()
+	for _, a := range agetimes {
+		check(a > t.Syncdevi, "window agetime %d must be > time_settings.syncdevi (%d)", a, t.Syncdevi)
+	}
+	for i, o := range c.Windows.Override {
+		check(o.Prefix != "" || o.Peer != "", "windows.override[%d]: needs a prefix or a peer", i)
+		if o.Prefix != "" {
+			_, err := util.ParseRoute(o.Prefix)
+			check(err == nil, "windows.override[%d]: prefix %q: %v", i, o.Prefix, err)
+		}
+		if o.Peer != "" {
+			ip := net.ParseIP(o.Peer)
+			check(ip != nil && ip.To4() != nil, "windows.override[%d]: peer %q is not an IPv4 address", i, o.Peer)
+		}
+		for _, w := range o.Windows {
+			found := false
+			for _, a := range agetimes {
+				found = found || a == w
+			}
+			check(found, "windows.override[%d]: window %d is not one of the agetimes %v", i, w, agetimes)
+		}
+	}
+
+	check(c.Rollup.Bucket > 0, "rollup.bucket must be > 0, got %d", c.Rollup.Bucket)
+	check(c.Convergence.Fraction > 0 && c.Convergence.Fraction <= 1, "convergence.fraction must be in (0, 1], got %g", c.Convergence.Fraction)
+	check(c.Convergence.Smooth > 0, "convergence.smooth must be > 0, got %d", c.Convergence.Smooth)
+	check(c.Event.Gap >= 0, "event.gap must be >= 0, got %d", c.Event.Gap)
+	check(c.Topn.N > 0, "topn.n must be > 0, got %d", c.Topn.N)
+	for _, w := range c.Topn.Windows {
+		check(w > 0, "topn.windows must be > 0, got %d", w)
+	}
+	check(c.Topn.Report_interval > 0, "topn.report_interval must be > 0, got %d", c.Topn.Report_interval)
+	check(c.Checkpoint.Interval >= 0, "checkpoint.interval must be >= 0, got %d", c.Checkpoint.Interval)
+	check(c.Output.Flush_interval >= 0, "output.flush_interval must be >= 0, got %d", c.Output.Flush_interval)
+
+	if c.Api.Listen != "" {
+		_, _, err := net.SplitHostPort(c.Api.Listen)
+		check(err == nil, "api.listen: %v", err)
+	}
+
+	r := &c.Receiver
+	if r.Tcp_listen != "" {
+		_, _, err := net.SplitHostPort(r.Tcp_listen)
+		check(err == nil, "receiver.tcp_listen: %v", err)
+	}
+	check((r.Tls_cert == "") == (r.Tls_key == ""), "receiver.tls_cert and receiver.tls_key go together")
+	check(r.Tls_cert == "" || r.Tcp_listen != "", "receiver.tls_cert: TLS needs receiver.tcp_listen")
+	check(r.Tls_client_ca == "" || r.Tls_cert != "", "receiver.tls_client_ca: client certificates need receiver.tls_cert")
+	check(r.Max_pending >= 0, "receiver.max_pending must be >= 0, got %d", r.Max_pending)
+
+	if sp := &c.Speaker; sp.Listen != "" {
+		_, _, err := net.SplitHostPort(sp.Listen)
+		check(err == nil, "speaker.listen: %v", err)
+		check(sp.Asn > 0 && sp.Asn <= 0xffffffff, "speaker.asn must be in [1, 4294967295], got %d", sp.Asn)
+		ip := net.ParseIP(sp.Router_id)
+		check(ip != nil && ip.To4() != nil, "speaker.router_id %q is not an IPv4 address", sp.Router_id)
+		check(sp.Hold_time == 0 || (sp.Hold_time >= 3 && sp.Hold_time <= 0xffff), "speaker.hold_time must be 0 or in [3, 65535], got %d", sp.Hold_time)
+		check(len(sp.Neighbor) > 0, "speaker.neighbor: no neighbor, the speaker only accepts configured peers")
+		addrs := make(map[string]bool)
+		for i, n := range sp.Neighbor {
+			ip := net.ParseIP(n.Address)
+			check(ip != nil && ip.To4() != nil, "speaker.neighbor[%d]: address %q is not an IPv4 address", i, n.Address)
+			check(!addrs[n.Address], "speaker.neighbor[%d]: duplicate address %s", i, n.Address)
+			addrs[n.Address] = true
+			check(n.Asn > 0 && n.Asn <= 0xffffffff, "speaker.neighbor[%d]: asn must be in [1, 4294967295], got %d", i, n.Asn)
+		}
+	}
+
+	for i, f := range c.Feed {
+		check(f.Format == "exabgp" || f.Format == "gobgp", "feed[%d]: format %q is not exabgp or gobgp", i, f.Format)
+		check((f.Path == "") != (f.Socket == ""), "feed[%d]: needs either a path or a socket", i)
+	}
+
+	rib := &c.Rib
+	tables := 0
+	for _, t := range []string{rib.Mrt_file, rib.Birdc_file, rib.Birdc_command} {
+		if t != "" {
+			tables++
+		}
+	}
+	check(tables <= 1, "rib: mrt_file, birdc_file and birdc_command exclude each other")
+	check(!rib.Dump_request || r.Unix_stream != "" || r.Tcp_listen != "",
+		"rib.dump_request: needs receiver.unix_stream or receiver.tcp_listen")
+
+	if ap := &c.Approximate; ap.Enabled {
+		check(ap.Memory_mb > 0, "approximate.memory_mb must be > 0, got %d", ap.Memory_mb)
+		check(ap.Depth >= 1 && ap.Depth <= 8, "approximate.depth must be in [1, 8], got %d", ap.Depth)
+		check(ap.Heavy_hitters > 0, "approximate.heavy_hitters must be > 0, got %d", ap.Heavy_hitters)
+	}
+
+	qu := &c.Queues
+	check(qu.Max_flows >= 0, "queues.max_flows must be >= 0, got %d", qu.Max_flows)
+	check(qu.Max_updates >= 0, "queues.max_updates must be >= 0, got %d", qu.Max_updates)
+	if _, err := util.ParseOverloadPolicy(qu.Policy); err != nil {
+		errs = append(errs, fmt.Errorf("queues.policy: %w", err))
+	}
+	check(qu.Sample_rate >= 1, "queues.sample_rate must be >= 1, got %d", qu.Sample_rate)
+
+	a := &c.Alerts
+	for _, w := range a.Webhooks {
+		if err := checkURL("alerts.webhooks", w); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	check(a.Retries >= 0, "alerts.retries must be >= 0, got %d", a.Retries)
+	check(a.Dedup >= 0, "alerts.dedup must be >= 0, got %d", a.Dedup)
+	check(a.Rate_limit >= 0, "alerts.rate_limit must be >= 0, got %d", a.Rate_limit)
+	names := make(map[string]bool)
+	for i, r := range a.Rule {
+		check(r.Name != "", "alerts.rule[%d]: needs a name", i)
+		check(!names[r.Name], "alerts.rule[%d]: duplicate name %q", i, r.Name)
+		names[r.Name] = true
+		for _, p := range r.Watchlist {
+			_, err := util.ParseRoute(p)
+			check(err == nil, "alerts.rule %s: watchlist %q: %v", r.Name, p, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+/*
+Hot reload.
+
+The flow and route state is laid out for the windows it was built with: the
+cursors of the flow queues sit agetime and syncdevi apart, and the rollup and
+ranking buckets have a fixed length. Settings like these are kept at the
+value the process started with, the rest of a reloaded file is applied.
+*/
+
+// Settings that need a restart to change
+func fixed(c *Config) []struct {
+	name  string
+	value interface{}
+} {
+	return []struct {
+		name  string
+		value interface{}
+	}{
+		{"time_settings", &c.Time_settings},
+		{"windows", &c.Windows},
+		{"rollup.bucket", &c.Rollup.Bucket},
+		{"topn.windows", &c.Topn.Windows},
+		{"checkpoint.file", &c.Checkpoint.File},
+		{"api.listen", &c.Api.Listen},
+		{"receiver", &c.Receiver},
+		{"speaker", &c.Speaker},
+		{"feed", &c.Feed},
+		{"rib", &c.Rib},
+		{"approximate", &c.Approximate},
+		{"queues", &c.Queues},
+	}
+}
+
+// Load the config file again on top of the running config c. The fixed
+// settings keep their running value, a message tells about every one that
+// changed in the file. The new config is rejected as a whole if it is invalid.
+func Reload(c *Config, path string) (*Config, []string, error) {
+	n, err := Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var kept []string
+	old := fixed(c)
+	for i, f := range fixed(n) {
+		ov := reflect.ValueOf(old[i].value).Elem()
+		nv := reflect.ValueOf(f.value).Elem()
+		if reflect.DeepEqual(ov.Interface(), nv.Interface()) {
+			continue
+		}
+		kept = append(kept, fmt.Sprintf("%s changed from %+v to %+v, which needs a restart: keeping %+v",
+			f.name, ov.Interface(), nv.Interface(), ov.Interface()))
+		nv.Set(ov)
+	}
+
+	// the reloadable settings must still fit the kept ones
+	if errs := n.validate(); len(errs) > 0 {
+		return nil, kept, fmt.Errorf("config %s:\n%w", path, errors.Join(errs...))
+	}
+	return n, kept, nil
+}
+
+// Call fn every time the config file is written, renamed over or recreated
+func Watch(path string, fn func()) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.OnConfigChange(func(fsnotify.Event) { fn() })
+	v.WatchConfig()
+}
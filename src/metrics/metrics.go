@@ -0,0 +1,191 @@
+/*
+Minimal metrics in the Prometheus text exposition format.
+
+Counters and histograms are updated on the hot paths with atomics or a short
+lock, gauge functions are evaluated at scrape time. Metrics are written in the
+order they were registered.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Counters sharing a name, one per combination of label values
+type CounterVec struct {
+	labels   []string
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+func (cv *CounterVec) With(values ...string) *Counter {
+	key := strings.Join(values, "\xff")
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+
+	c, ok := cv.counters[key]
+	if !ok {
+		c = new(Counter)
+		cv.counters[key] = c
+	}
+	return c
+}
+
+type Histogram struct {
+	bounds []float64
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Called at scrape time, emits one sample per call of emit
+type GaugeFunc func(emit func(value float64, label_values ...string))
+
+type entry struct {
+	name  string
+	help  string
+	typ   string
+	write func(w io.Writer, name string)
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	entries []entry
+}
+
+var Default = &Registry{}
+
+func (r *Registry) add(name string, help string, typ string, write func(w io.Writer, name string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry{name, help, typ, write})
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+		pairs[i] = fmt.Sprintf(`%s="%s"`, n, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := new(Counter)
+	r.add(name, help, "counter", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %d\n", name, c.Value())
+	})
+	return c
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{labels: labels, counters: make(map[string]*Counter)}
+	r.add(name, help, "counter", func(w io.Writer, name string) {
+		cv.mu.Lock()
+		keys := make([]string, 0, len(cv.counters))
+		for k := range cv.counters {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(cv.labels, strings.Split(k, "\xff")), cv.counters[k].Value())
+		}
+		cv.mu.Unlock()
+	})
+	return cv
+}
+
+// bounds must be sorted, +Inf is added implicitly
+func (r *Registry) NewHistogram(name string, help string, bounds []float64) *Histogram {
+	h := &Histogram{bounds: append(bounds, math.Inf(1))}
+	h.counts = make([]uint64, len(h.bounds))
+	r.add(name, help, "histogram", func(w io.Writer, name string) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for i, b := range h.bounds {
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+	})
+	return h
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, labels []string, f GaugeFunc) {
+	r.add(name, help, "gauge", func(w io.Writer, name string) {
+		f(func(value float64, label_values ...string) {
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, label_values), formatFloat(value))
+		})
+	})
+}
+
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	entries := make([]entry, len(r.entries))
+	copy(entries, r.entries)
+	r.mu.Unlock()
+
+	for _, e := range entries {
+		fmt.Fprintf(w, "# HELP %s %s\n", e.name, e.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", e.name, e.typ)
+		e.write(w, e.name)
+	}
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
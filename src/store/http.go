@@ -0,0 +1,98 @@
+package store
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/util"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Accepts unix seconds, RFC3339 or a date
+func parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Unix(), nil
+}
+
+func parseType(s string) (int32, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "add":
+		return bgp.BGP_ADD, nil
+	case "delete":
+		return bgp.BGP_DELETE, nil
+	case "update":
+		return bgp.BGP_UPDATE, nil
+	}
+	return 0, fmt.Errorf("invalid update type %q", s)
+}
+
+// Build a Query from from, to, prefix, dst, type, limit and details
+func ParseQuery(v url.Values) (Query, error) {
+	var q Query
+	var err error
+	if q.From, err = parseTime(v.Get("from")); err != nil {
+		return q, err
+	}
+	if q.To, err = parseTime(v.Get("to")); err != nil {
+		return q, err
+	}
+	if p := v.Get("prefix"); p != "" {
+		if q.Route, err = util.ParseRoute(p); err != nil {
+			return q, err
+		}
+	}
+	if d := v.Get("dst"); d != "" {
+		q.Dst = util.IPbyte2int([]byte(d))
+	}
+	if q.Type, err = parseType(v.Get("type")); err != nil {
+		return q, err
+	}
+	if l := v.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil {
+			return q, err
+		}
+	}
+	q.Details = v.Get("details") == "1" || v.Get("details") == "true"
+	return q, nil
+}
+
+// GET ?from=&to=&prefix=&dst=&type=&limit=&details=
+func (s *Store) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := ParseQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Limit == 0 {
+			q.Limit = 1000
+		}
+		records, err := s.Query(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if records == nil {
+			records = []Record{}
+		}
+		util.CheckError(json.NewEncoder(w).Encode(records))
+	})
+}
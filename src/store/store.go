@@ -0,0 +1,308 @@
+/*
+Persistent scope history in an embedded bbolt file.
+
+Every handled update is stored with its summary and its per-destination detail
+records, every routing event with its summary. Updates are keyed by Btime and a
+sequence number, and indexed by route, destination and update type, so that
+"what did updates to 10.0.0.0/8 do last Tuesday" is a range scan. Events are
+keyed by the Btime of their last update.
+
+Buckets:
+
+	updates    btime | seq                  -> JSON Record
+	details    btime | seq | dst            -> JSON bgp.IpLogInfo
+	idx_route  route | btime | seq          -> nil
+	idx_dst    dst | btime | seq            -> nil
+	idx_type   type | btime | seq           -> nil
+	events     end | seq                    -> JSON bgp.EventSummary
+*/
+package store
+
+import (
+	"anaflow/src/bgp"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketUpdates  = []byte("updates")
+	bucketDetails  = []byte("details")
+	bucketIdxRoute = []byte("idx_route")
+	bucketIdxDst   = []byte("idx_dst")
+	bucketIdxType  = []byte("idx_type")
+	bucketEvents   = []byte("events")
+)
+
+// Records are committed in one transaction once this many are pending
+const maxPending = 4096
+
+type Record struct {
+	Update  bgp.BgpInfo       `json:"update"`
+	Summary bgp.UpdateSummary `json:"summary"`
+	Details []bgp.IpLogInfo   `json:"details,omitempty"`
+}
+
+type Store struct {
+	db      *bolt.DB
+	mu      sync.Mutex
+	pending []Record
+	events  []bgp.EventSummary
+}
+
+func Open(path string, readonly bool) (*Store, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: readonly})
+	if err != nil {
+		return nil, err
+	}
+	if !readonly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, b := range [][]byte{bucketUpdates, bucketDetails, bucketIdxRoute, bucketIdxDst, bucketIdxType, bucketEvents} {
+				if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &Store{db: db}, nil
+}
+
+// Buffer the update, it is written by the next Flush
+func (s *Store) OnUpdate(bu *bgp.BgpInfo, sum *bgp.UpdateSummary, details []bgp.IpLogInfo) {
+	s.mu.Lock()
+	s.pending = append(s.pending, Record{*bu, *sum, details})
+	full := len(s.pending) >= maxPending
+	s.mu.Unlock()
+
+	if full {
+		s.Flush()
+	}
+}
+
+// Buffer the event, it is written by the next Flush
+func (s *Store) OnEvent(ev *bgp.EventSummary) {
+	s.mu.Lock()
+	s.events = append(s.events, *ev)
+	full := len(s.events) >= maxPending
+	s.mu.Unlock()
+
+	if full {
+		s.Flush()
+	}
+}
+
+func updateKey(btime int64, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(btime))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	records := s.pending
+	s.pending = nil
+	events := s.events
+	s.events = nil
+	s.mu.Unlock()
+	if len(records) == 0 && len(events) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		event_bucket := tx.Bucket(bucketEvents)
+		for i := range events {
+			seq, err := event_bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(&events[i])
+			if err != nil {
+				return err
+			}
+			if err := event_bucket.Put(updateKey(events[i].End, seq), value); err != nil {
+				return err
+			}
+		}
+
+		updates := tx.Bucket(bucketUpdates)
+		details := tx.Bucket(bucketDetails)
+		idx_route := tx.Bucket(bucketIdxRoute)
+		idx_dst := tx.Bucket(bucketIdxDst)
+		idx_type := tx.Bucket(bucketIdxType)
+		for i := range records {
+			r := &records[i]
+			seq, err := updates.NextSequence()
+			if err != nil {
+				return err
+			}
+			key := updateKey(r.Summary.Btime, seq)
+
+			d := r.Details
+			r.Details = nil
+			value, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err := updates.Put(key, value); err != nil {
+				return err
+			}
+			if err := idx_route.Put(concat(u64(r.Summary.Route), key), nil); err != nil {
+				return err
+			}
+			if err := idx_type.Put(concat([]byte{byte(r.Summary.Msg_type)}, key), nil); err != nil {
+				return err
+			}
+			for _, info := range d {
+				value, err := json.Marshal(info)
+				if err != nil {
+					return err
+				}
+				if err := details.Put(concat(key, u32(info.DstIp)), value); err != nil {
+					return err
+				}
+				if err := idx_dst.Put(concat(u32(info.DstIp), key), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) Close() error {
+	err := s.Flush()
+	if e := s.db.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Zero fields are not filtered on. Route selects the updates of routes equal to
+// or more specific than it.
+type Query struct {
+	From    int64
+	To      int64
+	Route   uint64
+	Dst     uint32
+	Type    int32
+	Limit   int
+	Details bool
+}
+
+func (q *Query) inTime(btime int64) bool {
+	return (q.From == 0 || btime >= q.From) && (q.To == 0 || btime <= q.To)
+}
+
+// Scan the index keys in [lo, hi] and return the update keys they point to
+func scanIndex(b *bolt.Bucket, lo []byte, hi []byte, prefix_len int, q *Query) [][]byte {
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(lo); k != nil && bytes.Compare(k, hi) <= 0; k, _ = c.Next() {
+		key := k[prefix_len:]
+		if !q.inTime(int64(binary.BigEndian.Uint64(key))) {
+			continue
+		}
+		keys = append(keys, append([]byte(nil), key...))
+	}
+	return keys
+}
+
+func (s *Store) Query(q Query) ([]Record, error) {
+	var records []Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var keys [][]byte
+		from := updateKey(q.From, 0)
+		to := updateKey(q.To, ^uint64(0))
+		if q.To == 0 {
+			to = updateKey(int64(^uint64(0)>>1), ^uint64(0))
+		}
+
+		switch {
+		case q.Route != 0:
+			// routes inside the prefix sort between its first and last address
+			plen := q.Route & 0xff
+			ip := q.Route >> 8
+			last := ip | (1<<(32-plen) - 1)
+			keys = scanIndex(tx.Bucket(bucketIdxRoute), u64(q.Route), concat(u64(last<<8|0xff), to), 8, &q)
+		case q.Dst != 0:
+			keys = scanIndex(tx.Bucket(bucketIdxDst), concat(u32(q.Dst), from), concat(u32(q.Dst), to), 4, &q)
+		case q.Type != 0:
+			t := []byte{byte(q.Type)}
+			keys = scanIndex(tx.Bucket(bucketIdxType), concat(t, from), concat(t, to), 1, &q)
+		default:
+			c := tx.Bucket(bucketUpdates).Cursor()
+			for k, _ := c.Seek(from); k != nil && bytes.Compare(k, to) <= 0; k, _ = c.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+		}
+
+		// oldest first, whatever index was used
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+		updates := tx.Bucket(bucketUpdates)
+		details := tx.Bucket(bucketDetails)
+		for _, key := range keys {
+			var r Record
+			if err := json.Unmarshal(updates.Get(key), &r); err != nil {
+				return err
+			}
+			if (q.Type != 0 && r.Summary.Msg_type != q.Type) || (q.Route != 0 && !routeIn(r.Summary.Route, q.Route)) {
+				continue
+			}
+			if q.Details || q.Dst != 0 {
+				c := details.Cursor()
+				for k, v := c.Seek(key); k != nil && bytes.HasPrefix(k, key); k, v = c.Next() {
+					var info bgp.IpLogInfo
+					if err := json.Unmarshal(v, &info); err != nil {
+						return err
+					}
+					if q.Dst == 0 || info.DstIp == q.Dst {
+						r.Details = append(r.Details, info)
+					}
+				}
+			}
+			records = append(records, r)
+			if q.Limit > 0 && len(records) >= q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Whether route a is equal to or more specific than route b
+func routeIn(a uint64, b uint64) bool {
+	pb := b & 0xff
+	if a&0xff < pb {
+		return false
+	}
+	return a>>8>>(32-pb) == b>>8>>(32-pb)
+}
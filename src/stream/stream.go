@@ -0,0 +1,255 @@
+/*
+Live stream of the scope results over Server-Sent Events.
+
+Each handled update is sent as an "update" event carrying its summary, followed
+by one "detail" event per destination record. Each routing event is sent as an
+"event" event carrying its summary. Clients filter with query parameters:
+
+	GET /api/stream?prefix=10.0.0.0/8&as=64512&observer=192.0.2.1&min_bytes=1000000
+
+prefix keeps the updates of routes inside it, as keeps the updates whose first
+hop is the AS and the records whose destination is in it, observer keeps the
+records reported by that router and min_bytes drops smaller updates and records.
+Routing events span many routes and destinations: a client filtering on prefix
+or observer gets none, as and min_bytes apply to their first hop and moved bytes.
+A client that cannot keep up loses events rather than slowing the analysis down.
+*/
+package stream
+
+import (
+	"anaflow/src/bgp"
+	"anaflow/src/metrics"
+	"anaflow/src/util"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const clientBuffer = 256
+const heartbeat = 15 * time.Second
+
+var droppedEvents = metrics.Default.NewCounter("anaflow_stream_dropped_events_total",
+	"Events not sent to a stream client because its buffer was full.")
+
+type Filter struct {
+	Route    uint64 // 0 for any
+	Asn      int64  // -1 for any
+	Observer uint32 // 0 for any
+	MinBytes uint64
+}
+
+type event struct {
+	name string
+	data []byte
+}
+
+type client struct {
+	filter Filter
+	events chan event
+}
+
+type Hub struct {
+	mu      sync.Mutex
+	clients map[*client]bool
+	closed  bool
+}
+
+func NewHub() *Hub {
+	return &Hub{clients: make(map[*client]bool)}
+}
+
+func routeIn(a uint64, b uint64) bool {
+	pb := b & 0xff
+	if a&0xff < pb {
+		return false
+	}
+	return a>>8>>(32-pb) == b>>8>>(32-pb)
+}
+
+func detailBytes(d *bgp.IpLogInfo) uint64 {
+	if d.PostFlow > d.PriFlow {
+		return d.PostFlow
+	}
+	return d.PriFlow
+}
+
+// Records of the update that pass the filter, and whether the update does
+func (f *Filter) apply(bu *bgp.BgpInfo, sum *bgp.UpdateSummary, details []bgp.IpLogInfo) ([]bgp.IpLogInfo, bool) {
+	if f.Route != 0 && !routeIn(sum.Route, f.Route) {
+		return nil, false
+	}
+	if sum.Moved < f.MinBytes {
+		return nil, false
+	}
+	asn_match := f.Asn < 0 || int64(bu.New_first_asn) == f.Asn || int64(bu.Old_first_asn) == f.Asn
+
+	var passed []bgp.IpLogInfo
+	for i := range details {
+		d := &details[i]
+		if f.Observer != 0 && d.Observer != f.Observer {
+			continue
+		}
+		if !asn_match && int64(d.DstAs) != f.Asn {
+			continue
+		}
+		if detailBytes(d) < f.MinBytes {
+			continue
+		}
+		passed = append(passed, *d)
+	}
+	if (f.Observer != 0 || !asn_match) && len(passed) == 0 {
+		return nil, false
+	}
+	return passed, true
+}
+
+func mustJSON(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	util.CheckError(err)
+	return data
+}
+
+func (h *Hub) OnUpdate(bu *bgp.BgpInfo, sum *bgp.UpdateSummary, details []bgp.IpLogInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		return
+	}
+
+	summary := mustJSON(sum)
+	for c := range h.clients {
+		passed, ok := c.filter.apply(bu, sum, details)
+		if !ok {
+			continue
+		}
+		events := []event{{"update", summary}}
+		for i := range passed {
+			events = append(events, event{"detail", mustJSON(&passed[i])})
+		}
+		for _, e := range events {
+			select {
+			case c.events <- e:
+			default:
+				droppedEvents.Inc()
+			}
+		}
+	}
+}
+
+func (h *Hub) OnEvent(ev *bgp.EventSummary) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		return
+	}
+
+	data := mustJSON(ev)
+	for c := range h.clients {
+		f := &c.filter
+		if f.Route != 0 || f.Observer != 0 || ev.Moved < f.MinBytes || (f.Asn >= 0 && int64(ev.First_asn) != f.Asn) {
+			continue
+		}
+		select {
+		case c.events <- event{"event", data}:
+		default:
+			droppedEvents.Inc()
+		}
+	}
+}
+
+func (h *Hub) Flush() error {
+	return nil
+}
+
+// Disconnect every client
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for c := range h.clients {
+		close(c.events)
+		delete(h.clients, c)
+	}
+	return nil
+}
+
+func ParseFilter(r *http.Request) (Filter, error) {
+	f := Filter{Asn: -1}
+	q := r.URL.Query()
+	var err error
+	if p := q.Get("prefix"); p != "" {
+		if f.Route, err = util.ParseRoute(p); err != nil {
+			return f, err
+		}
+	}
+	if a := q.Get("as"); a != "" {
+		if f.Asn, err = strconv.ParseInt(a, 10, 64); err != nil {
+			return f, err
+		}
+	}
+	if o := q.Get("observer"); o != "" {
+		f.Observer = util.IPbyte2int([]byte(o))
+	}
+	if m := q.Get("min_bytes"); m != "" {
+		if f.MinBytes, err = strconv.ParseUint(m, 10, 64); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := &client{filter: filter, events: make(chan event, clientBuffer)}
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	h.clients[c] = true
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		if h.clients[c] {
+			delete(h.clients, c)
+			close(c.events)
+		}
+		h.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case e, ok := <-c.events:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,146 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+)
+
+/*
+Bounded queues.
+
+A queue with a capacity sheds values instead of growing past it, so that a
+slow consumer cannot exhaust the memory. What CsPush does once the queue is
+full depends on the overload policy:
+
+	block        wait until the consumer makes room, which blocks the source
+	drop_oldest  drop the oldest value not consumed yet, or the pushed one if
+	             every queued value is in use
+	sample       from 3/4 of the capacity on keep one push in Sample, at the
+	             capacity drop them all. A kept flow counts for the ones
+	             dropped: its size is multiplied by Sample.
+
+A closed queue refuses every push and releases the blocked ones, so that the
+sources can stop.
+*/
+
+type OverloadPolicy int
+
+const (
+	OVERLOAD_BLOCK OverloadPolicy = iota
+	OVERLOAD_DROP_OLDEST
+	OVERLOAD_SAMPLE
+)
+
+var overloadNames = []string{"block", "drop_oldest", "sample"}
+
+func (p OverloadPolicy) String() string {
+	if int(p) < len(overloadNames) {
+		return overloadNames[p]
+	}
+	return fmt.Sprintf("OverloadPolicy(%d)", int(p))
+}
+
+func ParseOverloadPolicy(s string) (OverloadPolicy, error) {
+	for i, n := range overloadNames {
+		if n == s {
+			return OverloadPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overload policy %q, want one of %v", s, overloadNames)
+}
+
+// Capacity 0 leaves the queue unbounded
+type Bound struct {
+	Capacity int
+	Policy   OverloadPolicy
+	Sample   int    // OVERLOAD_SAMPLE keeps one push in Sample
+	Shed     func() // called for every value dropped, with the queue locked
+	Blocked  func() // called for every push that had to wait
+}
+
+// Admission state of a queue, guarded by the queue mutex
+type bound struct {
+	Bound
+	room   *sync.Cond // signalled on pops, for OVERLOAD_BLOCK
+	seen   int        // pushes while sampling
+	closed bool
+}
+
+func (b *bound) setBound(nb Bound, mu *sync.Mutex) {
+	if b.room != nil {
+		// release the blocked pushes, they check the new bound
+		b.room.Broadcast()
+	}
+	b.Bound = nb
+	if b.Sample < 1 {
+		b.Sample = 1
+	}
+	b.room = sync.NewCond(mu)
+	b.seen = 0
+}
+
+// Whether a push may go ahead, with the queue locked, and the number of
+// pushes the pushed value stands for. drop removes the oldest value not
+// consumed yet and reports whether there was one.
+func (b *bound) admit(mu *sync.Mutex, length *int, drop func() bool) (bool, int) {
+	if b.closed {
+		return false, 0
+	}
+	if b.Capacity <= 0 {
+		return true, 1
+	}
+	switch b.Policy {
+	case OVERLOAD_BLOCK:
+		if *length < b.Capacity {
+			return true, 1
+		}
+		if b.Blocked != nil {
+			b.Blocked()
+		}
+		for !b.closed && b.Capacity > 0 && *length >= b.Capacity {
+			b.room.Wait()
+		}
+		return !b.closed, 1
+	case OVERLOAD_DROP_OLDEST:
+		if *length < b.Capacity {
+			return true, 1
+		}
+		b.shed()
+		return drop(), 1
+	case OVERLOAD_SAMPLE:
+		if *length >= b.Capacity {
+			b.shed()
+			return false, 0
+		}
+		if *length < b.Capacity-b.Capacity/4 {
+			return true, 1
+		}
+		b.seen++
+		if b.seen%b.Sample != 0 {
+			b.shed()
+			return false, 0
+		}
+		return true, b.Sample
+	}
+	return true, 1
+}
+
+func (b *bound) close() {
+	b.closed = true
+	if b.room != nil {
+		b.room.Broadcast()
+	}
+}
+
+func (b *bound) shed() {
+	if b.Shed != nil {
+		b.Shed()
+	}
+}
+
+// Values left the queue
+func (b *bound) popped() {
+	if b.room != nil {
+		b.room.Broadcast()
+	}
+}
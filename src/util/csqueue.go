@@ -111,6 +111,11 @@ type GCsqueue[T QueueType] struct {
 	end    *gnode[T]
 	length int
 	mu     sync.Mutex
+	bound
+
+	// Called with the queue locked for every value pushed, with 1, and
+	// popped or dropped, with -1. Set before the queue is shared.
+	Count func(v T, delta int)
 }
 
 func NewGCsqueue[T QueueType]() *GCsqueue[T] {
@@ -132,13 +137,39 @@ func (cq *GCsqueue[T]) Push(v T, utime int64) {
 		cq.end = n
 	}
 	cq.length++
+	if cq.Count != nil {
+		cq.Count(v, 1)
+	}
 }
 
+// Push within the bound of the queue, see SetBound. Push ignores it.
 func (cq *GCsqueue[T]) CsPush(v T, utime int64) {
 	cq.mu.Lock()
 	defer cq.mu.Unlock()
 
-	cq.Push(v, utime)
+	if ok, _ := cq.admit(&cq.mu, &cq.length, cq.dropOldest); ok {
+		cq.Push(v, utime)
+	}
+}
+
+func (cq *GCsqueue[T]) dropOldest() bool {
+	_, ok := cq.Pop()
+	return ok
+}
+
+func (cq *GCsqueue[T]) SetBound(b Bound) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	cq.setBound(b, &cq.mu)
+}
+
+// Refuse any further push and release the blocked ones
+func (cq *GCsqueue[T]) Close() {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	cq.close()
 }
 
 func (cq *GCsqueue[T]) Pop() (T, bool) {
@@ -157,6 +188,10 @@ func (cq *GCsqueue[T]) Pop() (T, bool) {
 	n.next = nil
 	n.prev = nil
 	cq.length--
+	cq.popped()
+	if cq.Count != nil {
+		cq.Count(n.v, -1)
+	}
 	return n.v, true
 }
 
@@ -185,154 +220,21 @@ func (cq *GCsqueue[T]) CsPopOverTime(utime int64) (T, bool) {
 	return v, false
 }
 
-// As Flow Queue needs another three pointers, we rewrite the flow queue
-type flownode struct {
-	next  *flownode
-	v     bgp.Flow
-	utime int64
-}
-
-type FlowCsqueue struct {
-	pri_s_t    int64
-	pri_e_t    int64
-	post_s_t   int64
-	post_e_t   int64
-	length     int
-	pri_start  *flownode // = q_start
-	pri_end    *flownode
-	post_start *flownode
-	post_end   *flownode
-	q_end      *flownode
-	mu         sync.Mutex
-}
-
-func NewFlowCsqueue() *FlowCsqueue {
-	fq := new(FlowCsqueue)
-	fq.pri_start = &flownode{next: nil, utime: int64((^uint64(0)) >> 1)}
-	fq.pri_end = fq.pri_start
-	fq.post_end = fq.pri_start
-	fq.post_start = fq.pri_start
-	fq.q_end = fq.pri_start
-	fq.length = 0
-	return fq
-}
-
-func (cq *FlowCsqueue) Push(v bgp.Flow, utime int64) {
-
-	n := &flownode{nil, v, utime}
-	if cq.length == 0 {
-		cq.pri_start.next = n
-		cq.q_end = n
-	} else {
-		cq.q_end.next = n
-		cq.q_end = n
-	}
-	cq.length++
-}
-
-func (cq *FlowCsqueue) CsPush(v bgp.Flow, utime int64) {
-	cq.mu.Lock()
-	defer cq.mu.Unlock()
-
-	cq.Push(v, utime)
-}
-
-// save one local variable copy
-func (cq *FlowCsqueue) PopWoReturn() {
-	n := cq.pri_start.next
-	if n.next == nil {
-		cq.pri_start.next = nil
-		cq.pri_end = cq.pri_start
-		cq.post_start = cq.pri_start
-		cq.post_end = cq.pri_start
-		cq.q_end = cq.pri_start
-	} else {
-		cq.pri_start.next = n.next
-	}
-	n.next = nil
-	cq.length--
-}
-
-func (cq *FlowCsqueue) CsPopPriStartOverTime(v_ptr *bgp.Flow) bool {
-	cq.mu.Lock()
-	defer cq.mu.Unlock()
-
-	if cq.length == 0 {
-		return false
-	}
-	if cq.pri_start.next.utime <= cq.pri_s_t {
-		*v_ptr = cq.pri_start.next.v
-		cq.PopWoReturn()
-		return true
-	}
-	return false
-}
-
-func (cq *FlowCsqueue) CsOnePriEndOvertime(v_ptr *bgp.Flow) bool {
-	cq.mu.Lock()
-	defer cq.mu.Unlock()
-
-	if cq.length == 0 {
-		return false
-	}
-	if cq.pri_end.next == nil {
-		return false
-	}
-	if cq.pri_end.next.utime <= cq.pri_e_t {
-		*v_ptr = cq.pri_end.next.v
-		cq.pri_end = cq.pri_end.next
-		return true
-	}
-	return false
-}
-
-func (cq *FlowCsqueue) CsOnePostStartOvertime(v_ptr *bgp.Flow) bool {
+// Copy the queued values and their utimes, used for checkpoints
+func (cq *GCsqueue[T]) CsItems() ([]T, []int64) {
 	cq.mu.Lock()
 	defer cq.mu.Unlock()
 
-	if cq.length == 0 {
-		return false
-	}
-	if cq.post_start.next == nil {
-		return false
-	}
-	if cq.post_start.next.utime <= cq.post_s_t {
-		*v_ptr = cq.post_start.next.v
-		cq.post_start = cq.post_start.next
-		return true
+	values := make([]T, 0, cq.length)
+	utimes := make([]int64, 0, cq.length)
+	for n := cq.start; n != nil; n = n.next {
+		values = append(values, n.v)
+		utimes = append(utimes, n.utime)
 	}
-	return false
-}
-
-func (cq *FlowCsqueue) CsOnePostEndOvertime(v_ptr *bgp.Flow) bool {
-	cq.mu.Lock()
-	defer cq.mu.Unlock()
-
-	if cq.length == 0 {
-		return false
-	}
-	if cq.post_end.next == nil {
-		return false
-	}
-	if cq.post_end.next.utime <= cq.post_e_t {
-		*v_ptr = cq.post_end.next.v
-		cq.post_end = cq.post_end.next
-		return true
-	}
-	return false
-}
-
-func (cq *FlowCsqueue) ModifyTime(utime int64, delay int64, agetime int64, syncdevi int64) {
-	cq.mu.Lock()
-	defer cq.mu.Unlock()
-
-	cq.pri_s_t = utime - delay - 2*agetime
-	cq.pri_e_t = utime - delay - agetime - syncdevi
-	cq.post_s_t = utime - delay - agetime + syncdevi
-	cq.post_e_t = utime - delay
+	return values, utimes
 }
 
-func (cq *FlowCsqueue) GetLength() int {
+func (cq *GCsqueue[T]) GetLength() int {
 	cq.mu.Lock()
 	defer cq.mu.Unlock()
 
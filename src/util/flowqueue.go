@@ -0,0 +1,425 @@
+package util
+
+import (
+	"anaflow/src/bgp"
+	"sync"
+)
+
+/*
+The flow queue.
+
+Flows are pushed once, in arrival order, and shared by every window. Each
+window walks them with its own FlowCursors as the analysis time goes by, each
+cursor up to the flows whose utime is past its time:
+
+	pri_start <= pri_end <= post_start <= post_end <= q_end
+
+post_end adds the flows to the post maps of a window, post_start removes them,
+pri_end adds them to the pri maps and pri_start removes them. A cursor stops
+at the first flow it is not due for. A flow is popped off the queue once the
+pri_start of every window has passed it.
+
+The flows are kept in chunks of flowChunkSize, the utimes apart so that the
+cursors scan them without touching the flows. A chunk is reused once it is
+popped: as many are kept for the next pushes as the queued flows fill, and at
+least minSpareChunks, so that a steady flow rate allocates nothing. A cursor
+is the position of the next flow it examines.
+*/
+
+const flowChunkSize = 1024 // 64 KiB of flows and utimes
+const minSpareChunks = 16
+
+type flowChunk struct {
+	flows  [flowChunkSize]bgp.Flow
+	utimes [flowChunkSize]int64
+	lo, hi int    // the flows in the chunk, dropped ones below lo
+	seq    uint64 // order of the chunk in the queue
+	next   *flowChunk
+}
+
+// Position of the next flow a cursor examines. It only sits at the end of a
+// chunk if that chunk is the last one.
+type flowPos struct {
+	c *flowChunk
+	i int
+}
+
+func (p flowPos) before(o flowPos) bool {
+	return p.c.seq < o.c.seq || (p.c == o.c && p.i < o.i)
+}
+
+// Move p past the end of its chunk to the next one
+func (p *flowPos) normalize() {
+	for p.i >= p.c.hi && p.c.next != nil {
+		p.c = p.c.next
+		p.i = p.c.lo
+	}
+}
+
+// The cursors, for CsAdvance
+type FlowCursor int
+
+const (
+	PRI_START FlowCursor = iota
+	PRI_END
+	POST_START
+	POST_END
+)
+
+// The cursors of one window, guarded by the mutex of their queue
+type FlowCursors struct {
+	cq       *FlowCsqueue
+	pri_s_t  int64
+	pri_e_t  int64
+	post_s_t int64
+	post_e_t int64
+	pos      [4]flowPos // by FlowCursor
+}
+
+type FlowCsqueue struct {
+	length int
+	head   *flowChunk
+	tail   *flowChunk // q_end is tail.hi
+	seq    uint64     // of the next chunk
+	sets   []*FlowCursors
+	spare  *flowChunk
+	nspare int
+	mu     sync.Mutex
+	bound
+}
+
+func NewFlowCsqueue() *FlowCsqueue {
+	fq := new(FlowCsqueue)
+	fq.head = fq.newChunk()
+	fq.reset()
+	return fq
+}
+
+// Cursors for one more window, at the start of the queue
+func (cq *FlowCsqueue) NewCursors() *FlowCursors {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	cs := &FlowCursors{cq: cq}
+	for i := range cs.pos {
+		cs.pos[i] = flowPos{cq.head, cq.head.lo}
+	}
+	cq.sets = append(cq.sets, cs)
+	return cs
+}
+
+// Empty the queue down to its head chunk
+func (cq *FlowCsqueue) reset() {
+	for c := cq.head.next; c != nil; {
+		next := c.next
+		cq.recycle(c)
+		c = next
+	}
+	cq.head.lo, cq.head.hi, cq.head.next = 0, 0, nil
+	cq.tail = cq.head
+	for _, p := range cq.cursors() {
+		*p = flowPos{cq.head, 0}
+	}
+	cq.length = 0
+}
+
+func (cq *FlowCsqueue) recycle(c *flowChunk) {
+	if cq.nspare >= minSpareChunks && cq.nspare >= cq.length/flowChunkSize {
+		return
+	}
+	c.lo, c.hi = 0, 0
+	c.next = cq.spare
+	cq.spare = c
+	cq.nspare++
+}
+
+func (cq *FlowCsqueue) newChunk() *flowChunk {
+	c := cq.spare
+	if c == nil {
+		c = new(flowChunk)
+	} else {
+		cq.spare = c.next
+		cq.nspare--
+		c.next = nil
+	}
+	c.seq = cq.seq
+	cq.seq++
+	return c
+}
+
+// Every cursor of every window
+func (cq *FlowCsqueue) cursors() []*flowPos {
+	ps := make([]*flowPos, 0, 4*len(cq.sets))
+	for _, cs := range cq.sets {
+		for i := range cs.pos {
+			ps = append(ps, &cs.pos[i])
+		}
+	}
+	return ps
+}
+
+func (cq *FlowCsqueue) Push(v bgp.Flow, utime int64) {
+	c := cq.tail
+	if c.hi == flowChunkSize {
+		c.next = cq.newChunk()
+		cq.tail = c.next
+		for _, cs := range cq.sets {
+			for i := range cs.pos {
+				cs.pos[i].normalize()
+			}
+		}
+		c = cq.tail
+	}
+	c.flows[c.hi] = v
+	c.utimes[c.hi] = utime
+	c.hi++
+	cq.length++
+}
+
+// Push within the bound of the queue, see SetBound. Push ignores it.
+func (cq *FlowCsqueue) CsPush(v bgp.Flow, utime int64) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	if ok, scale := cq.admit(&cq.mu, &cq.length, cq.dropOldest); ok {
+		// a sampled flow stands for the ones dropped
+		v.Size *= uint64(scale)
+		cq.Push(v, utime)
+	}
+}
+
+// Refuse any further push and release the blocked ones
+func (cq *FlowCsqueue) Close() {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	cq.close()
+}
+
+// Drop the oldest flow no cursor has reached. The flows behind a post_end are
+// in the maps of its window, which only forget them at pri_start.
+//
+// The flows of its chunk below it shift up over it, the cursors among them
+// with them: at most a chunk is copied.
+func (cq *FlowCsqueue) dropOldest() bool {
+	at := flowPos{cq.head, cq.head.lo}
+	for _, cs := range cq.sets {
+		if at.before(cs.pos[POST_END]) {
+			at = cs.pos[POST_END]
+		}
+	}
+	c, i := at.c, at.i
+	if i >= c.hi {
+		return false
+	}
+	copy(c.flows[c.lo+1:i+1], c.flows[c.lo:i])
+	copy(c.utimes[c.lo+1:i+1], c.utimes[c.lo:i])
+	c.lo++
+	for _, cs := range cq.sets {
+		for j := range cs.pos {
+			if p := &cs.pos[j]; p.c == c && p.i <= i {
+				p.i++
+				p.normalize()
+			}
+		}
+	}
+	cq.length--
+	if cq.length == 0 {
+		cq.reset()
+	} else {
+		cq.popEmpty()
+	}
+	return true
+}
+
+func (cq *FlowCsqueue) SetBound(b Bound) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	cq.setBound(b, &cq.mu)
+}
+
+// Unlink the emptied chunks at the head. The cursors are never behind the
+// head, those on a chunk unlinked move to the new head.
+func (cq *FlowCsqueue) popEmpty() {
+	for cq.head.lo == cq.head.hi && cq.head.next != nil {
+		old := cq.head
+		cq.head = old.next
+		for _, p := range cq.cursors() {
+			if p.c == old {
+				*p = flowPos{cq.head, cq.head.lo}
+			}
+		}
+		cq.recycle(old)
+	}
+}
+
+// Pop the flows every pri_start has passed
+func (cq *FlowCsqueue) trim() {
+	if len(cq.sets) == 0 {
+		return
+	}
+	min := cq.sets[0].pos[PRI_START]
+	for _, cs := range cq.sets[1:] {
+		if cs.pos[PRI_START].before(min) {
+			min = cs.pos[PRI_START]
+		}
+	}
+	popped := false
+	for cq.length > 0 && (flowPos{cq.head, cq.head.lo}).before(min) {
+		cq.head.lo++
+		cq.length--
+		popped = true
+		if cq.head.lo == cq.head.hi {
+			if cq.length == 0 {
+				cq.reset()
+				break
+			}
+			cq.popEmpty()
+		}
+	}
+	if popped {
+		cq.popped()
+	}
+}
+
+// Advance p over the flows due by utime, appending them to buf
+func advance(p *flowPos, utime int64, buf []bgp.Flow) []bgp.Flow {
+	for {
+		c := p.c
+		j := p.i
+		for j < c.hi && c.utimes[j] <= utime {
+			j++
+		}
+		buf = append(buf, c.flows[p.i:j]...)
+		p.i = j
+		if j < c.hi || c.next == nil {
+			return buf
+		}
+		p.normalize()
+	}
+}
+
+// Advance a cursor over every flow it is due for, under one lock, and append
+// them to buf. The flows every window passed with PRI_START are popped.
+func (cs *FlowCursors) CsAdvance(cursor FlowCursor, buf []bgp.Flow) []bgp.Flow {
+	cq := cs.cq
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	switch cursor {
+	case PRI_START:
+		buf = advance(&cs.pos[PRI_START], cs.pri_s_t, buf)
+		// the other cursors never lag behind it, as with a pop
+		for i := range cs.pos {
+			if cs.pos[i].before(cs.pos[PRI_START]) {
+				cs.pos[i] = cs.pos[PRI_START]
+			}
+		}
+		cq.trim()
+		return buf
+	case PRI_END:
+		return advance(&cs.pos[PRI_END], cs.pri_e_t, buf)
+	case POST_START:
+		return advance(&cs.pos[POST_START], cs.post_s_t, buf)
+	}
+	return advance(&cs.pos[POST_END], cs.post_e_t, buf)
+}
+
+func (cs *FlowCursors) ModifyTime(utime int64, delay int64, agetime int64, syncdevi int64) {
+	cs.cq.mu.Lock()
+	defer cs.cq.mu.Unlock()
+
+	cs.pri_s_t = utime - delay - 2*agetime
+	cs.pri_e_t = utime - delay - agetime - syncdevi
+	cs.post_s_t = utime - delay - agetime + syncdevi
+	cs.post_e_t = utime - delay
+}
+
+// Times of the four cursors as set by the last ModifyTime
+func (cs *FlowCursors) CursorTimes() (pri_s_t int64, pri_e_t int64, post_s_t int64, post_e_t int64) {
+	cs.cq.mu.Lock()
+	defer cs.cq.mu.Unlock()
+
+	return cs.pri_s_t, cs.pri_e_t, cs.post_s_t, cs.post_e_t
+}
+
+// Flows from pri_start to the queue end
+func (cs *FlowCursors) GetLength() int {
+	cs.cq.mu.Lock()
+	defer cs.cq.mu.Unlock()
+
+	return cs.cq.length - cs.cq.offset(cs.pos[PRI_START])
+}
+
+func (cq *FlowCsqueue) GetLength() int {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	l := cq.length
+	return l
+}
+
+// Number of flows from the queue start to p
+func (cq *FlowCsqueue) offset(p flowPos) int {
+	n := 0
+	for c := cq.head; c != p.c; c = c.next {
+		n += c.hi - c.lo
+	}
+	return n + p.i - p.c.lo
+}
+
+// Position after the first n flows
+func (cq *FlowCsqueue) seek(n int) flowPos {
+	p := flowPos{cq.head, cq.head.lo}
+	for n > p.c.hi-p.i && p.c.next != nil {
+		n -= p.c.hi - p.i
+		p = flowPos{p.c.next, p.c.next.lo}
+	}
+	if n > p.c.hi-p.i {
+		n = p.c.hi - p.i
+	}
+	p.i += n
+	p.normalize()
+	return p
+}
+
+// Copy the queued flows and their utimes. The cursors of each of sets are
+// returned as the number of flows from the queue start they have passed, in
+// FlowCursor order.
+func (cq *FlowCsqueue) CsSnapshot(sets []*FlowCursors) (flows []bgp.Flow, utimes []int64, offsets [][4]int) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	flows = make([]bgp.Flow, 0, cq.length)
+	utimes = make([]int64, 0, cq.length)
+	for c := cq.head; c != nil; c = c.next {
+		flows = append(flows, c.flows[c.lo:c.hi]...)
+		utimes = append(utimes, c.utimes[c.lo:c.hi]...)
+	}
+	offsets = make([][4]int, len(sets))
+	for i, cs := range sets {
+		for j := range cs.pos {
+			offsets[i][j] = cq.offset(cs.pos[j])
+		}
+	}
+	return flows, utimes, offsets
+}
+
+// Rebuild the queue from a snapshot taken by CsSnapshot, with the cursors of
+// sets at offsets. Any queued flow is dropped, the other cursors start over.
+func (cq *FlowCsqueue) CsRestore(flows []bgp.Flow, utimes []int64, sets []*FlowCursors, offsets [][4]int) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	cq.reset()
+	for i := range flows {
+		cq.Push(flows[i], utimes[i])
+	}
+	for i, cs := range sets {
+		for j := range cs.pos {
+			cs.pos[j] = cq.seek(offsets[i][j])
+		}
+	}
+	cq.trim()
+}
@@ -0,0 +1,335 @@
+package util
+
+import (
+	"anaflow/src/bgp"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// Push n flows, the i-th with utime and Size i
+func pushFlows(cq *FlowCsqueue, from int, n int) {
+	for i := from; i < from+n; i++ {
+		cq.Push(bgp.Flow{Size: uint64(i)}, int64(i))
+	}
+}
+
+func checkFlows(t *testing.T, what string, got []bgp.Flow, want []int) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: %d flows, want %d", what, len(got), len(want))
+	}
+	for i := range got {
+		if got[i].Size != uint64(want[i]) {
+			t.Fatalf("%s: flow %d is %d, want %d", what, i, got[i].Size, want[i])
+		}
+	}
+}
+
+func span(from int, to int) []int {
+	var s []int
+	for i := from; i < to; i++ {
+		s = append(s, i)
+	}
+	return s
+}
+
+func TestFlowCursorsAcrossChunks(t *testing.T) {
+	cq := NewFlowCsqueue()
+	cs := cq.NewCursors()
+	n := 3*flowChunkSize + 10
+	pushFlows(cq, 0, n)
+
+	// post_end 2500, post_start and pri_end 1500, pri_start 500
+	cs.ModifyTime(2500, 0, 1000, 0)
+	checkFlows(t, "post_end", cs.CsAdvance(POST_END, nil), span(0, 2501))
+	checkFlows(t, "post_start", cs.CsAdvance(POST_START, nil), span(0, 1501))
+	checkFlows(t, "pri_end", cs.CsAdvance(PRI_END, nil), span(0, 1501))
+	checkFlows(t, "pri_start", cs.CsAdvance(PRI_START, nil), span(0, 501))
+	if l := cq.GetLength(); l != n-501 {
+		t.Fatalf("queue length %d after pri_start, want %d", l, n-501)
+	}
+
+	// one second at a time, pri_start over the end of the first chunk and
+	// post_start over the end of the second
+	for sec := 1501; sec <= 2*flowChunkSize+3; sec++ {
+		cs.ModifyTime(int64(sec)+1000, 0, 1000, 0)
+		checkFlows(t, "post_end", cs.CsAdvance(POST_END, nil), span(sec+1000, sec+1001))
+		checkFlows(t, "post_start", cs.CsAdvance(POST_START, nil), []int{sec})
+		checkFlows(t, "pri_end", cs.CsAdvance(PRI_END, nil), []int{sec})
+		checkFlows(t, "pri_start", cs.CsAdvance(PRI_START, nil), []int{sec - 1000})
+	}
+
+	// past the end, and pushes after it
+	cs.ModifyTime(int64(3*n), 0, 1, 0)
+	for _, cursor := range []FlowCursor{POST_END, POST_START, PRI_END} {
+		cs.CsAdvance(cursor, nil)
+	}
+	cs.CsAdvance(PRI_START, nil)
+	if l := cq.GetLength(); l != 0 {
+		t.Fatalf("queue length %d once every cursor passed it, want 0", l)
+	}
+	pushFlows(cq, n, flowChunkSize+1)
+	checkFlows(t, "post_end after the end", cs.CsAdvance(POST_END, nil), span(n, n+flowChunkSize+1))
+}
+
+func TestFlowCursorsOfTwoWindows(t *testing.T) {
+	cq := NewFlowCsqueue()
+	short := cq.NewCursors()
+	long := cq.NewCursors()
+	pushFlows(cq, 0, 2*flowChunkSize)
+
+	// the flows leave the queue once both pri_start cursors have passed them
+	short.ModifyTime(1500, 0, 100, 0)
+	long.ModifyTime(1500, 0, 500, 0)
+	for _, cs := range []*FlowCursors{short, long} {
+		for _, cursor := range []FlowCursor{POST_END, POST_START, PRI_END, PRI_START} {
+			cs.CsAdvance(cursor, nil)
+		}
+	}
+	if l := cq.GetLength(); l != 2*flowChunkSize-501 {
+		t.Fatalf("queue length %d, want %d", l, 2*flowChunkSize-501)
+	}
+	if l := short.GetLength(); l != 2*flowChunkSize-1301 {
+		t.Fatalf("length from the short pri_start %d, want %d", l, 2*flowChunkSize-1301)
+	}
+}
+
+func TestFlowDropOldestInCursorChunk(t *testing.T) {
+	cq := NewFlowCsqueue()
+	a := cq.NewCursors()
+	b := cq.NewCursors()
+	pushFlows(cq, 0, 10)
+	a.ModifyTime(2, 0, 100, 0)
+	b.ModifyTime(4, 0, 100, 0)
+	checkFlows(t, "post_end a", a.CsAdvance(POST_END, nil), span(0, 3))
+	checkFlows(t, "post_end b", b.CsAdvance(POST_END, nil), span(0, 5))
+
+	// the oldest flow no post_end has reached is 5, the cursors below it shift
+	cq.SetBound(Bound{Capacity: 10, Policy: OVERLOAD_DROP_OLDEST})
+	cq.CsPush(bgp.Flow{Size: 10}, 10)
+	if l := cq.GetLength(); l != 10 {
+		t.Fatalf("queue length %d, want 10", l)
+	}
+	a.ModifyTime(100, 0, 1, 0)
+	b.ModifyTime(100, 0, 1, 0)
+	checkFlows(t, "post_end a", a.CsAdvance(POST_END, nil), []int{3, 4, 6, 7, 8, 9, 10})
+	checkFlows(t, "post_end b", b.CsAdvance(POST_END, nil), []int{6, 7, 8, 9, 10})
+	checkFlows(t, "post_start a", a.CsAdvance(POST_START, nil), []int{0, 1, 2, 3, 4, 6, 7, 8, 9, 10})
+
+	// every flow is in use, the pushed one is dropped
+	cq.CsPush(bgp.Flow{Size: 11}, 11)
+	if l := cq.GetLength(); l != 10 {
+		t.Fatalf("queue length %d with every flow in use, want 10", l)
+	}
+}
+
+func TestFlowSnapshotRestore(t *testing.T) {
+	cq := NewFlowCsqueue()
+	a := cq.NewCursors()
+	b := cq.NewCursors()
+	pushFlows(cq, 0, 3*flowChunkSize)
+	a.ModifyTime(2000, 0, 600, 10)
+	b.ModifyTime(2000, 0, 300, 10)
+	for _, cs := range []*FlowCursors{a, b} {
+		for _, cursor := range []FlowCursor{POST_END, POST_START, PRI_END, PRI_START} {
+			cs.CsAdvance(cursor, nil)
+		}
+	}
+	flows, utimes, offsets := cq.CsSnapshot([]*FlowCursors{a, b})
+
+	restored := NewFlowCsqueue()
+	ra := restored.NewCursors()
+	rb := restored.NewCursors()
+	restored.CsRestore(flows, utimes, []*FlowCursors{ra, rb}, offsets)
+	flows2, utimes2, offsets2 := restored.CsSnapshot([]*FlowCursors{ra, rb})
+	if len(flows2) != len(flows) || offsets2[0] != offsets[0] || offsets2[1] != offsets[1] {
+		t.Fatalf("restored %d flows at %v, want %d at %v", len(flows2), offsets2, len(flows), offsets)
+	}
+	for i := range flows {
+		if flows2[i] != flows[i] || utimes2[i] != utimes[i] {
+			t.Fatalf("restored flow %d differs", i)
+		}
+	}
+
+	// both queues go on alike
+	for _, pair := range [][2]*FlowCursors{{a, ra}, {b, rb}} {
+		for _, cs := range pair {
+			cs.ModifyTime(3000, 0, 300, 10)
+		}
+		for _, cursor := range []FlowCursor{POST_END, POST_START, PRI_END, PRI_START} {
+			got := pair[1].CsAdvance(cursor, nil)
+			want := pair[0].CsAdvance(cursor, nil)
+			if len(got) != len(want) || (len(got) > 0 && got[0] != want[0]) {
+				t.Fatalf("cursor %d of the restored queue passed %d flows, want %d", cursor, len(got), len(want))
+			}
+		}
+	}
+}
+
+// The linked-node flow queue the chunks replaced, one node per flow and the
+// cursors advanced one flow per call. Kept as the baseline of the benchmarks,
+// without the bound.
+type linkedFlowNode struct {
+	next  *linkedFlowNode
+	v     bgp.Flow
+	utime int64
+}
+
+type linkedFlowCsqueue struct {
+	pri_s_t    int64
+	pri_e_t    int64
+	post_s_t   int64
+	post_e_t   int64
+	length     int
+	pri_start  *linkedFlowNode // = q_start
+	pri_end    *linkedFlowNode
+	post_start *linkedFlowNode
+	post_end   *linkedFlowNode
+	q_end      *linkedFlowNode
+	mu         sync.Mutex
+}
+
+func newLinkedFlowCsqueue() *linkedFlowCsqueue {
+	fq := new(linkedFlowCsqueue)
+	fq.pri_start = &linkedFlowNode{next: nil, utime: int64((^uint64(0)) >> 1)}
+	fq.pri_end = fq.pri_start
+	fq.post_end = fq.pri_start
+	fq.post_start = fq.pri_start
+	fq.q_end = fq.pri_start
+	return fq
+}
+
+func (cq *linkedFlowCsqueue) CsPush(v bgp.Flow, utime int64) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	n := &linkedFlowNode{nil, v, utime}
+	if cq.length == 0 {
+		cq.pri_start.next = n
+	} else {
+		cq.q_end.next = n
+	}
+	cq.q_end = n
+	cq.length++
+}
+
+func (cq *linkedFlowCsqueue) popWoReturn() {
+	n := cq.pri_start.next
+	if n.next == nil {
+		cq.pri_start.next = nil
+		cq.pri_end = cq.pri_start
+		cq.post_start = cq.pri_start
+		cq.post_end = cq.pri_start
+		cq.q_end = cq.pri_start
+	} else {
+		cq.pri_start.next = n.next
+	}
+	n.next = nil
+	cq.length--
+}
+
+func (cq *linkedFlowCsqueue) CsPopPriStartOverTime(v_ptr *bgp.Flow) bool {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	if cq.length == 0 || cq.pri_start.next.utime > cq.pri_s_t {
+		return false
+	}
+	*v_ptr = cq.pri_start.next.v
+	cq.popWoReturn()
+	return true
+}
+
+// Advance *p over one flow if it is due by utime
+func (cq *linkedFlowCsqueue) csOneOvertime(p **linkedFlowNode, utime int64, v_ptr *bgp.Flow) bool {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	if cq.length == 0 || (*p).next == nil || (*p).next.utime > utime {
+		return false
+	}
+	*v_ptr = (*p).next.v
+	*p = (*p).next
+	return true
+}
+
+func (cq *linkedFlowCsqueue) ModifyTime(utime int64, delay int64, agetime int64, syncdevi int64) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	cq.pri_s_t = utime - delay - 2*agetime
+	cq.pri_e_t = utime - delay - agetime - syncdevi
+	cq.post_s_t = utime - delay - agetime + syncdevi
+	cq.post_e_t = utime - delay
+}
+
+// One interval of 1M flows pushed, then a tick with an agetime of one
+// interval: post_end passes the interval, post_start and pri_end the one
+// before and pri_start pops the one two before, as the analysis does at a high
+// flow rate. The queue holds about 3M flows, the intervals before the timer
+// starts fill it.
+const benchFlows = 1 << 20
+const benchWarmup = 3
+
+func numGC() uint32 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.NumGC
+}
+
+// Start timing once the warmup intervals are done, and report the GC cycles
+// per interval when stop is called
+func benchStart(b *testing.B) (stop func()) {
+	b.ReportAllocs()
+	gcs := numGC()
+	b.ResetTimer()
+	return func() {
+		b.StopTimer()
+		b.ReportMetric(float64(numGC()-gcs)/float64(b.N), "gcs/op")
+	}
+}
+
+func BenchmarkFlowCsqueueInterval(b *testing.B) {
+	cq := NewFlowCsqueue()
+	cs := cq.NewCursors()
+	var buf []bgp.Flow
+	var stop func()
+	for n := 0; n < b.N+benchWarmup; n++ {
+		if n == benchWarmup {
+			stop = benchStart(b)
+		}
+		for i := 0; i < benchFlows; i++ {
+			cq.CsPush(bgp.Flow{Size: uint64(i)}, int64(n))
+		}
+		cs.ModifyTime(int64(n), 0, 1, 0)
+		for _, cursor := range []FlowCursor{POST_END, POST_START, PRI_END, PRI_START} {
+			buf = cs.CsAdvance(cursor, buf[:0])
+		}
+	}
+	stop()
+}
+
+func BenchmarkLinkedFlowCsqueueInterval(b *testing.B) {
+	cq := newLinkedFlowCsqueue()
+	var flow bgp.Flow
+	var stop func()
+	for n := 0; n < b.N+benchWarmup; n++ {
+		if n == benchWarmup {
+			stop = benchStart(b)
+		}
+		for i := 0; i < benchFlows; i++ {
+			cq.CsPush(bgp.Flow{Size: uint64(i)}, int64(n))
+		}
+		cq.ModifyTime(int64(n), 0, 1, 0)
+		for cq.csOneOvertime(&cq.post_end, cq.post_e_t, &flow) {
+		}
+		for cq.csOneOvertime(&cq.post_start, cq.post_s_t, &flow) {
+		}
+		for cq.csOneOvertime(&cq.pri_end, cq.pri_e_t, &flow) {
+		}
+		for cq.CsPopPriStartOverTime(&flow) {
+		}
+	}
+	stop()
+}
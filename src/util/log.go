@@ -0,0 +1,54 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Messages below this level are not printed
+var Log_level = LevelInfo
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q (debug, info, warn or error)", s)
+}
+
+func logf(level LogLevel, format string, args ...interface{}) {
+	if level >= Log_level {
+		fmt.Printf(format, args...)
+	}
+}
+
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+}
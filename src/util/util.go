@@ -2,11 +2,12 @@ package util
 
 import (
 	"fmt"
+	"net"
 )
 
 func CheckError(err error) bool {
 	if err != nil {
-		fmt.Printf("Error %s\n", err.Error())
+		Errorf("Error %s\n", err.Error())
 		return true
 	}
 	return false
@@ -41,3 +42,27 @@ func IPbyte2int(ip []byte) (ipint uint32) {
 	}
 	return ipint + t
 }
+
+// Convert "a.b.c.d/len" to the route prefix layout uint32 IP + uint8 Prefix
+func ParseRoute(cidr string) (uint64, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, err
+	}
+	ip := ipnet.IP.To4()
+	if ip == nil {
+		return 0, fmt.Errorf("not an IPv4 prefix: %s", cidr)
+	}
+	prefix, _ := ipnet.Mask.Size()
+	return uint64(IPbyte2int([]byte(ip.String())))<<8 + uint64(prefix), nil
+}
+
+func IPint2string(ip uint32) string {
+	return fmt.Sprintf("%d.%d.%d.%d", ip>>24, ip>>16&0xff, ip>>8&0xff, ip&0xff)
+}
+
+// Convert a route prefix uint32 IP + uint8 Prefix to "a.b.c.d/len"
+func RouteString(rp uint64) string {
+	prefix := rp & 0xff
+	return fmt.Sprintf("%s/%d", IPint2string(uint32(rp>>8)), prefix)
+}